@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/rtemka/rbtest/pkg/auth"
+)
+
+// newAuthenticator настраивает проверку подлинности по переменным
+// окружения apiKeysEnv, jwtSecretEnv, jwksEnv, audienceEnv и
+// issuerEnv. Если ни ключи, ни способ проверки токенов не заданы,
+// возвращает nil: API открыт.
+func newAuthenticator() (*auth.Authenticator, error) {
+	var opts []auth.Option
+	if path := os.Getenv(apiKeysEnv); path != "" {
+		keys, err := auth.LoadAPIKeys(path)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, auth.WithAPIKeys(keys))
+	}
+	if secret := os.Getenv(jwtSecretEnv); secret != "" {
+		opts = append(opts, auth.WithHMAC([]byte(secret)))
+	}
+	if path := os.Getenv(jwksEnv); path != "" {
+		keys, err := auth.LoadJWKS(path)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, auth.WithJWKS(keys))
+	}
+	if len(opts) == 0 {
+		return nil, nil
+	}
+
+	opts = append(opts, auth.WithAudience(os.Getenv(audienceEnv)), auth.WithIssuer(os.Getenv(issuerEnv)))
+	return auth.New(opts...)
+}
+
+// runHashKey выполняет команду
+//
+//	testapp hash-key
+//
+// и печатает хеш ключа API, прочитанного из stdin, для файла
+// ключей apiKeysEnv. Сам ключ в конфигурацию не попадает.
+func runHashKey() error {
+	key, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return errors.New("hash-key: the key must be passed on stdin")
+	}
+	fmt.Println(auth.HashAPIKey(key))
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	"github.com/joho/godotenv"
+	"github.com/rtemka/rbtest/pkg/importer"
+)
+
+// runImport выполняет команду
+//
+//	testapp import [-mode upsert|insert|replace] [-format json|ndjson|csv] [-dry-run] FILE
+//
+// и загружает объекты из файла (или stdin, если FILE равен "-")
+// напрямую в БД, выбранную переменными окружения, как и сервер.
+// Запущенный сервер увидит изменения при следующем обновлении кэша.
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	mode := fs.String("mode", string(importer.ModeUpsert), "upsert, insert or replace")
+	format := fs.String("format", "", "json, ndjson or csv (default: by file extension)")
+	dryRun := fs.Bool("dry-run", false, "validate the file without writing")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: testapp import [flags] FILE")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("import: exactly one FILE is required")
+	}
+
+	opts := importer.Options{Format: importer.Format(*format), DryRun: *dryRun}
+	var err error
+	if opts.Mode, err = importer.ParseMode(*mode); err != nil {
+		return err
+	}
+
+	path := fs.Arg(0)
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		if opts.Format == "" {
+			if opts.Format, err = importer.FormatOf(path); err != nil {
+				return err
+			}
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	if opts.Format == "" {
+		return errors.New("import: -format is required for stdin")
+	}
+
+	_ = godotenv.Load()
+	db, err := openRepo(os.Getenv(backendEnv))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	rep, err := importer.Import(ctx, db, in, opts)
+	if rep != nil {
+		printReport(os.Stdout, rep)
+	}
+	if err != nil {
+		return err
+	}
+	if !rep.OK() {
+		return fmt.Errorf("import: %d errors", len(rep.Errors)+rep.Omitted)
+	}
+	return nil
+}
+
+// printReport выводит отчет о загрузке.
+func printReport(w io.Writer, rep *importer.Report) {
+	for _, e := range rep.Errors {
+		fmt.Fprintln(w, e)
+	}
+	if rep.Omitted > 0 {
+		fmt.Fprintf(w, "... and %d more errors\n", rep.Omitted)
+	}
+
+	prefix := ""
+	if rep.DryRun {
+		prefix = "dry run: "
+	}
+	fmt.Fprintf(w, "%smode=%s records=%d created=%d updated=%d deleted=%d\n",
+		prefix, rep.Mode, rep.Records, rep.Created, rep.Updated, rep.Deleted)
+}
@@ -3,7 +3,8 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -14,20 +15,68 @@ import (
 	"github.com/joho/godotenv"
 	"github.com/rtemka/rbtest/domain"
 	"github.com/rtemka/rbtest/pkg/api"
+	"github.com/rtemka/rbtest/pkg/auth"
 	"github.com/rtemka/rbtest/pkg/cache"
+	"github.com/rtemka/rbtest/pkg/events"
+	"github.com/rtemka/rbtest/pkg/grpcapi"
+	"github.com/rtemka/rbtest/pkg/grpcapi/itempb"
+	"github.com/rtemka/rbtest/pkg/health"
+	"github.com/rtemka/rbtest/pkg/logging"
+	"github.com/rtemka/rbtest/pkg/metrics"
+	"github.com/rtemka/rbtest/pkg/repo/filedb"
+	"github.com/rtemka/rbtest/pkg/repo/memdb"
 	"github.com/rtemka/rbtest/pkg/repo/mongo"
+	"github.com/rtemka/rbtest/pkg/repo/sqlite"
+	"github.com/rtemka/rbtest/pkg/tracing"
+	"google.golang.org/grpc"
 )
 
 // переменная окружения.
 const (
-	portEnv = "APP_PORT"
-	dbEnv   = "DB_URL"
+	portEnv      = "APP_PORT"
+	grpcEnv      = "GRPC_PORT"      // необязательная, адрес gRPC API
+	validEnv     = "API_VALIDATE"   // необязательная, "true" включает проверку запросов по OpenAPI
+	levelEnv     = "LOG_LEVEL"      // необязательная, debug, info (по умолчанию), warn или error
+	traceEnv     = "TRACE_EXPORTER" // необязательная, none (по умолчанию), stdout, file или otlp
+	traceFileEnv = "TRACE_FILE"     // файл спанов для экспортера file
+	drainEnv     = "SHUTDOWN_DELAY" // необязательная, сколько /readyz отвечает 503 перед остановкой серверов, например, 5s
+	dbEnv        = "DB_URL"
+	feedEnv      = "CACHE_CHANGE_FEED" // необязательная, "true" включает поток изменений
+	backendEnv   = "DB_BACKEND"        // необязательная, mongo (по умолчанию), memdb, filedb или sqlite
+	seedEnv      = "MEMDB_SEED"        // необязательная, JSON-файл с объектами для memdb
+	fileDBEnv    = "FILEDB_DIR"        // каталог данных для filedb
+	sqliteEnv    = "SQLITE_PATH"       // файл БД для sqlite
+	apiKeysEnv   = "AUTH_API_KEYS"     // необязательная, JSON-файл хешей ключей API, см. testapp hash-key
+	jwtSecretEnv = "AUTH_JWT_SECRET"   // необязательная, секрет HMAC токенов, не короче 32 байт
+	jwksEnv      = "AUTH_JWKS"         // необязательная, JWKS-файл открытых ключей токенов
+	audienceEnv  = "AUTH_JWT_AUDIENCE" // обязательная для токенов, ожидаемый claim aud
+	issuerEnv    = "AUTH_JWT_ISSUER"   // необязательная, ожидаемый claim iss
 )
 
 const cacheUpdInterval = 5 * time.Second
 
+// интервал сверки кэша с БД в режиме потока изменений
+const cacheReconcileInterval = 5 * time.Minute
+
+// во сколько интервалов полной загрузки кэш может
+// не обновляться, прежде чем приложение перестанет быть готовым
+const cacheStaleIntervals = 3
+
+// сколько последних изменений хранится для переподключения
+// клиентов потока событий
+const eventsBufferSize = 1024
+
 func main() {
-	if err := run(); err != nil {
+	var err error
+	switch {
+	case len(os.Args) > 1 && os.Args[1] == "import":
+		err = runImport(os.Args[2:]) // testapp import - загрузка объектов из файла
+	case len(os.Args) > 1 && os.Args[1] == "hash-key":
+		err = runHashKey() // testapp hash-key - хеш ключа API для AUTH_API_KEYS
+	default:
+		err = run()
+	}
+	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
@@ -35,57 +84,193 @@ func main() {
 
 func run() error {
 	_ = godotenv.Load() // загружаем переменные окружения
-	em, err := envs(portEnv, dbEnv)
+	em, err := envs(portEnv)
 	if err != nil {
 		return err
 	}
 
-	db, err := mongo.New(em[dbEnv], "rbtest", "items")
+	// журнал в формате JSON, компоненты отмечаются атрибутом component
+	level, err := logging.ParseLevel(os.Getenv(levelEnv))
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	logger := logging.New(os.Stdout, level)
+	slog.SetDefault(logger)
+
+	// трассировка запросов через API, кэш и БД
+	shutdownTracing, err := tracing.Setup(context.Background(), os.Getenv(traceEnv), os.Getenv(traceFileEnv))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error("tracing shutdown failed", "err", err)
+		}
+	}()
+
+	drain, err := drainDelay()
+	if err != nil {
+		return err
+	}
+
+	// без ключей и настроек токенов API доступен всем
+	authn, err := newAuthenticator()
+	if err != nil {
+		return err
+	}
+	if authn == nil {
+		logger.Warn("authentication is disabled", "hint", "set "+apiKeysEnv+", "+jwtSecretEnv+" or "+jwksEnv)
+	}
+
+	db, err := openRepo(os.Getenv(backendEnv))
+	if err != nil {
+		return err
 	}
 	defer db.Close()
+	if m, ok := db.(*mongo.Mongo); ok {
+		m.Logger(logger.With("component", "repo"))
+	}
+
+	// проверки готовности, каждая зависимость
+	// регистрирует свою
+	h := health.New()
+	if p, ok := db.(pinger); ok {
+		h.Register("db", p.Ping)
+	}
 
 	// создание контекста для регулирования
 	// закрытие всех подсистем
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	cl := log.New(os.Stdout, "Cache:", log.Lmsgprefix|log.LstdFlags)
-	cache := cache.New(ctx, db, cl, cacheUpdInterval)
+	// изменения, которые видит кэш, рассылаются клиентам
+	// GET /items/events, /ws и gRPC Watch
+	feed := events.New(eventsBufferSize)
+
+	// метрики отдаются по GET /metrics, вызовы БД учитываются
+	// оберткой над ней, еще одна обертка пишет их в журнал
+	m := metrics.New()
+	repo := logging.Repository(m.Repository(db), logger.With("component", "repo"))
+
+	cache := newCache(ctx, repo, logger.With("component", "cache"),
+		cache.WithChangeHook(feed.Publish), cache.WithRefreshHook(m.ObserveRefresh))
+	m.RegisterCache(cache)
+	h.Register("cache", cache.Check(cacheStaleIntervals*cacheInterval()))
 
 	var wg sync.WaitGroup
 	wg.Add(1)
 
-	al := log.New(os.Stdout, "API:", log.Lmsgprefix|log.LstdFlags)
+	servers := []server{
+		startRestServer(ctx, cache, feed, m, h, authn, logger.With("component", "api"), em, &wg),
+	}
 
-	servers := []*http.Server{
-		startRestServer(cache, al, em, &wg),
+	if addr, ok := os.LookupEnv(grpcEnv); ok {
+		srv, err := startGRPCServer(cache, feed, authn, logger.With("component", "grpc"), addr, &wg)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, srv)
 	}
 
 	// логика закрытия сервера
-	cancelation(cancel, servers)
+	cancelation(logger, cancel, h, drain, servers)
 
 	wg.Wait()
 
 	return nil
 }
 
+// openRepo подключается к БД, выбранной переменной окружения backendEnv.
+func openRepo(backend string) (domain.Repository, error) {
+	switch backend {
+	case "", "mongo":
+		em, err := envs(dbEnv)
+		if err != nil {
+			return nil, err
+		}
+		return mongo.New(em[dbEnv], "rbtest", "items")
+
+	case "memdb":
+		if seed, ok := os.LookupEnv(seedEnv); ok {
+			return memdb.NewFromFile(seed)
+		}
+		return memdb.New(), nil
+
+	case "filedb":
+		em, err := envs(fileDBEnv)
+		if err != nil {
+			return nil, err
+		}
+		return filedb.Open(em[fileDBEnv])
+
+	case "sqlite":
+		em, err := envs(sqliteEnv)
+		if err != nil {
+			return nil, err
+		}
+		return sqlite.Open(em[sqliteEnv])
+	}
+	return nil, fmt.Errorf("unknown %s %q", backendEnv, backend)
+}
+
+// pinger БД, которая умеет проверять соединение.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// newCache создает кэш поверх БД. Если задана переменная
+// окружения feedEnv, кэш обновляется по потоку изменений БД.
+func newCache(ctx context.Context, db domain.Repository, logger *slog.Logger, opts ...cache.Option) *cache.Cache {
+	if os.Getenv(feedEnv) == "true" {
+		opts = append(opts, cache.WithChangeFeed(cacheUpdInterval))
+	}
+	return cache.New(ctx, db, logger, cacheInterval(), opts...)
+}
+
+// cacheInterval возвращает интервал полной загрузки кэша из БД.
+func cacheInterval() time.Duration {
+	if os.Getenv(feedEnv) == "true" {
+		return cacheReconcileInterval
+	}
+	return cacheUpdInterval
+}
+
+// drainDelay возвращает задержку остановки из переменной
+// окружения drainEnv, по умолчанию 0.
+func drainDelay() (time.Duration, error) {
+	v, ok := os.LookupEnv(drainEnv)
+	if !ok {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative duration, got %q", drainEnv, v)
+	}
+	return d, nil
+}
+
 // cancellation отслеживает сигналы прерывания и,
 // если они получены, отменяет контекст приложения и
-// "мягко" гасит серверы.
-func cancelation(cancel context.CancelFunc, servers []*http.Server) {
+// "мягко" гасит серверы. Перед остановкой серверов
+// приложение в течение drain отвечает на /readyz 503,
+// чтобы балансировщик успел перестать слать запросы.
+func cancelation(logger *slog.Logger, cancel context.CancelFunc, h *health.Checker, drain time.Duration, servers []server) {
 	// ловим сигналов прерывания, типа CTRL-C
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGQUIT)
 	go func() {
 		sig := <-stop // получили сигнал
-		log.Printf("got signal %q", sig)
+		logger.Info("shutting down", "signal", sig.String(), "drain", drain)
+
+		h.Drain()
+		time.Sleep(drain)
 
 		// закрываем серверы
 		for i := range servers {
 			if err := servers[i].Shutdown(context.Background()); err != nil {
-				log.Fatal(err)
+				fatal(logger, "shutdown failed", err)
 			}
 		}
 
@@ -93,6 +278,12 @@ func cancelation(cancel context.CancelFunc, servers []*http.Server) {
 	}()
 }
 
+// fatal пишет ошибку в журнал и завершает приложение.
+func fatal(logger *slog.Logger, msg string, err error) {
+	logger.Error(msg, "err", err)
+	os.Exit(1)
+}
+
 // envs собирает ожидаемые переменные окружения,
 // возвращает ошибку, если какая-либо из переменных env не задана.
 func envs(envs ...string) (map[string]string, error) {
@@ -107,9 +298,16 @@ func envs(envs ...string) (map[string]string, error) {
 }
 
 // startRestServer запускает сервер REST API.
-func startRestServer(db domain.Repository, logger *log.Logger, env map[string]string, wg *sync.WaitGroup) *http.Server {
+func startRestServer(ctx context.Context, db domain.Repository, feed *events.Feed, m *metrics.Metrics, h *health.Checker, authn *auth.Authenticator, logger *slog.Logger, env map[string]string, wg *sync.WaitGroup) *http.Server {
 	// REST API
-	api := api.New(db, logger, cacheUpdInterval)
+	opts := []api.Option{api.WithEvents(feed), api.WithMetrics(m), api.WithHealth(h)}
+	if os.Getenv(validEnv) == "true" {
+		opts = append(opts, api.WithValidation())
+	}
+	if authn != nil {
+		opts = append(opts, api.WithAuth(authn))
+	}
+	api := api.New(db, logger, cacheUpdInterval, opts...)
 
 	// конфигурируем сервер
 	srv := &http.Server{
@@ -117,14 +315,80 @@ func startRestServer(db domain.Repository, logger *log.Logger, env map[string]st
 		Handler:           api.Router(),
 		IdleTimeout:       3 * time.Minute,
 		ReadHeaderTimeout: time.Minute,
+		// запросы наследуют контекст приложения: соединения
+		// WebSocket, которые Shutdown не отслеживает, закрываются
+		// при его отмене
+		BaseContext: func(net.Listener) context.Context { return ctx },
 	}
+	// потоки событий не завершаются сами, без этого
+	// Shutdown ждал бы их бесконечно
+	srv.RegisterOnShutdown(feed.Close)
 
 	go func() {
 		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-			log.Fatal(err)
+			fatal(logger, "server failed", err)
 		}
-		logger.Println("server is shut down")
+		logger.Info("server is shut down")
 		wg.Done()
 	}()
 	return srv
 }
+
+// server сервер, который умеет "мягко" останавливаться.
+type server interface {
+	Shutdown(ctx context.Context) error
+}
+
+// grpcServer приводит grpc.Server к server.
+type grpcServer struct {
+	srv  *grpc.Server
+	feed *events.Feed
+}
+
+// Shutdown дожидается завершения вызовов, а если ctx
+// истекает раньше, обрывает их.
+func (s grpcServer) Shutdown(ctx context.Context) error {
+	// вызовы Watch не завершаются сами, без этого
+	// GracefulStop ждал бы их бесконечно
+	s.feed.Close()
+
+	done := make(chan struct{})
+	go func() {
+		s.srv.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.srv.Stop()
+		return ctx.Err()
+	}
+}
+
+// startGRPCServer запускает сервер gRPC API.
+func startGRPCServer(db domain.Repository, feed *events.Feed, authn *auth.Authenticator, logger *slog.Logger, addr string, wg *sync.WaitGroup) (server, error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var opts []grpc.ServerOption
+	if authn != nil {
+		opts = append(opts,
+			grpc.ChainUnaryInterceptor(grpcapi.UnaryAuth(authn)),
+			grpc.ChainStreamInterceptor(grpcapi.StreamAuth(authn)))
+	}
+	srv := grpc.NewServer(opts...)
+	itempb.RegisterItemServiceServer(srv, grpcapi.New(db, logger, grpcapi.WithEvents(feed)))
+
+	wg.Add(1)
+	go func() {
+		if err := srv.Serve(lis); err != nil {
+			fatal(logger, "server failed", err)
+		}
+		logger.Info("server is shut down")
+		wg.Done()
+	}()
+	return grpcServer{srv: srv, feed: feed}, nil
+}
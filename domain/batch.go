@@ -0,0 +1,63 @@
+package domain
+
+import "errors"
+
+// MaxBatchSize максимальное число операций в одном пакете.
+const MaxBatchSize = 1000
+
+// ErrAborted возвращается для операций атомарного пакета,
+// которые не были применены из-за ошибки в другой операции.
+var ErrAborted = errors.New("batch aborted")
+
+// ErrUnknownOp возвращается для операции пакета неизвестного типа.
+var ErrUnknownOp = errors.New("unknown batch operation")
+
+// BatchOp тип операции пакета. Создание с ненулевым Item.ID
+// добавляет объект с этим id или возвращает ErrConflict, если
+// id занят: так данные переносятся между БД с сохранением id.
+// Следующие id назначаются после наибольшего занятого.
+type BatchOp string
+
+const (
+	BatchCreate BatchOp = "create" // как CreateItem, но ненулевой Item.ID сохраняется
+	BatchUpdate BatchOp = "update" // как UpdateItem: Item.Version - ожидаемая версия
+	BatchDelete BatchOp = "delete" // как DeleteItem: используются Item.ID и Item.Version
+	BatchPut    BatchOp = "put"    // update, если объект с Item.ID есть, иначе create
+)
+
+// BatchOperation одна операция пакета.
+type BatchOperation struct {
+	Op   BatchOp
+	Item Item
+}
+
+// BatchResult результат одной операции пакета. Item содержит
+// объект после операции (для удаления только id), Err ошибку
+// операции с той же семантикой, что у одиночных методов.
+// Created сообщает, что успешная операция создала объект:
+// по версии этого не понять, первое изменение документа,
+// сохраненного без версии, тоже дает версию 1.
+type BatchResult struct {
+	Item    Item
+	Created bool
+	Err     error
+}
+
+// IsOpError сообщает, относится ли ошибка к отдельной операции
+// пакета (объект не найден, конфликт версий), а не к БД в целом.
+func IsOpError(err error) bool {
+	return errors.Is(err, ErrNotFound) ||
+		errors.Is(err, ErrConflict) ||
+		errors.Is(err, ErrUnknownOp)
+}
+
+// Abort возвращает результаты атомарного пакета, отмененного
+// из-за ошибки err в операции с индексом failed.
+func Abort(ops []BatchOperation, failed int, err error) []BatchResult {
+	results := make([]BatchResult, len(ops))
+	for i, op := range ops {
+		results[i] = BatchResult{Item: Item{ID: op.Item.ID}, Err: ErrAborted}
+	}
+	results[failed].Err = err
+	return results
+}
@@ -0,0 +1,34 @@
+package domain
+
+import "context"
+
+// ChangeOp тип изменения объекта в БД.
+type ChangeOp string
+
+const (
+	ChangeCreated ChangeOp = "created" // объект добавлен
+	ChangeUpdated ChangeOp = "updated" // объект изменен
+	ChangeDeleted ChangeOp = "deleted" // объект удален
+	// ChangeReset сообщает, что изменение произошло, но применить
+	// его по отдельности нельзя, и состояние нужно перечитать целиком.
+	ChangeReset ChangeOp = "reset"
+)
+
+// Change событие изменения объекта в БД.
+type Change struct {
+	Op   ChangeOp
+	Item Item // при удалении достаточно заполненного id
+}
+
+// Watcher реализуется репозиториями, которые умеют
+// сообщать об изменениях объектов в БД.
+type Watcher interface {
+	// Watch подписывается на изменения объектов. Канал закрывается,
+	// когда отменен ctx или поток изменений прервался.
+	Watch(ctx context.Context) (<-chan Change, error)
+}
+
+// ChangeHook получает изменения объектов после того, как они
+// применены. Вызывается на пути записи, поэтому не должен
+// блокироваться надолго.
+type ChangeHook func(changes []Change)
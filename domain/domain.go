@@ -1,18 +1,54 @@
 package domain
 
-import "context"
+import (
+	"context"
+	"errors"
+)
+
+// ErrNotFound возвращается репозиторием, если объект
+// с запрошенным id отсутствует в БД.
+var ErrNotFound = errors.New("item not found")
+
+// ErrConflict возвращается репозиторием, если ожидаемая
+// версия объекта не совпадает с версией в БД, то есть объект
+// успели изменить с момента, когда его прочитал клиент.
+var ErrConflict = errors.New("item version conflict")
+
+// ErrUnavailable возвращается репозиторием, если хранилище
+// временно недоступно (нет связи с БД, БД закрыта и т.п.)
+// и запрос имеет смысл повторить позже.
+var ErrUnavailable = errors.New("storage unavailable")
 
 type Item struct {
 	// так как используем mongo, то тут можно было бы использовать
 	// ObjectID mongo, но для простоты используем просто int
 	ID   int64  `json:"id"`
 	Name string `json:"name"`
+	// Version увеличивается при каждом изменении объекта
+	// и используется для оптимистичной блокировки.
+	Version int64 `json:"version"`
 }
 
+// Методы изменения принимают ожидаемую версию объекта
+// (item.Version для UpdateItem, version для DeleteItem).
+// Если она не совпадает с версией в БД, возвращается ErrConflict,
+// нулевая версия означает изменение без проверки.
+//
+// Операции пакета (Batch) выполняются по порядку, следующая
+// операция видит результат предыдущих. Неатомарный пакет
+// применяет все операции, которые удалось применить. Атомарный
+// пакет при первой ошибке не применяет ни одной (см. Abort).
+// Ошибка самого Batch означает, что пакет не выполнен целиком.
 type Repository interface {
-	Items(context.Context) ([]Item, error)            // Items возвращает списком все объекты из БД.
-	Item(ctx context.Context, id int64) (Item, error) // Item находит объект по id.
-	DeleteItem(ctx context.Context, id int64) error   // DeleteItem удаляет из БД объект по id.
-	UpdateItem(ctx context.Context, item Item) error  // UpdateItem обновляет в БД объект.
-	Close() error                                     // Close закрывает подключение к БД.
+	Items(context.Context) ([]Item, error)                         // Items возвращает списком все объекты из БД.
+	Item(ctx context.Context, id int64) (Item, error)              // Item находит объект по id.
+	ListItems(ctx context.Context, q ListQuery) (ItemsPage, error) // ListItems возвращает страницу объектов по запросу.
+	CreateItem(ctx context.Context, item Item) (Item, error)       // CreateItem добавляет в БД объект, присваивая ему новый id.
+	DeleteItem(ctx context.Context, id, version int64) error       // DeleteItem удаляет из БД объект по id.
+	UpdateItem(ctx context.Context, item Item) (Item, error)       // UpdateItem обновляет в БД объект и возвращает его новую версию.
+	// ModifyItem атомарно изменяет объект функцией fn и возвращает его новую версию.
+	ModifyItem(ctx context.Context, id, version int64, fn ModifyFunc) (Item, error)
+	// Batch выполняет пакет операций и возвращает результат каждой из них.
+	Batch(ctx context.Context, ops []BatchOperation, atomic bool) ([]BatchResult, error)
+	Close() error // Close закрывает подключение к БД.
 }
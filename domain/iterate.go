@@ -0,0 +1,30 @@
+package domain
+
+import "context"
+
+// Iterator реализуется репозиториями, которые умеют обходить
+// объекты, не загружая их в память все сразу.
+type Iterator interface {
+	// IterateItems вызывает fn для каждого объекта по порядку id.
+	// Ошибка fn прекращает обход и возвращается как есть.
+	IterateItems(ctx context.Context, fn func(Item) error) error
+}
+
+// Iterate обходит объекты репозитория r по порядку id. Если r
+// не реализует Iterator, объекты загружаются методом Items.
+func Iterate(ctx context.Context, r Repository, fn func(Item) error) error {
+	if it, ok := r.(Iterator); ok {
+		return it.IterateItems(ctx, fn)
+	}
+
+	items, err := r.Items(ctx)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package domain
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// Ограничения на размер страницы списка объектов.
+const (
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+)
+
+// SortField поле, по которому сортируется список объектов.
+type SortField string
+
+const (
+	SortByID   SortField = "id"
+	SortByName SortField = "name"
+)
+
+// Cursor указывает на последний объект предыдущей страницы.
+// При сортировке по имени кроме id хранится и имя, так как
+// порядок объектов определяется парой (name, id).
+type Cursor struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+// Encode превращает курсор в непрозрачную для клиента строку.
+// Строка одинакова для всех транспортов (REST, gRPC).
+func (c Cursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeCursor восстанавливает курсор из строки Cursor.Encode.
+func DecodeCursor(s string) (Cursor, error) {
+	var c Cursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	return c, json.Unmarshal(b, &c)
+}
+
+// ListQuery параметры запроса списка объектов.
+type ListQuery struct {
+	Limit        int       // размер страницы, 0 - DefaultListLimit
+	After        *Cursor   // страница начинается после этого объекта
+	Sort         SortField // поле сортировки, по умолчанию id
+	Desc         bool      // сортировка по убыванию
+	NamePrefix   string    // фильтр по началу имени
+	NameContains string    // фильтр по подстроке имени
+}
+
+// ItemsPage страница списка объектов.
+type ItemsPage struct {
+	Items []Item
+	Next  *Cursor // курсор следующей страницы, nil если страница последняя
+}
+
+// PageLimit возвращает размер страницы с учетом
+// значения по умолчанию и ограничения сверху.
+func (q ListQuery) PageLimit() int {
+	switch {
+	case q.Limit <= 0:
+		return DefaultListLimit
+	case q.Limit > MaxListLimit:
+		return MaxListLimit
+	}
+	return q.Limit
+}
+
+// Match сообщает, проходит ли объект фильтры запроса.
+func (q ListQuery) Match(item Item) bool {
+	return strings.HasPrefix(item.Name, q.NamePrefix) &&
+		strings.Contains(item.Name, q.NameContains)
+}
+
+// Less сообщает, стоит ли объект a раньше объекта b
+// в порядке сортировки запроса.
+func (q ListQuery) Less(a, b Item) bool {
+	if q.Desc {
+		a, b = b, a
+	}
+	if q.Sort == SortByName && a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	return a.ID < b.ID
+}
+
+// CursorOf возвращает курсор, указывающий на объект.
+func (q ListQuery) CursorOf(item Item) Cursor {
+	c := Cursor{ID: item.ID}
+	if q.Sort == SortByName {
+		c.Name = item.Name
+	}
+	return c
+}
+
+// IsAfter сообщает, находится ли объект после курсора запроса.
+func (q ListQuery) IsAfter(item Item) bool {
+	if q.After == nil {
+		return true
+	}
+	return q.Less(Item{ID: q.After.ID, Name: q.After.Name}, item)
+}
+
+// Page применяет запрос к набору объектов в памяти:
+// фильтрует, сортирует и отрезает страницу после курсора.
+// Исходный слайс не изменяется.
+func (q ListQuery) Page(items []Item) ItemsPage {
+	out := make([]Item, 0, len(items))
+	for i := range items {
+		if q.Match(items[i]) && q.IsAfter(items[i]) {
+			out = append(out, items[i])
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool { return q.Less(out[i], out[j]) })
+
+	return q.Cut(out)
+}
+
+// Cut формирует страницу из уже отфильтрованных и
+// отсортированных объектов, начинающихся после курсора.
+func (q ListQuery) Cut(items []Item) ItemsPage {
+	limit := q.PageLimit()
+	if len(items) <= limit {
+		return ItemsPage{Items: items}
+	}
+	next := q.CursorOf(items[limit-1])
+	return ItemsPage{Items: items[:limit], Next: &next}
+}
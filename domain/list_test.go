@@ -0,0 +1,86 @@
+package domain
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestListQueryPage(t *testing.T) {
+	items := []Item{
+		{ID: 3, Name: "beta"},
+		{ID: 1, Name: "alpha"},
+		{ID: 4, Name: "alpha"},
+		{ID: 2, Name: "gamma"},
+	}
+
+	ids := func(items []Item) []int64 {
+		out := make([]int64, 0, len(items))
+		for _, it := range items {
+			out = append(out, it.ID)
+		}
+		return out
+	}
+
+	tests := []struct {
+		name     string
+		q        ListQuery
+		wantIDs  []int64
+		wantNext *Cursor
+	}{
+		{
+			name:    "default",
+			q:       ListQuery{},
+			wantIDs: []int64{1, 2, 3, 4},
+		},
+		{
+			name:     "limit",
+			q:        ListQuery{Limit: 2},
+			wantIDs:  []int64{1, 2},
+			wantNext: &Cursor{ID: 2},
+		},
+		{
+			name:    "after",
+			q:       ListQuery{After: &Cursor{ID: 2}},
+			wantIDs: []int64{3, 4},
+		},
+		{
+			name:    "desc",
+			q:       ListQuery{Desc: true, After: &Cursor{ID: 3}},
+			wantIDs: []int64{2, 1},
+		},
+		{
+			name:     "byName",
+			q:        ListQuery{Sort: SortByName, Limit: 3},
+			wantIDs:  []int64{1, 4, 3},
+			wantNext: &Cursor{ID: 3, Name: "beta"},
+		},
+		{
+			name:    "byNameAfterTie",
+			q:       ListQuery{Sort: SortByName, After: &Cursor{ID: 1, Name: "alpha"}},
+			wantIDs: []int64{4, 3, 2},
+		},
+		{
+			name:    "byNameDesc",
+			q:       ListQuery{Sort: SortByName, Desc: true},
+			wantIDs: []int64{2, 3, 4, 1},
+		},
+		{
+			name:    "filters",
+			q:       ListQuery{NamePrefix: "a", NameContains: "ph"},
+			wantIDs: []int64{1, 4},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.q.Page(items)
+
+			if !reflect.DeepEqual(ids(got.Items), tt.wantIDs) {
+				t.Errorf("Page() ids = %v, want %v", ids(got.Items), tt.wantIDs)
+			}
+			if !reflect.DeepEqual(got.Next, tt.wantNext) {
+				t.Errorf("Page() next = %v, want %v", got.Next, tt.wantNext)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package domain
+
+import (
+	"context"
+	"errors"
+)
+
+// ModifyFunc получает текущее состояние объекта и возвращает
+// измененное. id и версия в результате игнорируются. Ошибка
+// отменяет изменение и возвращается из ModifyItem как есть.
+// Функция может вызываться несколько раз, поэтому не должна
+// иметь побочных эффектов.
+type ModifyFunc func(Item) (Item, error)
+
+// Modify реализует ModifyItem поверх Item и UpdateItem для
+// репозиториев без собственных транзакций: объект читается,
+// изменяется и записывается с условием на прочитанную версию.
+// Если объект успели изменить, попытка повторяется.
+// Если version не 0, то объект изменяется, только если его
+// версия совпадает с version, иначе возвращается ErrConflict.
+func Modify(ctx context.Context, r Repository, id, version int64, fn ModifyFunc) (Item, error) {
+	for {
+		cur, err := r.Item(ctx, id)
+		if err != nil {
+			return Item{}, err
+		}
+		if version != 0 && cur.Version != version {
+			return Item{}, ErrConflict
+		}
+
+		next, err := fn(cur)
+		if err != nil {
+			return Item{}, err
+		}
+		next.ID, next.Version = cur.ID, cur.Version
+
+		updated, err := r.UpdateItem(ctx, next)
+		if errors.Is(err, ErrConflict) && version == 0 {
+			if err := ctx.Err(); err != nil {
+				return Item{}, err
+			}
+			continue // объект изменили между чтением и записью
+		}
+		return updated, err
+	}
+}
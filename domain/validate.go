@@ -0,0 +1,96 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxNameLength максимальная длина имени объекта в символах.
+const MaxNameLength = 256
+
+// ErrInvalid оборачивается ошибкой ValidationError.
+var ErrInvalid = errors.New("invalid item")
+
+// FieldError ошибка в значении отдельного поля. Field совпадает
+// с именем поля в JSON.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError список нарушенных правил проверки объекта.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = fmt.Sprintf("'%s' %s", f.Field, f.Message)
+	}
+	return ErrInvalid.Error() + ": " + strings.Join(msgs, "; ")
+}
+
+func (e *ValidationError) Unwrap() error { return ErrInvalid }
+
+// add добавляет ошибку поля.
+func (e *ValidationError) add(field, format string, args ...any) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// err возвращает nil, если ошибок нет.
+func (e *ValidationError) err() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Validate проверяет поля объекта. Нулевые id и версия допустимы:
+// id нового объекта назначает репозиторий, нулевая версия
+// означает изменение без проверки версии.
+func (it Item) Validate() error {
+	var e ValidationError
+	if it.ID < 0 {
+		e.add("id", "must be positive")
+	}
+	if it.Version < 0 {
+		e.add("version", "must not be negative")
+	}
+	if msg := checkName(it.Name); msg != "" {
+		e.add("name", msg)
+	}
+	return e.err()
+}
+
+// ValidateID проверяет id существующего объекта.
+func ValidateID(id int64) error {
+	if id <= 0 {
+		return &ValidationError{Fields: []FieldError{{Field: "id", Message: "must be positive"}}}
+	}
+	return nil
+}
+
+// checkName возвращает описание нарушенного правила
+// для имени объекта или пустую строку.
+// Имя не пустое, не длиннее MaxNameLength символов, в UTF-8,
+// только из печатных символов (из пробельных допустим лишь
+// U+0020) и без пробелов по краям.
+func checkName(name string) string {
+	switch {
+	case name == "":
+		return "is required"
+	case !utf8.ValidString(name):
+		return "must be valid UTF-8"
+	case utf8.RuneCountInString(name) > MaxNameLength:
+		return fmt.Sprintf("must be at most %d characters", MaxNameLength)
+	case strings.TrimSpace(name) != name:
+		return "must not start or end with whitespace"
+	case strings.IndexFunc(name, func(r rune) bool { return !unicode.IsPrint(r) && r != ' ' }) >= 0:
+		return "must contain only printable characters and plain spaces"
+	}
+	return ""
+}
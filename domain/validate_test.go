@@ -0,0 +1,62 @@
+package domain
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestItemValidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		item       Item
+		wantFields []string
+	}{
+		{name: "valid", item: Item{ID: 1, Name: "test one", Version: 2}},
+		{name: "new", item: Item{Name: "новый объект"}},
+		{name: "maxLength", item: Item{Name: strings.Repeat("я", MaxNameLength)}},
+		{name: "emptyName", item: Item{ID: 1}, wantFields: []string{"name"}},
+		{name: "longName", item: Item{Name: strings.Repeat("a", MaxNameLength+1)}, wantFields: []string{"name"}},
+		{name: "badUTF8", item: Item{Name: "bad \xff"}, wantFields: []string{"name"}},
+		{name: "control", item: Item{Name: "tab\there"}, wantFields: []string{"name"}},
+		{name: "nbsp", item: Item{Name: "no\u00a0break"}, wantFields: []string{"name"}},
+		{name: "spaces", item: Item{Name: " padded "}, wantFields: []string{"name"}},
+		{name: "negative", item: Item{ID: -1, Name: "x", Version: -1}, wantFields: []string{"id", "version"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.item.Validate()
+			if len(tt.wantFields) == 0 {
+				if err != nil {
+					t.Fatalf("Validate() = err %v, want nil", err)
+				}
+				return
+			}
+
+			var verr *ValidationError
+			if !errors.As(err, &verr) || !errors.Is(err, ErrInvalid) {
+				t.Fatalf("Validate() = err %v, want *ValidationError", err)
+			}
+			var fields []string
+			for _, f := range verr.Fields {
+				fields = append(fields, f.Field)
+			}
+			if !reflect.DeepEqual(fields, tt.wantFields) {
+				t.Errorf("Validate() fields = %v, want %v", fields, tt.wantFields)
+			}
+		})
+	}
+}
+
+func TestValidateID(t *testing.T) {
+	if err := ValidateID(1); err != nil {
+		t.Errorf("ValidateID(1) = err %v", err)
+	}
+	for _, id := range []int64{0, -5} {
+		if err := ValidateID(id); !errors.Is(err, ErrInvalid) {
+			t.Errorf("ValidateID(%d) = err %v, want %v", id, err, ErrInvalid)
+		}
+	}
+}
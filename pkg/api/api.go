@@ -6,13 +6,24 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
-	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rtemka/rbtest/domain"
+	"github.com/rtemka/rbtest/pkg/auth"
+	"github.com/rtemka/rbtest/pkg/events"
+	"github.com/rtemka/rbtest/pkg/health"
+	"github.com/rtemka/rbtest/pkg/logging"
+	"github.com/rtemka/rbtest/pkg/metrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type repo = domain.Repository
@@ -25,18 +36,58 @@ var (
 
 // API приложения.
 type API struct {
-	router *mux.Router
-	repo   repo
-	logger *log.Logger
+	router  *mux.Router
+	repo    repo
+	logger  *slog.Logger
+	events  *events.Feed        // поток изменений, nil - выключен
+	metrics *metrics.Metrics    // метрики, nil - выключены
+	health  *health.Checker     // пробы /healthz и /readyz, nil - выключены
+	auth    *auth.Authenticator // проверка подлинности, nil - выключена
+	// validate включает проверку запросов по описанию API
+	validate bool
+}
+
+// Option настраивает API.
+type Option func(*API)
+
+// WithEvents включает поток изменений GET /items/events
+// и подписки через WebSocket /ws.
+// Изменения в feed должен публиковать тот, кто их видит,
+// например, кэш через cache.WithChangeHook(feed.Publish).
+func WithEvents(feed *events.Feed) Option {
+	return func(api *API) { api.events = feed }
+}
+
+// WithMetrics включает учет запросов в m и отдает
+// метрики по GET /metrics без проверки подлинности.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(api *API) { api.metrics = m }
+}
+
+// WithHealth включает пробы живости GET /healthz
+// и готовности GET /readyz по проверкам из h.
+func WithHealth(h *health.Checker) Option {
+	return func(api *API) { api.health = h }
+}
+
+// WithAuth включает проверку подлинности клиентов: без ключа
+// API или токена доступны только пробы и описание API.
+// Проверенный клиент передается обработчикам и БД через
+// контекст, см. auth.FromContext.
+func WithAuth(a *auth.Authenticator) Option {
+	return func(api *API) { api.auth = a }
 }
 
 // Возвращает новый объект *API
-func New(repo repo, logger *log.Logger, cacheInterval time.Duration) *API {
+func New(repo repo, logger *slog.Logger, cacheInterval time.Duration, opts ...Option) *API {
 	api := API{
 		router: mux.NewRouter(),
 		repo:   repo,
 		logger: logger,
 	}
+	for _, opt := range opts {
+		opt(&api)
+	}
 	api.endpoints()
 
 	return &api
@@ -48,16 +99,51 @@ func (api *API) Router() *mux.Router {
 }
 
 func (api *API) endpoints() {
+	api.router.Use(
+		api.requestIDMiddleware, // первым, чтобы id был во всех записях журнала
+		api.tracingMiddleware,
+	)
+	if api.metrics != nil {
+		api.router.Use(api.metricsMiddleware) // раньше остальных, чтобы учесть все время запроса
+		api.router.Handle(metricsPath, api.metrics.Handler()).Methods(http.MethodGet)
+	}
 	api.router.Use(
 		api.logRequestMiddleware,
 		api.closerMiddleware,
 		api.headersMiddleware,
 	)
+	if api.auth != nil {
+		api.router.Use(api.authMiddleware) // до проверки тела, чтобы не разбирать запросы чужих
+	}
+	if api.validate {
+		validate, err := api.validationMiddleware()
+		if err != nil {
+			// описание встроено в бинарный файл и проверяется
+			// тестами, так что это ошибка сборки
+			panic(err)
+		}
+		api.router.Use(validate)
+	}
+
+	api.router.HandleFunc("/openapi.json", api.itemsHandlerOpenAPI()).Methods(http.MethodGet, http.MethodOptions)
+	if api.health != nil {
+		api.router.HandleFunc(livePath, api.healthHandlerLive()).Methods(http.MethodGet)
+		api.router.HandleFunc(readyPath, api.healthHandlerReady()).Methods(http.MethodGet)
+	}
 
 	api.router.HandleFunc("/items", api.itemsHandlerList()).Methods(http.MethodGet, http.MethodOptions)
+	if api.events != nil {
+		// раньше /items/{id}, иначе "events" примется за id
+		api.router.HandleFunc("/items/events", api.itemsHandlerEvents()).Methods(http.MethodGet, http.MethodOptions)
+		api.router.HandleFunc("/ws", api.wsHandler()).Methods(http.MethodGet)
+	}
 	api.router.HandleFunc("/items/{id}", api.itemsHandlerGet()).Methods(http.MethodGet, http.MethodOptions)
 	api.router.HandleFunc("/items/{id}", api.itemsHandlerDelete()).Methods(http.MethodDelete, http.MethodOptions)
+	api.router.HandleFunc("/items/{id}", api.itemsHandlerPatch()).Methods(http.MethodPatch, http.MethodOptions)
 	api.router.HandleFunc("/items", api.itemsHandlerPut()).Methods(http.MethodPut, http.MethodOptions)
+	api.router.HandleFunc("/items", api.itemsHandlerPost()).Methods(http.MethodPost, http.MethodOptions)
+	api.router.HandleFunc("/items:batch", api.itemsHandlerBatch()).Methods(http.MethodPost, http.MethodOptions)
+	api.router.HandleFunc("/items:import", api.itemsHandlerImport()).Methods(http.MethodPost, http.MethodOptions)
 }
 
 // headersMiddleware задает обычные заголовки для всех ответов.
@@ -81,19 +167,118 @@ func (api *API) closerMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-// logRequestMiddleware логирует request
+// RequestIDHeader заголовок с id запроса.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen ограничение длины id запроса от клиента.
+const maxRequestIDLen = 128
+
+// requestIDMiddleware берет id запроса из заголовка X-Request-ID
+// или создает новый, возвращает его клиенту в том же заголовке
+// и передает через контекст в журнал.
+func (api *API) requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = randomID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
+	})
+}
+
+// validRequestID проверяет id запроса от клиента: непустой,
+// не длиннее maxRequestIDLen, из видимых символов ASCII,
+// чтобы его можно было без экранирования писать в журнал.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// logRequestMiddleware пишет в журнал обработанный запрос
+// со статусом, размером и временем ответа. Ответы 5xx
+// пишутся на уровне error, а пробы, которые приходят
+// каждые несколько секунд, - на уровне debug или, если
+// приложение не готово, warn.
 func (api *API) logRequestMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		next.ServeHTTP(w, r)
-		api.logger.Printf("method=%s path=%s query=%s vars=%s remote=%s",
-			r.Method, r.URL.Path, r.URL.Query(), mux.Vars(r), r.RemoteAddr)
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		route, _ := mux.CurrentRoute(r).GetPathTemplate()
+		level := slog.LevelInfo
+		switch {
+		case route == livePath, route == readyPath:
+			level = slog.LevelDebug
+			if rec.Status() != http.StatusOK {
+				level = slog.LevelWarn
+			}
+		case rec.Status() >= http.StatusInternalServerError:
+			level = slog.LevelError
+		}
+		api.logger.LogAttrs(r.Context(), level, "request",
+			slog.String("method", r.Method),
+			slog.String("route", route),
+			slog.String("path", r.URL.Path),
+			slog.String("query", redactQuery(r.URL.RawQuery)),
+			slog.Int("status", rec.Status()),
+			slog.Int64("bytes", rec.bytes),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("remote", r.RemoteAddr),
+		)
 	})
 }
 
-func (api *API) WriteJSONError(w http.ResponseWriter, err error, code int) {
-	w.WriteHeader(code)
-	msg := map[string]string{"error": err.Error()}
-	_ = json.NewEncoder(w).Encode(&msg)
+// metricsMiddleware учитывает запрос в метриках
+// по шаблону пути маршрута и статусу ответа.
+func (api *API) metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		route, _ := mux.CurrentRoute(r).GetPathTemplate()
+		api.metrics.ObserveRequest(route, r.Method, rec.Status(), time.Since(start))
+	})
+}
+
+// tracer создает спаны обработчиков.
+var tracer = otel.Tracer("github.com/rtemka/rbtest/pkg/api")
+
+// tracingMiddleware ведет спан обработчика с именем по шаблону
+// пути маршрута. Если запрос пришел с заголовком traceparent
+// (W3C Trace Context), спан продолжает трассировку клиента.
+// Ответы 5xx отмечаются в спане ошибкой.
+func (api *API) tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		route, _ := mux.CurrentRoute(r).GetPathTemplate()
+		ctx, span := tracer.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(r.URL.Path),
+				attribute.String(logging.RequestIDKey, logging.RequestID(ctx)),
+			))
+		defer span.End()
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rec.Status()))
+		if rec.Status() >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.Status()))
+		}
+	})
 }
 
 func (api *API) WriteJSON(w http.ResponseWriter, data any, code int) {
@@ -104,39 +289,66 @@ func (api *API) WriteJSON(w http.ResponseWriter, data any, code int) {
 	_ = json.NewEncoder(w).Encode(data)
 }
 
-// itemsHandlerList возвращает список сущностьей из БД.
+// itemsHandlerList возвращает страницу списка сущностьей из БД.
+// Поддерживает постраничный вывод, сортировку и фильтр по имени.
+// Если клиент запросил NDJSON или CSV (заголовок Accept),
+// то вместо страницы выгружается вся коллекция потоком.
 func (api *API) itemsHandlerList() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", "Accept")
+
+		format, ok := negotiate(r.Header.Get("Accept"), jsonType, ndjsonType, csvType)
+		if !ok {
+			api.writeError(w, r, &Error{Kind: KindNotAcceptable,
+				Detail: "Accept must allow one of " + strings.Join([]string{jsonType, ndjsonType, csvType}, ", ")})
+			return
+		}
+		if format != jsonType {
+			api.exportItems(w, r, format)
+			return
+		}
+
+		q, err := listQuery(r.URL.Query())
+		if err != nil {
+			api.writeError(w, r, err)
+			return
+		}
 
 		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 		defer cancel()
 
-		items, err := api.repo.Items(ctx)
+		page, err := api.repo.ListItems(ctx, q)
 		if err != nil {
-			api.WriteJSONError(w, ErrInternal, http.StatusInternalServerError)
+			api.writeError(w, r, err)
 			return
 		}
-		api.WriteJSON(w, items, http.StatusOK)
+		api.WriteJSON(w, newItemsPage(page), http.StatusOK)
 	}
 }
 
 // itemsHandlerDelete удлаляет сущность из БД.
+// Поддерживает условное удаление с If-Match.
 func (api *API) itemsHandlerDelete() http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		s := mux.Vars(r)["id"]
-		id, err := strconv.ParseInt(s, 10, 64)
+		id, err := pathID(r)
 		if err != nil {
-			api.WriteJSONError(w, fmt.Errorf("%w: bad 'id' path parameter", ErrBadInput), http.StatusBadRequest)
+			api.writeError(w, r, err)
+			return
+		}
+
+		version, conditional, err := ifMatchVersion(r)
+		if err != nil {
+			api.writeError(w, r, err)
 			return
 		}
 
 		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 		defer cancel()
 
-		err = api.repo.DeleteItem(ctx, id)
+		err = api.repo.DeleteItem(ctx, id, version)
 		if err != nil {
-			api.WriteJSONError(w, ErrInternal, http.StatusInternalServerError)
+			api.writeConditionalError(w, r, err, conditional)
 			return
 		}
 
@@ -144,14 +356,15 @@ func (api *API) itemsHandlerDelete() http.HandlerFunc {
 	}
 }
 
-// itemsHandlerDelete получает из БД по id.
+// itemsHandlerGet получает сущность из БД по id.
+// Версия сущности отдается в заголовке ETag, поддерживаются
+// условные запросы с If-Match и If-None-Match.
 func (api *API) itemsHandlerGet() http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		s := mux.Vars(r)["id"]
-		id, err := strconv.ParseInt(s, 10, 64)
+		id, err := pathID(r)
 		if err != nil {
-			api.WriteJSONError(w, fmt.Errorf("%w: bad 'id' path parameter", ErrBadInput), http.StatusBadRequest)
+			api.writeError(w, r, err)
 			return
 		}
 
@@ -160,7 +373,18 @@ func (api *API) itemsHandlerGet() http.HandlerFunc {
 
 		item, err := api.repo.Item(ctx, id)
 		if err != nil {
-			api.WriteJSONError(w, ErrInternal, http.StatusInternalServerError)
+			api.writeError(w, r, err)
+			return
+		}
+
+		setETag(w, item.Version)
+
+		if h := r.Header.Get("If-Match"); h != "" && !etagMatches(h, item.Version, false) {
+			api.writeError(w, r, ErrPrecondition)
+			return
+		}
+		if h := r.Header.Get("If-None-Match"); h != "" && etagMatches(h, item.Version, true) {
+			api.WriteJSON(w, nil, http.StatusNotModified)
 			return
 		}
 
@@ -168,27 +392,121 @@ func (api *API) itemsHandlerGet() http.HandlerFunc {
 	}
 }
 
-// itemsHandlerPut обновляет сущность в БД.
+// itemsHandlerPut обновляет сущность в БД. Ожидаемая версия
+// сущности берется из заголовка If-Match, а если его нет,
+// то из поля version тела запроса (0 - без проверки версии).
 func (api *API) itemsHandlerPut() http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		var item item
-		err := json.NewDecoder(r.Body).Decode(&item)
-		if err != nil || item.ID == 0 {
-			api.WriteJSONError(w, fmt.Errorf("%w: bad JSON string in request body", ErrBadInput), http.StatusBadRequest)
+		if err := decodeJSON(w, r, &item, maxBodySize); err != nil {
+			api.writeError(w, r, err)
+			return
+		}
+		if item.ID == 0 {
+			api.writeError(w, r, fieldError("id", "is required"))
+			return
+		}
+		if err := item.Validate(); err != nil {
+			api.writeError(w, r, err)
+			return
+		}
+
+		version, conditional, err := ifMatchVersion(r)
+		if err != nil {
+			api.writeError(w, r, err)
+			return
+		}
+		if conditional {
+			item.Version = version
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+
+		item, err = api.repo.UpdateItem(ctx, item)
+		if err != nil {
+			api.writeConditionalError(w, r, err, conditional)
+			return
+		}
+
+		setETag(w, item.Version)
+		api.WriteJSON(w, map[string]any{"updated": map[string]int64{"id": item.ID, "version": item.Version}}, http.StatusOK)
+	}
+}
+
+// itemsHandlerPatch частично изменяет сущность в БД патчем
+// в формате JSON Merge Patch или JSON Patch. Патч применяется
+// к текущему состоянию сущности атомарно, ожидаемая версия
+// берется из заголовка If-Match.
+func (api *API) itemsHandlerPatch() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := pathID(r)
+		if err != nil {
+			api.writeError(w, r, err)
+			return
+		}
+
+		version, conditional, err := ifMatchVersion(r)
+		if err != nil {
+			api.writeError(w, r, err)
+			return
+		}
+
+		apply, err := readPatch(w, r)
+		if err != nil {
+			w.Header().Set("Accept-Patch", acceptPatch)
+			api.writeError(w, r, err)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+
+		item, err := api.repo.ModifyItem(ctx, id, version, patchItem(apply))
+		if err != nil {
+			api.writeConditionalError(w, r, err, conditional)
+			return
+		}
+
+		setETag(w, item.Version)
+		api.WriteJSON(w, item, http.StatusOK)
+	}
+}
+
+// itemsHandlerPost создает новую сущность в БД.
+// id сущности назначается сервером.
+func (api *API) itemsHandlerPost() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		var item item
+		if err := decodeJSON(w, r, &item, maxBodySize); err != nil {
+			api.writeError(w, r, err)
+			return
+		}
+		if item.ID != 0 {
+			api.writeError(w, r, fieldError("id", "is assigned by server"))
+			return
+		}
+		if err := item.Validate(); err != nil {
+			api.writeError(w, r, err)
 			return
 		}
 
 		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 		defer cancel()
 
-		err = api.repo.UpdateItem(ctx, item)
+		item, err := api.repo.CreateItem(ctx, item)
 		if err != nil {
-			api.WriteJSONError(w, ErrInternal, http.StatusInternalServerError)
+			api.writeError(w, r, err)
 			return
 		}
 
-		api.WriteJSON(w, map[string]any{"updated": map[string]int64{"id": item.ID}}, http.StatusOK)
+		w.Header().Set("Location", fmt.Sprintf("/items/%d", item.ID))
+		setETag(w, item.Version)
+		api.WriteJSON(w, item, http.StatusCreated)
 	}
 }
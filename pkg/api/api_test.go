@@ -2,21 +2,31 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/rtemka/rbtest/pkg/logging"
 	"github.com/rtemka/rbtest/pkg/repo/memdb"
 )
 
-func TestAPI(t *testing.T) {
-	api := New(memdb.New(), log.New(io.Discard, "", 0), 1*time.Minute)
+var testItems = []item{
+	{ID: 1, Name: "test one", Version: 1},
+	{ID: 2, Name: "test two", Version: 1},
+}
 
+// newTestAPI возвращает API поверх БД в памяти с тестовыми объектами.
+func newTestAPI() *API {
+	return New(memdb.New(testItems...), logging.Discard(), 1*time.Minute)
+}
+
+func TestAPI(t *testing.T) {
 	tb, err := json.Marshal(map[string]any{"id": 1, "name": "upd test"})
 	if err != nil {
 		t.Fatalf("TestAPI = err %v", err)
@@ -26,6 +36,7 @@ func TestAPI(t *testing.T) {
 		name           string
 		path           string
 		method         string
+		header         map[string]string
 		body           io.Reader
 		wantStatusCode int
 	}{
@@ -35,6 +46,30 @@ func TestAPI(t *testing.T) {
 			method:         http.MethodGet,
 			wantStatusCode: http.StatusOK,
 		},
+		{
+			name:           "itemsHandlerListPage",
+			path:           "/items?limit=1&sort=-name&name_prefix=test",
+			method:         http.MethodGet,
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "itemsHandlerListBadLimit",
+			path:           "/items?limit=0",
+			method:         http.MethodGet,
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "itemsHandlerListBadSort",
+			path:           "/items?sort=size",
+			method:         http.MethodGet,
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "itemsHandlerListBadCursor",
+			path:           "/items?cursor=!!!",
+			method:         http.MethodGet,
+			wantStatusCode: http.StatusBadRequest,
+		},
 		{
 			name:           "itemsHandlerDelete",
 			path:           "/items/1",
@@ -47,6 +82,90 @@ func TestAPI(t *testing.T) {
 			method:         http.MethodGet,
 			wantStatusCode: http.StatusOK,
 		},
+		{
+			name:           "itemsHandlerGetNotFound",
+			path:           "/items/42",
+			method:         http.MethodGet,
+			wantStatusCode: http.StatusNotFound,
+		},
+		{
+			name:           "itemsHandlerDeleteNotFound",
+			path:           "/items/42",
+			method:         http.MethodDelete,
+			wantStatusCode: http.StatusNotFound,
+		},
+		{
+			name:           "itemsHandlerPutNotFound",
+			path:           "/items",
+			method:         http.MethodPut,
+			body:           strings.NewReader(`{"id": 42, "name": "missing"}`),
+			wantStatusCode: http.StatusNotFound,
+		},
+		{
+			name:           "itemsHandlerGetNotModified",
+			path:           "/items/1",
+			method:         http.MethodGet,
+			header:         map[string]string{"If-None-Match": `"1"`},
+			wantStatusCode: http.StatusNotModified,
+		},
+		{
+			name:           "itemsHandlerGetNotModifiedWeak",
+			path:           "/items/1",
+			method:         http.MethodGet,
+			header:         map[string]string{"If-None-Match": `W/"1"`},
+			wantStatusCode: http.StatusNotModified,
+		},
+		{
+			name:           "itemsHandlerGetWeakIfMatch",
+			path:           "/items/1",
+			method:         http.MethodGet,
+			header:         map[string]string{"If-Match": `W/"1"`},
+			wantStatusCode: http.StatusPreconditionFailed,
+		},
+		{
+			name:           "itemsHandlerGetPrecondition",
+			path:           "/items/1",
+			method:         http.MethodGet,
+			header:         map[string]string{"If-Match": `"2"`},
+			wantStatusCode: http.StatusPreconditionFailed,
+		},
+		{
+			name:           "itemsHandlerDeletePrecondition",
+			path:           "/items/1",
+			method:         http.MethodDelete,
+			header:         map[string]string{"If-Match": `"2"`},
+			wantStatusCode: http.StatusPreconditionFailed,
+		},
+		{
+			name:           "itemsHandlerDeleteIfMatch",
+			path:           "/items/1",
+			method:         http.MethodDelete,
+			header:         map[string]string{"If-Match": `"1"`},
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "itemsHandlerPutIfMatch",
+			path:           "/items",
+			method:         http.MethodPut,
+			header:         map[string]string{"If-Match": `"1"`},
+			body:           strings.NewReader(`{"id": 1, "name": "upd test"}`),
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "itemsHandlerPutBadIfMatch",
+			path:           "/items",
+			method:         http.MethodPut,
+			header:         map[string]string{"If-Match": `W/"1"`},
+			body:           strings.NewReader(`{"id": 1, "name": "upd test"}`),
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "itemsHandlerPutConflict",
+			path:           "/items",
+			method:         http.MethodPut,
+			body:           strings.NewReader(`{"id": 1, "name": "upd test", "version": 5}`),
+			wantStatusCode: http.StatusConflict,
+		},
 		{
 			name:           "itemsHandlerPutError",
 			path:           "/items",
@@ -61,11 +180,30 @@ func TestAPI(t *testing.T) {
 			body:           bytes.NewReader(tb),
 			wantStatusCode: http.StatusOK,
 		},
+		{
+			name:           "itemsHandlerPost",
+			path:           "/items",
+			method:         http.MethodPost,
+			body:           strings.NewReader(`{"name": "new test"}`),
+			wantStatusCode: http.StatusCreated,
+		},
+		{
+			name:           "itemsHandlerPostError",
+			path:           "/items",
+			method:         http.MethodPost,
+			body:           strings.NewReader(`{"id": 5, "name": "new test"}`),
+			wantStatusCode: http.StatusBadRequest,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			api := newTestAPI()
+
 			req := httptest.NewRequest(tt.method, tt.path, tt.body)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
 			rr := httptest.NewRecorder()
 
 			api.router.ServeHTTP(rr, req)
@@ -79,3 +217,210 @@ func TestAPI(t *testing.T) {
 	}
 
 }
+
+func TestAPIListPages(t *testing.T) {
+	api := newTestAPI()
+
+	var got []int64
+	path := "/items?limit=1"
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		rr := httptest.NewRecorder()
+
+		api.router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("itemsHandlerList() resp code = %d, want %d", rr.Code, http.StatusOK)
+		}
+
+		var page itemsPage
+		if err := json.NewDecoder(rr.Body).Decode(&page); err != nil {
+			t.Fatalf("itemsHandlerList() = err %v", err)
+		}
+
+		for _, it := range page.Items {
+			got = append(got, it.ID)
+		}
+
+		if page.NextCursor == "" {
+			break
+		}
+		path = "/items?limit=1&cursor=" + page.NextCursor
+	}
+
+	if len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Errorf("itemsHandlerList() ids = %v, want [1 2]", got)
+	}
+}
+
+func TestAPIETag(t *testing.T) {
+	api := newTestAPI()
+
+	req := httptest.NewRequest(http.MethodGet, "/items/2", nil)
+	rr := httptest.NewRecorder()
+
+	api.router.ServeHTTP(rr, req)
+
+	if got, want := rr.Header().Get("ETag"), `"1"`; got != want {
+		t.Errorf("itemsHandlerGet() ETag = %s, want %s", got, want)
+	}
+
+	req = httptest.NewRequest(http.MethodPut, "/items", strings.NewReader(`{"id": 2, "name": "upd"}`))
+	req.Header.Set("If-Match", rr.Header().Get("ETag"))
+	rr = httptest.NewRecorder()
+
+	api.router.ServeHTTP(rr, req)
+
+	if got, want := rr.Header().Get("ETag"), `"2"`; got != want {
+		t.Errorf("itemsHandlerPut() ETag = %s, want %s", got, want)
+	}
+}
+
+// legacyRepo отдает объекты без версии, как документы mongo,
+// сохраненные до появления поля version.
+type legacyRepo struct {
+	*memdb.MemDB
+}
+
+func (r legacyRepo) Item(ctx context.Context, id int64) (item, error) {
+	it, err := r.MemDB.Item(ctx, id)
+	it.Version = 0
+	return it, err
+}
+
+// TestAPIETagLegacy проверяет, что у объекта без версии нет
+// ETag, а "0" ни с чем не совпадает.
+func TestAPIETagLegacy(t *testing.T) {
+	api := New(legacyRepo{memdb.New(item{ID: 1, Name: "legacy"})}, logging.Discard(), time.Minute)
+
+	tests := []struct {
+		header, value string
+		wantStatus    int
+	}{
+		{wantStatus: http.StatusOK},
+		{header: "If-None-Match", value: `"0"`, wantStatus: http.StatusOK},
+		{header: "If-None-Match", value: "*", wantStatus: http.StatusNotModified},
+		{header: "If-Match", value: `"0"`, wantStatus: http.StatusPreconditionFailed},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/items/1", nil)
+		if tt.header != "" {
+			req.Header.Set(tt.header, tt.value)
+		}
+		rr := httptest.NewRecorder()
+		api.router.ServeHTTP(rr, req)
+		if rr.Code != tt.wantStatus || rr.Header().Get("ETag") != "" {
+			t.Errorf("GET with %s %s = %d, ETag %q, want %d without ETag",
+				tt.header, tt.value, rr.Code, rr.Header().Get("ETag"), tt.wantStatus)
+		}
+	}
+}
+
+func TestAPICreateAndGet(t *testing.T) {
+	api := newTestAPI()
+
+	req := httptest.NewRequest(http.MethodPost, "/items", strings.NewReader(`{"name": "created"}`))
+	rr := httptest.NewRecorder()
+
+	api.router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("itemsHandlerPost() resp code = %d, want %d", rr.Code, http.StatusCreated)
+	}
+
+	loc := rr.Header().Get("Location")
+	if loc != "/items/3" {
+		t.Fatalf("itemsHandlerPost() Location = %q, want %q", loc, "/items/3")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, loc, nil)
+	rr = httptest.NewRecorder()
+
+	api.router.ServeHTTP(rr, req)
+
+	var got item
+	if err := json.NewDecoder(rr.Body).Decode(&got); err != nil {
+		t.Fatalf("itemsHandlerGet() = err %v", err)
+	}
+
+	want := item{ID: 3, Name: "created", Version: 1}
+	if got != want {
+		t.Errorf("itemsHandlerGet() = %v, want %v", got, want)
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, loc, nil)
+	rr = httptest.NewRecorder()
+
+	api.router.ServeHTTP(rr, req)
+
+	req = httptest.NewRequest(http.MethodGet, loc, nil)
+	rr = httptest.NewRecorder()
+
+	api.router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("itemsHandlerGet() after delete resp code = %d, want %d", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestAPIRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logging.New(&buf, slog.LevelDebug)
+	api := New(logging.Repository(memdb.New(testItems...), logger), logger, time.Minute)
+
+	tests := []struct {
+		header string
+		want   string // пустая строка - новый id
+	}{
+		{header: "req-42", want: "req-42"},
+		{header: ""},
+		{header: "bad id"},
+		{header: strings.Repeat("a", maxRequestIDLen+1)},
+	}
+
+	for _, tt := range tests {
+		buf.Reset()
+		req := httptest.NewRequest(http.MethodGet, "/items/9", nil)
+		if tt.header != "" {
+			req.Header.Set(RequestIDHeader, tt.header)
+		}
+		rr := httptest.NewRecorder()
+		api.router.ServeHTTP(rr, req)
+
+		id, n := rr.Header().Get(RequestIDHeader), rr.Body.Len()
+		if tt.want != "" && id != tt.want || tt.want == "" && (len(id) != 16 || id == tt.header) {
+			t.Errorf("%s %q = %q, want %q or a new id", RequestIDHeader, tt.header, id, tt.want)
+		}
+		var p Problem
+		if err := json.NewDecoder(rr.Body).Decode(&p); err != nil || p.CorrelationID != id {
+			t.Errorf("correlation_id = %q, err %v, want %q", p.CorrelationID, err, id)
+		}
+
+		// запись о вызове БД и запись о запросе
+		var msgs []string
+		dec := json.NewDecoder(&buf)
+		for dec.More() {
+			var rec struct {
+				Msg       string `json:"msg"`
+				RequestID string `json:"request_id"`
+				Status    int    `json:"status"`
+				Bytes     int64  `json:"bytes"`
+				Latency   int64  `json:"latency"`
+			}
+			if err := dec.Decode(&rec); err != nil {
+				t.Fatalf("decode log record = err %v", err)
+			}
+			if rec.RequestID != id {
+				t.Errorf("log record %q request_id = %q, want %q", rec.Msg, rec.RequestID, id)
+			}
+			if rec.Msg == "request" && (rec.Status != http.StatusNotFound || rec.Bytes != int64(n) || rec.Latency <= 0) {
+				t.Errorf("request record = %+v, want status 404, bytes and latency", rec)
+			}
+			msgs = append(msgs, rec.Msg)
+		}
+		if strings.Join(msgs, ",") != "repository call,request" {
+			t.Errorf("log records = %v, want [repository call request]", msgs)
+		}
+	}
+}
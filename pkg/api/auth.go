@@ -0,0 +1,100 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/rtemka/rbtest/pkg/auth"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// publicRoutes маршруты, доступные без проверки подлинности:
+// пробы оркестратора, метрики для Prometheus и описание API.
+var publicRoutes = map[string]bool{
+	livePath:        true,
+	readyPath:       true,
+	metricsPath:     true,
+	"/openapi.json": true,
+}
+
+// Параметры запроса с ключом API и токеном (RFC 6750, 2.3)
+// для клиентов, которые не умеют задавать заголовки.
+const (
+	apiKeyParam      = "api_key"
+	accessTokenParam = "access_token"
+)
+
+// streamRoutes маршруты, на которых ключ или токен можно
+// передать в параметре запроса: EventSource и WebSocket в
+// браузере не задают заголовки. На остальных маршрутах
+// параметры не принимаются, чтобы ключи не попадали в URL.
+var streamRoutes = map[string]bool{
+	"/items/events": true,
+	"/ws":           true,
+}
+
+// authMiddleware проверяет ключ API или токен клиента и
+// передает клиента дальше через контекст. Без них отвечает
+// 401 с заголовком WWW-Authenticate.
+func (api *API) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, _ := mux.CurrentRoute(r).GetPathTemplate()
+		if publicRoutes[route] || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var h auth.Header = r.Header
+		if streamRoutes[route] {
+			h = queryCredentials(r)
+		}
+		p, err := api.auth.Authenticate(h)
+		if err != nil {
+			api.logger.InfoContext(r.Context(), "authentication failed", "err", err)
+			w.Header().Set("WWW-Authenticate", api.auth.Challenge(err))
+			api.writeError(w, r, err)
+			return
+		}
+
+		trace.SpanFromContext(r.Context()).SetAttributes(
+			attribute.String("enduser.id", p.Subject),
+			attribute.String("auth.method", p.Method),
+		)
+		next.ServeHTTP(w, r.WithContext(auth.WithPrincipal(r.Context(), p)))
+	})
+}
+
+// queryCredentials возвращает заголовки запроса, дополненные
+// ключом или токеном из параметров, если в заголовках их нет.
+func queryCredentials(r *http.Request) http.Header {
+	if r.Header.Get(auth.APIKeyHeader) != "" || r.Header.Get("Authorization") != "" {
+		return r.Header
+	}
+	q := r.URL.Query()
+	h := r.Header.Clone()
+	if tok := q.Get(accessTokenParam); tok != "" {
+		h.Set("Authorization", "Bearer "+tok)
+	} else if key := q.Get(apiKeyParam); key != "" {
+		h.Set(auth.APIKeyHeader, key)
+	}
+	return h
+}
+
+// redactQuery возвращает строку запроса, в которой значения
+// ключа и токена заменены, чтобы не писать их в журнал.
+func redactQuery(raw string) string {
+	if !strings.Contains(raw, apiKeyParam) && !strings.Contains(raw, accessTokenParam) {
+		return raw
+	}
+	parts := strings.Split(raw, "&")
+	for i, part := range parts {
+		name, _, _ := strings.Cut(part, "=")
+		if name, err := url.QueryUnescape(name); err == nil && (name == apiKeyParam || name == accessTokenParam) {
+			parts[i] = name + "=REDACTED"
+		}
+	}
+	return strings.Join(parts, "&")
+}
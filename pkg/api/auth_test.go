@@ -0,0 +1,134 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rtemka/rbtest/pkg/auth"
+	"github.com/rtemka/rbtest/pkg/events"
+	"github.com/rtemka/rbtest/pkg/health"
+	"github.com/rtemka/rbtest/pkg/logging"
+	"github.com/rtemka/rbtest/pkg/metrics"
+	"github.com/rtemka/rbtest/pkg/repo/memdb"
+	"github.com/rtemka/rbtest/pkg/repo/observe"
+)
+
+func TestAPIAuth(t *testing.T) {
+	a, err := auth.New(auth.WithAPIKeys([]auth.APIKey{{Name: "ci", SHA256: auth.HashAPIKey("ci-key")}}))
+	if err != nil {
+		t.Fatalf("auth.New() = err %v", err)
+	}
+	// запись идет мимо кэша, и БД видит клиента из контекста
+	var principal auth.Principal
+	db := observe.Wrap(memdb.New(), func(ctx context.Context, op string, _ time.Duration, _ error) {
+		if op == "create_item" {
+			principal, _ = auth.FromContext(ctx)
+		}
+	})
+	api := New(db, logging.Discard(), time.Minute, WithAuth(a), WithHealth(health.New()), WithMetrics(metrics.New()))
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		header     map[string]string
+		wantStatus int
+		wantError  string // значение error в WWW-Authenticate
+	}{
+		{name: "no credentials", method: http.MethodGet, path: "/items", wantStatus: http.StatusUnauthorized},
+		{name: "unknown key", method: http.MethodGet, path: "/items", header: map[string]string{"X-API-Key": "guess"},
+			wantStatus: http.StatusUnauthorized, wantError: "invalid_token"},
+		{name: "bearer not accepted", method: http.MethodGet, path: "/items",
+			header: map[string]string{"Authorization": "Bearer x.y.z"}, wantStatus: http.StatusUnauthorized, wantError: "invalid_token"},
+		{name: "api key", method: http.MethodGet, path: "/items", header: map[string]string{"X-API-Key": "ci-key"},
+			wantStatus: http.StatusOK},
+		{name: "api key scheme", method: http.MethodPost, path: "/items", header: map[string]string{"Authorization": "ApiKey ci-key"},
+			wantStatus: http.StatusCreated},
+		{name: "liveness is public", method: http.MethodGet, path: "/healthz", wantStatus: http.StatusOK},
+		{name: "readiness is public", method: http.MethodGet, path: "/readyz", wantStatus: http.StatusOK},
+		{name: "metrics are public", method: http.MethodGet, path: "/metrics", wantStatus: http.StatusOK},
+		{name: "spec is public", method: http.MethodGet, path: "/openapi.json", wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(`{"name":"a"}`))
+		req.Header.Set("Content-Type", jsonType)
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		api.router.ServeHTTP(rr, req)
+
+		if rr.Code != tt.wantStatus {
+			t.Errorf("%s: %s %s = %d %s, want %d", tt.name, tt.method, tt.path, rr.Code, rr.Body, tt.wantStatus)
+			continue
+		}
+		if rr.Code != http.StatusUnauthorized {
+			continue
+		}
+
+		challenge := rr.Header().Get("WWW-Authenticate")
+		if !strings.HasPrefix(challenge, `Bearer realm="rbtest"`) || strings.Contains(challenge, "invalid_token") != (tt.wantError != "") {
+			t.Errorf("%s: WWW-Authenticate = %q, want error %q", tt.name, challenge, tt.wantError)
+		}
+		var p Problem
+		if err := json.NewDecoder(rr.Body).Decode(&p); err != nil || p.Type != "/problems/unauthorized" {
+			t.Errorf("%s: problem = %+v, err %v, want type /problems/unauthorized", tt.name, p, err)
+		}
+	}
+
+	if want := (auth.Principal{Subject: "ci", Method: auth.MethodAPIKey}); principal != want {
+		t.Errorf("repository principal = %+v, want %+v", principal, want)
+	}
+}
+
+func TestAPIAuthQuery(t *testing.T) {
+	a, err := auth.New(auth.WithAPIKeys([]auth.APIKey{{Name: "ci", SHA256: auth.HashAPIKey("ci-key")}}))
+	if err != nil {
+		t.Fatalf("auth.New() = err %v", err)
+	}
+	var buf bytes.Buffer
+	api := New(memdb.New(), logging.New(&buf, slog.LevelInfo), time.Minute, WithAuth(a), WithEvents(events.New(1)))
+	srv := httptest.NewServer(api.Router())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+	}{
+		{name: "events with api key", path: "/items/events?api_key=ci-key", wantStatus: http.StatusOK},
+		{name: "events with bad token", path: "/items/events?access_token=x.y.z", wantStatus: http.StatusUnauthorized},
+		{name: "events without key", path: "/items/events", wantStatus: http.StatusUnauthorized},
+		// обычный GET без Upgrade прошел проверку и отвергнут обработчиком
+		{name: "websocket with api key", path: "/ws?api_key=ci-key", wantStatus: http.StatusBadRequest},
+		{name: "websocket without key", path: "/ws", wantStatus: http.StatusUnauthorized},
+		{name: "other routes take headers only", path: "/items?api_key=ci-key", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+tt.path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: GET %s = err %v", tt.name, tt.path, err)
+		}
+		resp.Body.Close() // поток событий обрывается клиентом
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("%s: GET %s = %d, want %d", tt.name, tt.path, resp.StatusCode, tt.wantStatus)
+		}
+	}
+
+	srv.Close() // дожидаемся записи журнала всех запросов
+	if log := buf.String(); strings.Contains(log, "ci-key") || !strings.Contains(log, "api_key=REDACTED") {
+		t.Errorf("request log leaks the key or lacks redaction:\n%s", log)
+	}
+}
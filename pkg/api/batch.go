@@ -0,0 +1,162 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/rtemka/rbtest/domain"
+)
+
+// batchRequest тело запроса POST /items:batch.
+type batchRequest struct {
+	Atomic     bool             `json:"atomic"` // все или ничего
+	Operations []batchOperation `json:"operations"`
+}
+
+// batchOperation операция пакета: create, update или delete.
+// Для delete используются только item.id и item.version.
+type batchOperation struct {
+	Op   domain.BatchOp `json:"op"`
+	Item item           `json:"item"`
+}
+
+// batchResult результат операции пакета: HTTP-статус, который
+// вернул бы одиночный запрос, и объект или описание ошибки.
+type batchResult struct {
+	Status int      `json:"status"`
+	Item   *item    `json:"item,omitempty"`
+	Error  *Problem `json:"error,omitempty"`
+}
+
+// batchResponse ответ на пакет. Результаты идут в порядке операций.
+type batchResponse struct {
+	Results []batchResult `json:"results"`
+}
+
+// validate проверяет операцию пакета теми же правилами,
+// что и одиночные запросы.
+func (op batchOperation) validate() error {
+	var err error
+	switch op.Op {
+	case domain.BatchCreate:
+		if op.Item.ID != 0 {
+			return fieldError("item.id", "is assigned by server")
+		}
+		err = op.Item.Validate()
+	case domain.BatchUpdate:
+		if op.Item.ID == 0 {
+			return fieldError("item.id", "is required")
+		}
+		err = op.Item.Validate()
+	case domain.BatchDelete:
+		err = domain.ValidateID(op.Item.ID)
+	default:
+		return fieldError("op", "must be one of create, update, delete")
+	}
+
+	var verr *domain.ValidationError
+	if errors.As(err, &verr) {
+		fields := make([]FieldError, len(verr.Fields))
+		for i, f := range verr.Fields {
+			fields[i] = FieldError{Field: "item." + f.Field, Message: f.Message}
+		}
+		return validationError(verr.Error(), fields...)
+	}
+	return err
+}
+
+// status возвращает HTTP-статус успешной операции.
+func (op batchOperation) status() int {
+	if op.Op == domain.BatchCreate {
+		return http.StatusCreated
+	}
+	return http.StatusOK
+}
+
+// failed формирует результат операции с ошибкой.
+func failed(err error) batchResult {
+	p := asError(err).problem()
+	return batchResult{Status: p.Status, Error: &p}
+}
+
+// itemsHandlerBatch выполняет пакет операций создания, изменения
+// и удаления сущностей и возвращает результат каждой операции.
+// Неатомарный пакет всегда отвечает 200, атомарный при ошибке
+// отвечает статусом ошибочной операции, а остальные операции
+// получают статус 424.
+func (api *API) itemsHandlerBatch() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req batchRequest
+		if err := decodeJSON(w, r, &req, maxBatchBodySize); err != nil {
+			api.writeError(w, r, err)
+			return
+		}
+		if n := len(req.Operations); n == 0 || n > domain.MaxBatchSize {
+			api.writeError(w, r, fieldError("operations", "must hold from 1 to %d operations", domain.MaxBatchSize))
+			return
+		}
+
+		results := make([]batchResult, len(req.Operations))
+		ops := make([]domain.BatchOperation, 0, len(req.Operations))
+		index := make([]int, 0, len(req.Operations)) // индекс операции запроса для ops
+
+		for i, op := range req.Operations {
+			if err := op.validate(); err != nil {
+				if req.Atomic {
+					api.writeBatchAbort(w, len(results), i, err)
+					return
+				}
+				results[i] = failed(err)
+				continue
+			}
+			ops = append(ops, domain.BatchOperation{Op: op.Op, Item: op.Item})
+			index = append(index, i)
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+
+		var res []domain.BatchResult
+		if len(ops) > 0 {
+			var err error
+			res, err = api.repo.Batch(ctx, ops, req.Atomic)
+			if err != nil {
+				api.writeError(w, r, err)
+				return
+			}
+		}
+
+		status := http.StatusOK
+		for k, rr := range res {
+			i := index[k]
+			if rr.Err != nil {
+				results[i] = failed(rr.Err)
+				if !errors.Is(rr.Err, domain.ErrAborted) && req.Atomic {
+					status = results[i].Status
+				}
+				continue
+			}
+			results[i] = batchResult{Status: req.Operations[i].status()}
+			if req.Operations[i].Op != domain.BatchDelete {
+				it := rr.Item
+				results[i].Item = &it
+			}
+		}
+
+		api.WriteJSON(w, batchResponse{Results: results}, status)
+	}
+}
+
+// writeBatchAbort отвечает на атомарный пакет, в котором
+// операция failed не прошла проверку, не обращаясь к БД.
+func (api *API) writeBatchAbort(w http.ResponseWriter, n, failedAt int, err error) {
+	results := make([]batchResult, n)
+	for i := range results {
+		results[i] = failed(domain.ErrAborted)
+	}
+	results[failedAt] = failed(err)
+	api.WriteJSON(w, batchResponse{Results: results}, results[failedAt].Status)
+}
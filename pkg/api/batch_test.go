@@ -0,0 +1,98 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIBatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantOps    []int // статусы операций
+	}{
+		{
+			name: "mixed",
+			body: `{"operations": [
+				{"op": "create", "item": {"name": "new"}},
+				{"op": "update", "item": {"id": 1, "name": "upd", "version": 1}},
+				{"op": "update", "item": {"id": 2, "name": "stale", "version": 5}},
+				{"op": "delete", "item": {"id": 42}},
+				{"op": "create", "item": {"name": ""}},
+				{"op": "delete", "item": {"id": 2}}
+			]}`,
+			wantStatus: http.StatusOK,
+			wantOps:    []int{201, 200, 409, 404, 400, 200},
+		},
+		{
+			name: "atomicConflict",
+			body: `{"atomic": true, "operations": [
+				{"op": "create", "item": {"name": "new"}},
+				{"op": "update", "item": {"id": 2, "name": "stale", "version": 5}}
+			]}`,
+			wantStatus: http.StatusConflict,
+			wantOps:    []int{424, 409},
+		},
+		{
+			name: "atomicInvalid",
+			body: `{"atomic": true, "operations": [
+				{"op": "create", "item": {"name": "new"}},
+				{"op": "rename", "item": {"id": 2}}
+			]}`,
+			wantStatus: http.StatusBadRequest,
+			wantOps:    []int{424, 400},
+		},
+		{
+			name: "atomic",
+			body: `{"atomic": true, "operations": [
+				{"op": "create", "item": {"name": "new"}},
+				{"op": "delete", "item": {"id": 2, "version": 1}}
+			]}`,
+			wantStatus: http.StatusOK,
+			wantOps:    []int{201, 200},
+		},
+		{
+			name:       "empty",
+			body:       `{"operations": []}`,
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newTestAPI()
+
+			req := httptest.NewRequest(http.MethodPost, "/items:batch", strings.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+
+			api.router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("itemsHandlerBatch() resp code = %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+			if tt.wantOps == nil {
+				return
+			}
+
+			var resp batchResponse
+			if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+				t.Fatalf("itemsHandlerBatch() = err %v", err)
+			}
+			if len(resp.Results) != len(tt.wantOps) {
+				t.Fatalf("itemsHandlerBatch() = %d results, want %d", len(resp.Results), len(tt.wantOps))
+			}
+			for i, res := range resp.Results {
+				if res.Status != tt.wantOps[i] {
+					t.Errorf("itemsHandlerBatch() op %d status = %d, want %d", i, res.Status, tt.wantOps[i])
+				}
+				if (res.Error == nil) != (res.Status < 300) {
+					t.Errorf("itemsHandlerBatch() op %d = %+v, want error only for failed operation", i, res)
+				}
+			}
+		})
+	}
+}
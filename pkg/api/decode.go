@@ -0,0 +1,70 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/rtemka/rbtest/domain"
+)
+
+// ограничения размера тела запроса в байтах
+const (
+	maxBodySize      = 64 << 10 // один объект или патч
+	maxBatchBodySize = 4 << 20  // пакет операций
+)
+
+// decodeJSON строго разбирает тело запроса в dst: неизвестные
+// поля, данные после JSON-значения и тело больше limit байт
+// считаются ошибкой запроса.
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst any, limit int64) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(dst); err != nil {
+		return decodeError(err)
+	}
+	// хвост разбираем как сырое значение: иначе его поля
+	// проверялись бы как поля объекта
+	if err := dec.Decode(new(json.RawMessage)); err != io.EOF {
+		if errors.As(err, new(*http.MaxBytesError)) {
+			return decodeError(err)
+		}
+		return validationError("request body must hold a single JSON value")
+	}
+	return nil
+}
+
+// decodeError превращает ошибку разбора JSON в ошибку API.
+func decodeError(err error) error {
+	var (
+		tooLarge *http.MaxBytesError
+		typeErr  *json.UnmarshalTypeError
+	)
+	switch {
+	case errors.As(err, &tooLarge):
+		return &Error{Kind: KindTooLarge, Err: err,
+			Detail: fmt.Sprintf("request body must not exceed %d bytes", tooLarge.Limit)}
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return fieldError(typeErr.Field, "must be of type %s", typeErr.Type)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// у encoding/json нет отдельного типа для этой ошибки
+		field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		return fieldError(field, "is not allowed")
+	}
+	return validationError("request body must be a JSON object")
+}
+
+// pathID разбирает и проверяет id объекта из пути запроса.
+func pathID(r *http.Request) (int64, error) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return 0, fieldError("id", "must be an integer")
+	}
+	return id, domain.ValidateID(id)
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIValidation(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantField  string
+		wantDetail string
+	}{
+		{
+			name:       "emptyName",
+			method:     http.MethodPost,
+			path:       "/items",
+			body:       `{"name":""}`,
+			wantStatus: http.StatusBadRequest,
+			wantField:  "name",
+		},
+		{
+			name:       "longName",
+			method:     http.MethodPost,
+			path:       "/items",
+			body:       `{"name":"` + strings.Repeat("x", 300) + `"}`,
+			wantStatus: http.StatusBadRequest,
+			wantField:  "name",
+		},
+		{
+			name:       "unknownField",
+			method:     http.MethodPost,
+			path:       "/items",
+			body:       `{"name":"ok","color":"red"}`,
+			wantStatus: http.StatusBadRequest,
+			wantField:  "color",
+		},
+		{
+			name:       "wrongType",
+			method:     http.MethodPost,
+			path:       "/items",
+			body:       `{"name":42}`,
+			wantStatus: http.StatusBadRequest,
+			wantField:  "name",
+		},
+		{
+			name:       "trailingData",
+			method:     http.MethodPost,
+			path:       "/items",
+			body:       `{"name":"ok"} {"name":"again"}`,
+			wantStatus: http.StatusBadRequest,
+			wantDetail: "request body must hold a single JSON value",
+		},
+		{
+			name:       "trailingUnknownField",
+			method:     http.MethodPost,
+			path:       "/items",
+			body:       `{"name":"ok"} {"color":"red"}`,
+			wantStatus: http.StatusBadRequest,
+			wantDetail: "request body must hold a single JSON value",
+		},
+		{
+			name:       "trailingGarbage",
+			method:     http.MethodPost,
+			path:       "/items",
+			body:       `{"name":"ok"}]`,
+			wantStatus: http.StatusBadRequest,
+			wantDetail: "request body must hold a single JSON value",
+		},
+		{
+			name:       "tooLarge",
+			method:     http.MethodPost,
+			path:       "/items",
+			body:       `{"name":"` + strings.Repeat("x", maxBodySize) + `"}`,
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "negativeID",
+			method:     http.MethodPut,
+			path:       "/items",
+			body:       `{"id":-1,"name":"ok"}`,
+			wantStatus: http.StatusBadRequest,
+			wantField:  "id",
+		},
+		{
+			name:       "negativePathID",
+			method:     http.MethodGet,
+			path:       "/items/-1",
+			wantStatus: http.StatusBadRequest,
+			wantField:  "id",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			p := problemOf(t, newTestAPI(), r)
+
+			if p.Status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", p.Status, tt.wantStatus, p.Detail)
+			}
+			if tt.wantDetail != "" && p.Detail != tt.wantDetail {
+				t.Errorf("detail = %q, want %q", p.Detail, tt.wantDetail)
+			}
+			if tt.wantField == "" {
+				return
+			}
+			if len(p.Errors) == 0 || p.Errors[0].Field != tt.wantField {
+				t.Errorf("errors = %+v, want error for %q", p.Errors, tt.wantField)
+			}
+		})
+	}
+}
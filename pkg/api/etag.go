@@ -0,0 +1,64 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrPrecondition отправляется, когда версия объекта
+// не совпала с заголовком If-Match.
+var ErrPrecondition = errors.New("precondition failed")
+
+// etag возвращает сильный ETag для версии объекта.
+func etag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// setETag задает заголовок ETag для версии объекта. У объектов,
+// сохраненных без версии (version 0), ETag нет: версию 0 нельзя
+// передать ожидаемой, она означает изменение без проверки.
+func setETag(w http.ResponseWriter, version int64) {
+	if version > 0 {
+		w.Header().Set("ETag", etag(version))
+	}
+}
+
+// etagMatches сообщает, совпадает ли версия объекта хотя бы
+// с одним ETag из заголовка If-Match или If-None-Match.
+// Слабые ETag совпадают только при слабом сравнении (weak),
+// которое RFC 9110 допускает лишь для If-None-Match.
+// С объектом без версии совпадает только "*".
+func etagMatches(header string, version int64, weak bool) bool {
+	want := etag(version)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == "*" || version > 0 && tag == want {
+			return true
+		}
+	}
+	return false
+}
+
+// ifMatchVersion разбирает заголовок If-Match запроса на изменение
+// и возвращает ожидаемую версию объекта. ok равно false, если
+// заголовка нет или он равен "*", то есть изменение безусловное.
+func ifMatchVersion(r *http.Request) (version int64, ok bool, err error) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return 0, false, nil
+	}
+
+	s, err := strconv.Unquote(header)
+	if err == nil {
+		version, err = strconv.ParseInt(s, 10, 64)
+	}
+	if err != nil || version <= 0 {
+		return 0, false, fieldError("If-Match", "must hold a single strong ETag")
+	}
+	return version, true, nil
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rtemka/rbtest/domain"
+	"github.com/rtemka/rbtest/pkg/events"
+)
+
+// eventStreamType тип ответа потока событий.
+const eventStreamType = "text/event-stream"
+
+// интервалы потока событий
+const (
+	eventsHeartbeat = 15 * time.Second // комментарий, чтобы прокси не закрыли соединение
+	eventsRetry     = 3 * time.Second  // через сколько браузер переподключается
+)
+
+// itemsHandlerEvents отправляет изменения объектов потоком
+// Server-Sent Events. Тип события - тип изменения, данные -
+// объект (при удалении только id). Клиент, переподключившийся
+// с заголовком Last-Event-ID, получает пропущенные события,
+// а если их уже нет в буфере - событие reset: список
+// объектов нужно перечитать.
+func (api *API) itemsHandlerEvents() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		after, resume, err := lastEventID(r)
+		if err != nil {
+			api.writeError(w, r, err)
+			return
+		}
+
+		notify, unsubscribe := api.events.Subscribe()
+		defer unsubscribe()
+
+		// без Last-Event-ID клиент получает только новые события
+		if !resume {
+			_, after, _ = api.events.Since(0)
+		}
+
+		h := w.Header()
+		h.Set("Content-Type", eventStreamType)
+		h.Set("Cache-Control", "no-cache")
+		h.Set("X-Accel-Buffering", "no") // не буферизовать в nginx
+		w.WriteHeader(http.StatusOK)
+
+		rc := http.NewResponseController(w)
+		fmt.Fprintf(w, "retry: %d\n\n", eventsRetry.Milliseconds())
+
+		heartbeat := time.NewTicker(eventsHeartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			evs, last, ok := api.events.Since(after)
+			if !ok {
+				evs = []events.Event{{ID: last, Change: domain.Change{Op: domain.ChangeReset}}}
+			}
+			for _, ev := range evs {
+				if err := writeEvent(w, ev); err != nil {
+					return
+				}
+			}
+			after = last
+			if err := rc.Flush(); err != nil {
+				return
+			}
+
+			select {
+			case <-r.Context().Done():
+				return
+			case _, open := <-notify:
+				if !open {
+					return // сервер останавливается
+				}
+			case <-heartbeat.C:
+				if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// writeEvent записывает событие в формате text/event-stream.
+func writeEvent(w io.Writer, ev events.Event) error {
+	var data any = ev.Change.Item
+	switch ev.Change.Op {
+	case domain.ChangeDeleted:
+		data = struct {
+			ID int64 `json:"id"`
+		}{ev.Change.Item.ID}
+	case domain.ChangeReset:
+		data = struct{}{}
+	}
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Change.Op, b)
+	return err
+}
+
+// lastEventID разбирает заголовок Last-Event-ID. EventSource
+// не умеет задавать заголовки, поэтому номер можно передать
+// и параметром last_event_id.
+func lastEventID(r *http.Request) (id uint64, ok bool, err error) {
+	v := r.Header.Get("Last-Event-ID")
+	field := "Last-Event-ID"
+	if v == "" {
+		v, field = r.URL.Query().Get("last_event_id"), "last_event_id"
+	}
+	if v = strings.TrimSpace(v); v == "" {
+		return 0, false, nil
+	}
+	if id, err = strconv.ParseUint(v, 10, 64); err != nil {
+		return 0, false, fieldError(field, "must be a non-negative integer")
+	}
+	return id, true, nil
+}
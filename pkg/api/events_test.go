@@ -0,0 +1,90 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rtemka/rbtest/domain"
+	"github.com/rtemka/rbtest/pkg/events"
+	"github.com/rtemka/rbtest/pkg/logging"
+	"github.com/rtemka/rbtest/pkg/repo/memdb"
+)
+
+// readEvent читает из потока следующее событие
+// и возвращает его строки без пустой строки в конце.
+func readEvent(t *testing.T, r *bufio.Reader) []string {
+	t.Helper()
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read event = err %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && len(lines) > 0:
+			return lines
+		case line == "", strings.HasPrefix(line, ":"), strings.HasPrefix(line, "retry:"):
+		default:
+			lines = append(lines, line)
+		}
+	}
+}
+
+func TestAPIEvents(t *testing.T) {
+	feed := events.New(2)
+	api := New(memdb.New(), logging.Discard(), time.Minute, WithEvents(feed))
+	srv := httptest.NewServer(api.Router())
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	connect := func(lastID string) *bufio.Reader {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/items/events", nil)
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET /items/events = err %v", err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || ct != eventStreamType {
+			t.Fatalf("GET /items/events = %d %s, want 200 %s", resp.StatusCode, ct, eventStreamType)
+		}
+		return bufio.NewReader(resp.Body)
+	}
+
+	stream := connect("")
+	feed.Publish([]domain.Change{
+		{Op: domain.ChangeCreated, Item: item{ID: 1, Name: "one", Version: 1}},
+		{Op: domain.ChangeDeleted, Item: item{ID: 1}},
+	})
+
+	want := [][]string{
+		{"id: 1", "event: created", `data: {"id":1,"name":"one","version":1}`},
+		{"id: 2", "event: deleted", `data: {"id":1}`},
+	}
+	for _, w := range want {
+		if got := readEvent(t, stream); strings.Join(got, "\n") != strings.Join(w, "\n") {
+			t.Errorf("event = %q, want %q", got, w)
+		}
+	}
+
+	// пропущенное событие есть в буфере
+	if got := readEvent(t, connect("1")); got[0] != "id: 2" {
+		t.Errorf("resumed event = %q, want id 2", got)
+	}
+
+	// пропущенные события вытеснены из буфера
+	feed.Publish([]domain.Change{{Op: domain.ChangeCreated, Item: item{ID: 2}}, {Op: domain.ChangeCreated, Item: item{ID: 3}}})
+	if got := readEvent(t, connect("1")); got[1] != "event: reset" || got[0] != "id: 4" {
+		t.Errorf("resumed event = %q, want reset with id 4", got)
+	}
+}
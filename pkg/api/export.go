@@ -0,0 +1,205 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rtemka/rbtest/domain"
+)
+
+// форматы ответа списка сущностей
+const (
+	jsonType   = "application/json"
+	ndjsonType = "application/x-ndjson"
+	csvType    = "text/csv"
+)
+
+// exportFlushEvery через сколько объектов выгрузка отправляется клиенту.
+const exportFlushEvery = 256
+
+// exportTimeout ограничение времени выгрузки всей коллекции.
+const exportTimeout = 5 * time.Minute
+
+// negotiate выбирает формат ответа по заголовку Accept
+// из предложенных форматов offers. Формат с наибольшим
+// весом q побеждает, при равенстве весов - тот, что раньше
+// в offers. Без заголовка выбирается первый формат, ok равно
+// false, если ни один формат клиенту не подходит.
+func negotiate(accept string, offers ...string) (format string, ok bool) {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0], true
+	}
+
+	best := 0.0
+	for _, offer := range offers {
+		q, spec := 0.0, -1 // вес самого конкретного подходящего диапазона
+		for _, rng := range strings.Split(accept, ",") {
+			mt, params, err := mime.ParseMediaType(strings.TrimSpace(rng))
+			if err != nil {
+				continue
+			}
+
+			s := -1
+			switch {
+			case mt == offer:
+				s = 2
+			case strings.HasSuffix(mt, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(mt, "*")):
+				s = 1
+			case mt == "*/*":
+				s = 0
+			}
+			if s <= spec {
+				continue
+			}
+
+			spec, q = s, 1
+			if v, ok := params["q"]; ok {
+				if q, err = strconv.ParseFloat(v, 64); err != nil {
+					q = 0
+				}
+			}
+		}
+		if q > best {
+			best, format = q, offer
+		}
+	}
+	return format, best > 0
+}
+
+// itemEncoder записывает объекты в поток в одном из форматов выгрузки.
+type itemEncoder interface {
+	encode(item) error
+	flush() error
+}
+
+// ndjsonEncoder пишет по одному JSON-объекту на строку.
+type ndjsonEncoder struct {
+	bw  *bufio.Writer
+	enc *json.Encoder
+}
+
+func newNDJSONEncoder(w io.Writer) *ndjsonEncoder {
+	bw := bufio.NewWriter(w)
+	return &ndjsonEncoder{bw: bw, enc: json.NewEncoder(bw)}
+}
+
+func (e *ndjsonEncoder) encode(it item) error { return e.enc.Encode(it) }
+func (e *ndjsonEncoder) flush() error         { return e.bw.Flush() }
+
+// csvEncoder пишет CSV с заголовком id,name,version.
+type csvEncoder struct {
+	cw *csv.Writer
+}
+
+func newCSVEncoder(w io.Writer) *csvEncoder {
+	e := csvEncoder{cw: csv.NewWriter(w)}
+	_ = e.cw.Write([]string{"id", "name", "version"})
+	return &e
+}
+
+func (e *csvEncoder) encode(it item) error {
+	return e.cw.Write([]string{
+		strconv.FormatInt(it.ID, 10),
+		it.Name,
+		strconv.FormatInt(it.Version, 10),
+	})
+}
+
+func (e *csvEncoder) flush() error {
+	e.cw.Flush()
+	return e.cw.Error()
+}
+
+// startWriter запоминает, начали ли данные уходить клиенту:
+// после этого ответить ошибкой уже нельзя.
+type startWriter struct {
+	w       io.Writer
+	started bool
+}
+
+func (sw *startWriter) Write(p []byte) (int, error) {
+	sw.started = true
+	return sw.w.Write(p)
+}
+
+// exportQuery разбирает параметры выгрузки: из параметров
+// списка сущностей допустимы только name_prefix и name_contains.
+// Выгрузка всегда идет целиком по id, поэтому limit, cursor и
+// sort считаются ошибкой запроса, а не молча отбрасываются.
+func exportQuery(v url.Values) (domain.ListQuery, error) {
+	for _, name := range []string{"limit", "cursor", "sort"} {
+		if v.Has(name) {
+			return domain.ListQuery{}, fieldError(name, "is not supported for NDJSON and CSV responses")
+		}
+	}
+	return domain.ListQuery{
+		Sort:         domain.SortByID,
+		NamePrefix:   v.Get("name_prefix"),
+		NameContains: v.Get("name_contains"),
+	}, nil
+}
+
+// exportItems выгружает все сущности, подходящие под фильтры
+// по имени, потоком в формате format. Объекты читаются из БД
+// по одному и отправляются клиенту порциями, поэтому память
+// не зависит от размера коллекции.
+func (api *API) exportItems(w http.ResponseWriter, r *http.Request, format string) {
+	q, err := exportQuery(r.URL.Query())
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), exportTimeout)
+	defer cancel()
+
+	sw := &startWriter{w: w}
+	var enc itemEncoder
+	if format == csvType {
+		w.Header().Set("Content-Type", csvType+"; charset=utf-8")
+		enc = newCSVEncoder(sw)
+	} else {
+		w.Header().Set("Content-Type", ndjsonType)
+		enc = newNDJSONEncoder(sw)
+	}
+
+	rc := http.NewResponseController(w)
+	n := 0
+
+	err = domain.Iterate(ctx, api.repo, func(it item) error {
+		if !q.Match(it) {
+			return nil
+		}
+		if err := enc.encode(it); err != nil {
+			return err
+		}
+		if n++; n%exportFlushEvery == 0 {
+			if err := enc.flush(); err != nil {
+				return err
+			}
+			return rc.Flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = enc.flush()
+	}
+
+	switch {
+	case err == nil:
+	case !sw.started:
+		api.writeError(w, r, err)
+	default:
+		// статус уже отправлен, клиент увидит оборванный поток
+		api.logger.WarnContext(r.Context(), "export interrupted", "path", r.URL.Path, "items", n, "err", err)
+	}
+}
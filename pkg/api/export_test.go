@@ -0,0 +1,136 @@
+package api
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rtemka/rbtest/pkg/logging"
+	"github.com/rtemka/rbtest/pkg/repo/memdb"
+)
+
+func TestNegotiate(t *testing.T) {
+	offers := []string{jsonType, ndjsonType, csvType}
+
+	tests := []struct {
+		accept string
+		want   string
+		wantOK bool
+	}{
+		{"", jsonType, true},
+		{"*/*", jsonType, true},
+		{"application/x-ndjson", ndjsonType, true},
+		{"text/csv; charset=utf-8", csvType, true},
+		{"text/*", csvType, true},
+		{"application/json;q=0.5, text/csv", csvType, true},
+		{"text/csv;q=0, */*;q=0.1", jsonType, true},
+		{"application/x-ndjson;q=0.9, application/json", jsonType, true},
+		{"text/html", "", false},
+		{"text/csv;q=0", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := negotiate(tt.accept, offers...)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("negotiate(%q) = %q, %v, want %q, %v", tt.accept, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+// exportAPI возвращает API поверх БД с n объектами.
+func exportAPI(n int) (*API, []item) {
+	items := make([]item, n)
+	for i := range items {
+		items[i] = item{ID: int64(i + 1), Name: fmt.Sprintf("item, \"%d\"", i+1), Version: 1}
+	}
+	return New(memdb.New(items...), logging.Discard(), time.Minute), items
+}
+
+func TestAPIExport(t *testing.T) {
+	// больше exportFlushEvery, чтобы выгрузка шла несколькими порциями
+	api, items := exportAPI(exportFlushEvery*2 + 3)
+
+	t.Run("NDJSON", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/items", nil)
+		req.Header.Set("Accept", ndjsonType)
+		rr := httptest.NewRecorder()
+
+		api.router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != ndjsonType {
+			t.Fatalf("itemsHandlerList() = %d %s, want 200 %s", rr.Code, rr.Header().Get("Content-Type"), ndjsonType)
+		}
+
+		var got []item
+		sc := bufio.NewScanner(rr.Body)
+		for sc.Scan() {
+			var it item
+			if err := json.Unmarshal(sc.Bytes(), &it); err != nil {
+				t.Fatalf("line %d = err %v", len(got)+1, err)
+			}
+			got = append(got, it)
+		}
+		if !reflect.DeepEqual(got, items) {
+			t.Errorf("itemsHandlerList() exported %d items, want %d", len(got), len(items))
+		}
+	})
+
+	t.Run("CSV", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/items?name_prefix=item,%20%221", nil)
+		req.Header.Set("Accept", csvType)
+		rr := httptest.NewRecorder()
+
+		api.router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("itemsHandlerList() resp code = %d, want %d", rr.Code, http.StatusOK)
+		}
+
+		records, err := csv.NewReader(rr.Body).ReadAll()
+		if err != nil {
+			t.Fatalf("csv = err %v", err)
+		}
+		if !reflect.DeepEqual(records[0], []string{"id", "name", "version"}) {
+			t.Errorf("csv header = %v", records[0])
+		}
+		if want := []string{"1", `item, "1"`, "1"}; !reflect.DeepEqual(records[1], want) {
+			t.Errorf("csv first record = %v, want %v", records[1], want)
+		}
+		for _, rec := range records[1:] {
+			if !strings.HasPrefix(rec[1], `item, "1`) {
+				t.Errorf("csv record %v does not match name_prefix", rec)
+			}
+		}
+	})
+
+	t.Run("PaginationRejected", func(t *testing.T) {
+		for _, param := range []string{"limit", "cursor", "sort"} {
+			req := httptest.NewRequest(http.MethodGet, "/items?"+param+"=1", nil)
+			req.Header.Set("Accept", ndjsonType)
+			p := problemOf(t, api, req)
+
+			if p.Status != http.StatusBadRequest || len(p.Errors) == 0 || p.Errors[0].Field != param {
+				t.Errorf("itemsHandlerList(%s) = %d %+v, want 400 for %q", param, p.Status, p.Errors, param)
+			}
+		}
+	})
+
+	t.Run("NotAcceptable", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/items", nil)
+		req.Header.Set("Accept", "text/html")
+		rr := httptest.NewRecorder()
+
+		api.router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusNotAcceptable {
+			t.Errorf("itemsHandlerList() resp code = %d, want %d", rr.Code, http.StatusNotAcceptable)
+		}
+	})
+}
@@ -0,0 +1,38 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/rtemka/rbtest/pkg/health"
+)
+
+// Пути проб и метрик.
+const (
+	livePath    = "/healthz"
+	readyPath   = "/readyz"
+	metricsPath = "/metrics"
+)
+
+// healthHandlerLive отвечает, что процесс жив и
+// обрабатывает запросы. Зависимости не проверяются.
+func (api *API) healthHandlerLive() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		api.WriteJSON(w, health.Report{Status: health.StatusOK}, http.StatusOK)
+	}
+}
+
+// healthHandlerReady проверяет зависимости и отвечает 200,
+// если приложение готово принимать запросы, и 503, если нет
+// или если началась остановка.
+func (api *API) healthHandlerReady() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		report := api.health.Ready(r.Context())
+		if !report.OK() {
+			api.WriteJSON(w, report, http.StatusServiceUnavailable)
+			return
+		}
+		api.WriteJSON(w, report, http.StatusOK)
+	}
+}
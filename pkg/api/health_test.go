@@ -0,0 +1,63 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rtemka/rbtest/pkg/health"
+	"github.com/rtemka/rbtest/pkg/logging"
+	"github.com/rtemka/rbtest/pkg/repo/memdb"
+)
+
+func TestAPIHealth(t *testing.T) {
+	var dbErr error
+	h := health.New()
+	h.Register("db", func(context.Context) error { return dbErr })
+	api := New(memdb.New(), logging.Discard(), time.Minute, WithHealth(h))
+
+	tests := []struct {
+		name       string
+		path       string
+		dbErr      error
+		drain      bool
+		wantStatus int
+		want       string
+	}{
+		{name: "live", path: "/healthz", wantStatus: http.StatusOK, want: health.StatusOK},
+		{name: "ready", path: "/readyz", wantStatus: http.StatusOK, want: health.StatusOK},
+		{name: "db down", path: "/readyz", dbErr: errors.New("no reachable servers"),
+			wantStatus: http.StatusServiceUnavailable, want: health.StatusFail},
+		{name: "live while db down", path: "/healthz", dbErr: errors.New("no reachable servers"),
+			wantStatus: http.StatusOK, want: health.StatusOK},
+		{name: "shutting down", path: "/readyz", drain: true,
+			wantStatus: http.StatusServiceUnavailable, want: health.StatusShuttingDown},
+		{name: "live while shutting down", path: "/healthz", drain: true,
+			wantStatus: http.StatusOK, want: health.StatusOK},
+	}
+
+	for _, tt := range tests {
+		dbErr = tt.dbErr
+		if tt.drain {
+			h.Drain()
+		}
+
+		rr := httptest.NewRecorder()
+		api.router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+		var got health.Report
+		if err := json.NewDecoder(rr.Body).Decode(&got); err != nil {
+			t.Fatalf("%s: decode = err %v", tt.name, err)
+		}
+		if rr.Code != tt.wantStatus || got.Status != tt.want {
+			t.Errorf("%s: GET %s = %d %s, want %d %s", tt.name, tt.path, rr.Code, got.Status, tt.wantStatus, tt.want)
+		}
+		if tt.dbErr != nil && tt.path == "/readyz" && got.Checks["db"].Error != tt.dbErr.Error() {
+			t.Errorf("%s: db check = %+v, want error %q", tt.name, got.Checks["db"], tt.dbErr)
+		}
+	}
+}
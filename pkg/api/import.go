@@ -0,0 +1,87 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rtemka/rbtest/pkg/importer"
+)
+
+// maxImportBodySize ограничение размера загружаемого файла в байтах.
+const maxImportBodySize = 32 << 20
+
+// importTimeout ограничение времени загрузки файла.
+const importTimeout = 5 * time.Minute
+
+// importFormats форматы загрузки по типу тела запроса.
+var importFormats = map[string]importer.Format{
+	jsonType:   importer.FormatJSON,
+	ndjsonType: importer.FormatNDJSON,
+	csvType:    importer.FormatCSV,
+}
+
+// itemsHandlerImport загружает объекты из тела запроса в формате
+// JSON-массива, NDJSON или CSV (по Content-Type). Параметры:
+// mode - upsert (по умолчанию), insert или replace, dry_run -
+// только проверить файл. Отвечает отчетом о загрузке: 200, если
+// ошибок нет, иначе 422 с номерами строк ошибок. При ошибках
+// в файле ничего не записывается, а ошибки записи отдельных
+// объектов не отменяют запись остальных.
+func (api *API) itemsHandlerImport() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		opts, err := importOptions(r)
+		if err != nil {
+			api.writeError(w, r, err)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), importTimeout)
+		defer cancel()
+
+		body := http.MaxBytesReader(w, r.Body, maxImportBodySize)
+		rep, err := importer.Import(ctx, api.repo, body, opts)
+		if errors.As(err, new(*http.MaxBytesError)) {
+			err = decodeError(err)
+		}
+		if err != nil {
+			api.writeError(w, r, err)
+			return
+		}
+
+		status := http.StatusOK
+		if !rep.OK() {
+			status = http.StatusUnprocessableEntity
+		}
+		api.WriteJSON(w, rep, status)
+	}
+}
+
+// importOptions разбирает параметры загрузки из запроса.
+func importOptions(r *http.Request) (importer.Options, error) {
+	var opts importer.Options
+
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	format, ok := importFormats[mt]
+	if err != nil || !ok {
+		return opts, &Error{Kind: KindUnsupportedMedia,
+			Detail: fmt.Sprintf("Content-Type must be one of %s, %s, %s", jsonType, ndjsonType, csvType)}
+	}
+	opts.Format = format
+
+	query := r.URL.Query()
+	if opts.Mode, err = importer.ParseMode(query.Get("mode")); err != nil {
+		return opts, fieldError("mode", "must be one of upsert, insert, replace")
+	}
+	if v := query.Get("dry_run"); v != "" {
+		if opts.DryRun, err = strconv.ParseBool(v); err != nil {
+			return opts, fieldError("dry_run", "must be a boolean")
+		}
+	}
+	return opts, nil
+}
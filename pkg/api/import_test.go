@@ -0,0 +1,87 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rtemka/rbtest/pkg/importer"
+)
+
+func TestAPIImport(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		contentType string
+		body        string
+		wantStatus  int
+		wantCreated int
+		wantErrors  int
+	}{
+		{
+			name:        "csv",
+			contentType: "text/csv; charset=utf-8",
+			body:        "id,name\n100,imported\n,new\n",
+			wantStatus:  http.StatusOK,
+			wantCreated: 2,
+		},
+		{
+			name:        "dryRun",
+			query:       "?dry_run=true&mode=insert",
+			contentType: ndjsonType,
+			body:        "{\"id\": 1, \"name\": \"taken\"}\n{\"name\": \"new\"}\n",
+			wantStatus:  http.StatusUnprocessableEntity,
+			wantCreated: 1,
+			wantErrors:  1,
+		},
+		{
+			name:        "invalid",
+			contentType: jsonType,
+			body:        `[{"name": ""}]`,
+			wantStatus:  http.StatusUnprocessableEntity,
+			wantErrors:  1,
+		},
+		{
+			name:        "badMode",
+			query:       "?mode=merge",
+			contentType: jsonType,
+			body:        `[]`,
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:        "unsupportedMedia",
+			contentType: "application/xml",
+			body:        `<items/>`,
+			wantStatus:  http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newTestAPI()
+
+			req := httptest.NewRequest(http.MethodPost, "/items:import"+tt.query, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			rr := httptest.NewRecorder()
+
+			api.router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("itemsHandlerImport() resp code = %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+			if rr.Code >= 400 && rr.Code != http.StatusUnprocessableEntity {
+				return
+			}
+
+			var rep importer.Report
+			if err := json.NewDecoder(rr.Body).Decode(&rep); err != nil {
+				t.Fatalf("itemsHandlerImport() = err %v", err)
+			}
+			if rep.Created != tt.wantCreated || len(rep.Errors) != tt.wantErrors {
+				t.Errorf("itemsHandlerImport() = %+v, want created %d and %d errors", rep, tt.wantCreated, tt.wantErrors)
+			}
+		})
+	}
+}
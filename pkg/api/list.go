@@ -0,0 +1,66 @@
+package api
+
+import (
+	"net/url"
+	"strconv"
+
+	"github.com/rtemka/rbtest/domain"
+)
+
+// itemsPage страница списка сущностей в ответе API.
+type itemsPage struct {
+	Items      []item `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// newItemsPage формирует ответ API из страницы, полученной от БД.
+func newItemsPage(page domain.ItemsPage) itemsPage {
+	out := itemsPage{Items: page.Items}
+	if out.Items == nil {
+		out.Items = []item{} // пустой список, а не null
+	}
+	if page.Next != nil {
+		out.NextCursor = page.Next.Encode()
+	}
+	return out
+}
+
+// listQuery разбирает параметры запроса списка сущностей:
+// limit, cursor, sort (id, -id, name, -name), name_prefix и name_contains.
+func listQuery(v url.Values) (domain.ListQuery, error) {
+	q := domain.ListQuery{
+		Sort:         domain.SortByID,
+		NamePrefix:   v.Get("name_prefix"),
+		NameContains: v.Get("name_contains"),
+	}
+
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > domain.MaxListLimit {
+			return q, fieldError("limit", "must be between 1 and %d", domain.MaxListLimit)
+		}
+		q.Limit = n
+	}
+
+	switch v.Get("sort") {
+	case "", "id":
+	case "-id":
+		q.Desc = true
+	case "name":
+		q.Sort = domain.SortByName
+	case "-name":
+		q.Sort, q.Desc = domain.SortByName, true
+	default:
+		return q, fieldError("sort", "must be one of id, -id, name, -name")
+	}
+
+	if s := v.Get("cursor"); s != "" {
+		c, err := domain.DecodeCursor(s)
+		if err != nil {
+			return q, fieldError("cursor", "is not a cursor returned by the server")
+		}
+		q.After = &c
+	}
+
+	return q, nil
+}
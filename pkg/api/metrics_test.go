@@ -0,0 +1,53 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rtemka/rbtest/pkg/events"
+	"github.com/rtemka/rbtest/pkg/logging"
+	"github.com/rtemka/rbtest/pkg/metrics"
+	"github.com/rtemka/rbtest/pkg/repo/memdb"
+)
+
+func TestAPIMetrics(t *testing.T) {
+	api := New(memdb.New(), logging.Discard(), time.Minute,
+		WithEvents(events.New(1)), WithMetrics(metrics.New()))
+	srv := httptest.NewServer(api.Router())
+	defer srv.Close()
+
+	for _, path := range []string{"/items/1", "/items/1", "/items"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s = err %v", path, err)
+		}
+		resp.Body.Close()
+	}
+	// WebSocket проходит через обертку ResponseWriter
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Dial() = err %v", err)
+	}
+	conn.Close()
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics = err %v", err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+
+	for _, want := range []string{
+		`rbtest_http_requests_total{method="GET",route="/items/{id}",status="404"} 2`,
+		`rbtest_http_requests_total{method="GET",route="/items",status="200"} 1`,
+	} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("GET /metrics does not contain %q", want)
+		}
+	}
+}
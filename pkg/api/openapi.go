@@ -0,0 +1,153 @@
+package api
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+)
+
+// openapiSpec описание API в формате OpenAPI 3. Должно совпадать
+// с маршрутами endpoints, это проверяет TestOpenAPIRoutes.
+//
+//go:embed openapi.json
+var openapiSpec []byte
+
+// loadSpec разбирает и проверяет описание API.
+func loadSpec() (*openapi3.T, error) {
+	doc, err := openapi3.NewLoader().LoadFromData(openapiSpec)
+	if err != nil {
+		return nil, err
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// WithValidation включает проверку запросов по описанию API
+// до вызова обработчиков. Обработчики проверяют запросы и сами,
+// поэтому проверка нужна, чтобы описание и поведение API
+// не расходились, например, в тестах и на стенде.
+func WithValidation() Option {
+	return func(api *API) { api.validate = true }
+}
+
+// itemsHandlerOpenAPI отдает описание API.
+func (api *API) itemsHandlerOpenAPI() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(openapiSpec)
+	}
+}
+
+// registerDecoders добавляет разбор тел JSON Merge Patch,
+// которого нет в openapi3filter.
+var registerDecoders = sync.OnceFunc(func() {
+	openapi3filter.RegisterBodyDecoder(mergePatchType, openapi3filter.JSONBodyDecoder)
+})
+
+// validationMiddleware проверяет параметры и тело запроса
+// по описанию API. Тело проверяется, только если его тип есть
+// в описании, иначе неподдерживаемый тип отклоняет обработчик.
+// Запросы к маршрутам без описания пропускаются.
+func (api *API) validationMiddleware() (func(http.Handler) http.Handler, error) {
+	doc, err := loadSpec()
+	if err != nil {
+		return nil, fmt.Errorf("openapi spec: %w", err)
+	}
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return nil, fmt.Errorf("openapi router: %w", err)
+	}
+	registerDecoders()
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route, params, err := router.FindRoute(r)
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			checkBody := hasBodySchema(route, r)
+			if checkBody {
+				// openapi3filter читает тело целиком, поэтому ограничиваем
+				// его самым большим из лимитов обработчиков JSON
+				r.Body = http.MaxBytesReader(w, r.Body, maxBatchBodySize)
+			}
+
+			in := openapi3filter.RequestValidationInput{
+				Request:    r,
+				PathParams: params,
+				Route:      route,
+				Options: &openapi3filter.Options{
+					ExcludeRequestBody: !checkBody,
+					AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+				},
+			}
+			if err := openapi3filter.ValidateRequest(r.Context(), &in); err != nil {
+				api.writeError(w, r, specError(err))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// hasBodySchema сообщает, описано ли в маршруте JSON-тело
+// с типом содержимого запроса. Тела операций с расширением
+// x-skip-body-validation проверяют сами обработчики, например,
+// загрузка файлов с номерами строк ошибок.
+func hasBodySchema(route *routers.Route, r *http.Request) bool {
+	body := route.Operation.RequestBody
+	if body == nil || body.Value == nil || route.Operation.Extensions["x-skip-body-validation"] == true {
+		return false
+	}
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (mt != jsonType && !strings.HasSuffix(mt, "+json")) {
+		return false
+	}
+	return body.Value.Content.Get(mt) != nil
+}
+
+// specError переводит ошибку проверки запроса в ошибку API
+// с указанием поля.
+func specError(err error) error {
+	if errors.As(err, new(*http.MaxBytesError)) {
+		return decodeError(err)
+	}
+
+	var reqErr *openapi3filter.RequestError
+	if !errors.As(err, &reqErr) {
+		return validationError(err.Error())
+	}
+
+	field, msg := "body", reqErr.Reason
+	if reqErr.Parameter != nil {
+		field = reqErr.Parameter.Name
+	}
+	var schemaErr *openapi3.SchemaError
+	if errors.As(err, &schemaErr) {
+		// у allOf причина во вложенной ошибке
+		for inner := schemaErr; errors.As(inner.Origin, &inner); {
+			schemaErr = inner
+		}
+		if ptr := schemaErr.JSONPointer(); len(ptr) > 0 && reqErr.Parameter == nil {
+			field = strings.Join(ptr, ".")
+		}
+		msg = schemaErr.Reason
+	}
+	if msg == "" {
+		msg = "is invalid"
+	}
+	return fieldError(field, "%s", msg)
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rtemka/rbtest/pkg/events"
+	"github.com/rtemka/rbtest/pkg/health"
+	"github.com/rtemka/rbtest/pkg/logging"
+	"github.com/rtemka/rbtest/pkg/metrics"
+	"github.com/rtemka/rbtest/pkg/repo/memdb"
+)
+
+// pathVars выбирает имена параметров из шаблона пути.
+var pathVars = regexp.MustCompile(`\{([^}:]+)`)
+
+// TestOpenAPIRoutes сверяет маршруты API с описанием:
+// каждый маршрут должен быть описан с теми же параметрами
+// пути, а каждая описанная операция - существовать.
+func TestOpenAPIRoutes(t *testing.T) {
+	doc, err := loadSpec()
+	if err != nil {
+		t.Fatalf("loadSpec() = err %v", err)
+	}
+
+	api := New(memdb.New(), logging.Discard(), time.Minute,
+		WithEvents(events.New(1)), WithMetrics(metrics.New()), WithHealth(health.New()))
+	routes := map[string]bool{} // "METHOD path"
+	err = api.Router().Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return err
+		}
+
+		item := doc.Paths.Value(path)
+		if item == nil {
+			t.Errorf("route %s %v is missing from the spec", path, methods)
+			return nil
+		}
+		for _, m := range methods {
+			if m == http.MethodOptions {
+				continue // предварительные запросы CORS не описываются
+			}
+			routes[m+" "+path] = true
+			op := item.GetOperation(m)
+			if op == nil {
+				t.Errorf("route %s %s is missing from the spec", m, path)
+				continue
+			}
+
+			var want, got []string
+			for _, v := range pathVars.FindAllStringSubmatch(path, -1) {
+				want = append(want, v[1])
+			}
+			for _, p := range append(item.Parameters, op.Parameters...) {
+				if p.Value.In == "path" {
+					got = append(got, p.Value.Name)
+				}
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("%s %s path parameters in spec = %v, want %v", m, path, got, want)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk() = err %v", err)
+	}
+
+	for path, item := range doc.Paths.Map() {
+		for m := range item.Operations() {
+			if !routes[m+" "+path] {
+				t.Errorf("spec operation %s %s has no route", m, path)
+			}
+		}
+	}
+}
+
+func TestOpenAPIValidation(t *testing.T) {
+	api := New(memdb.New(), logging.Discard(), time.Minute, WithValidation())
+	srv := httptest.NewServer(api.Router())
+	defer srv.Close()
+
+	tests := []struct {
+		method, path string
+		contentType  string
+		body         string
+		wantStatus   int
+		wantField    string
+	}{
+		{http.MethodGet, "/openapi.json", "", "", http.StatusOK, ""},
+		{http.MethodPost, "/items", jsonType, `{"name":"a"}`, http.StatusCreated, ""},
+		{http.MethodGet, "/items?limit=0", "", "", http.StatusBadRequest, "limit"},
+		{http.MethodGet, "/items?sort=version", "", "", http.StatusBadRequest, "sort"},
+		{http.MethodGet, "/items/0", "", "", http.StatusBadRequest, "id"},
+		{http.MethodPost, "/items", jsonType, `{"name":""}`, http.StatusBadRequest, "name"},
+		{http.MethodPost, "/items", jsonType, `{"id":"1","name":"a"}`, http.StatusBadRequest, "id"},
+		{http.MethodPut, "/items", jsonType, `{"name":"a"}`, http.StatusBadRequest, "id"},
+		{http.MethodPatch, "/items/1", mergePatchType, `{"name":5}`, http.StatusBadRequest, "name"},
+		{http.MethodPatch, "/items/1", jsonPatchType, `[{"op":"drop","path":"/name"}]`, http.StatusBadRequest, "0.op"},
+		{http.MethodPatch, "/items/1", "text/plain", `name=b`, http.StatusUnsupportedMediaType, ""},
+		{http.MethodPost, "/items:batch", jsonType, `{"operations":[]}`, http.StatusBadRequest, "operations"},
+		{http.MethodPost, "/items:import?mode=merge", csvType, "name\nb\n", http.StatusBadRequest, "mode"},
+		{http.MethodPost, "/items:import", jsonType, `[{"name":""}]`, http.StatusUnprocessableEntity, ""},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, srv.URL+tt.path, strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s = err %v", tt.method, tt.path, err)
+		}
+
+		var p Problem
+		_ = json.NewDecoder(resp.Body).Decode(&p)
+		resp.Body.Close()
+
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("%s %s %s = %d %+v, want %d", tt.method, tt.path, tt.body, resp.StatusCode, p, tt.wantStatus)
+			continue
+		}
+		if tt.wantField != "" && (len(p.Errors) != 1 || p.Errors[0].Field != tt.wantField) {
+			t.Errorf("%s %s %s errors = %+v, want field %q", tt.method, tt.path, tt.body, p.Errors, tt.wantField)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/rtemka/rbtest/domain"
+)
+
+// типы содержимого запроса PATCH
+const (
+	mergePatchType = "application/merge-patch+json" // RFC 7396
+	jsonPatchType  = "application/json-patch+json"  // RFC 6902
+)
+
+// acceptPatch значение заголовка Accept-Patch (RFC 5789).
+const acceptPatch = mergePatchType + ", " + jsonPatchType
+
+// patcher применяет патч к JSON-представлению объекта.
+type patcher func(doc []byte) ([]byte, error)
+
+// readPatch читает тело запроса PATCH и разбирает патч
+// в формате, указанном в Content-Type.
+func readPatch(w http.ResponseWriter, r *http.Request) (patcher, error) {
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mt != mergePatchType && mt != jsonPatchType {
+		return nil, &Error{Kind: KindUnsupportedMedia,
+			Detail: "Content-Type must be one of " + acceptPatch}
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		return nil, decodeError(err)
+	}
+
+	if mt == mergePatchType {
+		if !json.Valid(body) {
+			return nil, validationError("merge patch must be a JSON value")
+		}
+		return func(doc []byte) ([]byte, error) {
+			return jsonpatch.MergePatch(doc, body)
+		}, nil
+	}
+
+	patch, err := jsonpatch.DecodePatch(body)
+	if err != nil {
+		return nil, validationError("JSON patch must be an array of operations")
+	}
+	return patch.Apply, nil
+}
+
+// patchItem возвращает функцию изменения объекта патчем.
+// Результат патча разбирается так же строго, как тело PUT,
+// id и версию патчем менять нельзя.
+func patchItem(apply patcher) domain.ModifyFunc {
+	return func(cur item) (item, error) {
+		doc, err := json.Marshal(cur)
+		if err != nil {
+			return item{}, err
+		}
+
+		patched, err := apply(doc)
+		if errors.Is(err, jsonpatch.ErrTestFailed) {
+			return item{}, &Error{Kind: KindConflict, Detail: "patch test operation failed", Err: err}
+		}
+		if err != nil {
+			return item{}, validationError("patch cannot be applied: " + err.Error())
+		}
+
+		var next item
+		dec := json.NewDecoder(bytes.NewReader(patched))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&next); err != nil {
+			return item{}, decodeError(err)
+		}
+
+		switch {
+		case next.ID != cur.ID:
+			return item{}, fieldError("id", "is read-only")
+		case next.Version != cur.Version:
+			return item{}, fieldError("version", "is read-only, use If-Match")
+		}
+		return next, next.Validate()
+	}
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIPatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		ifMatch     string
+		body        string
+		wantStatus  int
+		want        item
+	}{
+		{
+			name:        "mergePatch",
+			contentType: mergePatchType,
+			body:        `{"name": "merged"}`,
+			wantStatus:  http.StatusOK,
+			want:        item{ID: 1, Name: "merged", Version: 2},
+		},
+		{
+			name:        "mergePatchCharset",
+			contentType: mergePatchType + "; charset=utf-8",
+			ifMatch:     `"1"`,
+			body:        `{"name": "merged"}`,
+			wantStatus:  http.StatusOK,
+			want:        item{ID: 1, Name: "merged", Version: 2},
+		},
+		{
+			name:        "jsonPatch",
+			contentType: jsonPatchType,
+			body:        `[{"op": "test", "path": "/name", "value": "test one"}, {"op": "replace", "path": "/name", "value": "patched"}]`,
+			wantStatus:  http.StatusOK,
+			want:        item{ID: 1, Name: "patched", Version: 2},
+		},
+		{
+			name:        "jsonPatchTestFailed",
+			contentType: jsonPatchType,
+			body:        `[{"op": "test", "path": "/name", "value": "other"}]`,
+			wantStatus:  http.StatusConflict,
+		},
+		{
+			name:        "staleIfMatch",
+			contentType: mergePatchType,
+			ifMatch:     `"7"`,
+			body:        `{"name": "late"}`,
+			wantStatus:  http.StatusPreconditionFailed,
+		},
+		{
+			name:        "removeName",
+			contentType: mergePatchType,
+			body:        `{"name": null}`,
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:        "readOnlyID",
+			contentType: mergePatchType,
+			body:        `{"id": 5}`,
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:        "unknownField",
+			contentType: jsonPatchType,
+			body:        `[{"op": "add", "path": "/color", "value": "red"}]`,
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:        "unsupportedMediaType",
+			contentType: "application/json",
+			body:        `{"name": "plain"}`,
+			wantStatus:  http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newTestAPI()
+
+			req := httptest.NewRequest(http.MethodPatch, "/items/1", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			if tt.ifMatch != "" {
+				req.Header.Set("If-Match", tt.ifMatch)
+			}
+			rr := httptest.NewRecorder()
+
+			api.router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("itemsHandlerPatch() resp code = %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var got item
+			if err := json.NewDecoder(rr.Body).Decode(&got); err != nil {
+				t.Fatalf("itemsHandlerPatch() = err %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("itemsHandlerPatch() = %v, want %v", got, tt.want)
+			}
+			if rr.Header().Get("ETag") != etag(tt.want.Version) {
+				t.Errorf("itemsHandlerPatch() ETag = %s, want %s", rr.Header().Get("ETag"), etag(tt.want.Version))
+			}
+		})
+	}
+}
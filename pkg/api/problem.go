@@ -0,0 +1,223 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/rtemka/rbtest/domain"
+	"github.com/rtemka/rbtest/pkg/auth"
+	"github.com/rtemka/rbtest/pkg/logging"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ProblemContentType тип содержимого ответа с ошибкой (RFC 7807).
+const ProblemContentType = "application/problem+json"
+
+// Problem описание ошибки в формате RFC 7807.
+type Problem struct {
+	Type     string `json:"type"`               // тип ошибки, ссылка относительно корня API
+	Title    string `json:"title"`              // краткое описание типа ошибки
+	Status   int    `json:"status"`             // HTTP-статус ответа
+	Detail   string `json:"detail,omitempty"`   // описание конкретной ошибки
+	Instance string `json:"instance,omitempty"` // путь запроса, вызвавшего ошибку
+	// CorrelationID связывает ответ с записью в логе сервера.
+	CorrelationID string       `json:"correlation_id,omitempty"`
+	Errors        []FieldError `json:"errors,omitempty"` // ошибки в отдельных полях
+}
+
+// FieldError ошибка в значении отдельного поля тела,
+// параметра или заголовка запроса.
+type FieldError = domain.FieldError
+
+// Kind тип ошибки API, по нему выбирается HTTP-статус.
+type Kind int
+
+const (
+	KindInternal         Kind = iota // непредвиденная ошибка сервера
+	KindValidation                   // некорректный запрос
+	KindTooLarge                     // слишком большое тело запроса
+	KindUnsupportedMedia             // неподдерживаемый Content-Type
+	KindNotAcceptable                // нет формата ответа из Accept
+	KindNotFound                     // объект не найден
+	KindConflict                     // конфликт версий объекта
+	KindPrecondition                 // не выполнено условие If-Match
+	KindUnavailable                  // хранилище временно недоступно
+	KindTimeout                      // хранилище не ответило вовремя
+	KindAborted                      // операция атомарного пакета отменена
+	KindUnauthorized                 // клиент не прошел проверку подлинности
+)
+
+// kindInfo HTTP-семантика типа ошибки.
+type kindInfo struct {
+	status int
+	slug   string
+	title  string
+}
+
+var kinds = map[Kind]kindInfo{
+	KindInternal:         {http.StatusInternalServerError, "internal", "Internal server error"},
+	KindValidation:       {http.StatusBadRequest, "validation", "Invalid request"},
+	KindTooLarge:         {http.StatusRequestEntityTooLarge, "too-large", "Request body too large"},
+	KindUnsupportedMedia: {http.StatusUnsupportedMediaType, "unsupported-media-type", "Unsupported media type"},
+	KindNotAcceptable:    {http.StatusNotAcceptable, "not-acceptable", "Not acceptable"},
+	KindNotFound:         {http.StatusNotFound, "not-found", "Item not found"},
+	KindConflict:         {http.StatusConflict, "conflict", "Item version conflict"},
+	KindPrecondition:     {http.StatusPreconditionFailed, "precondition-failed", "Precondition failed"},
+	KindUnavailable:      {http.StatusServiceUnavailable, "unavailable", "Service unavailable"},
+	KindTimeout:          {http.StatusGatewayTimeout, "timeout", "Storage timeout"},
+	KindAborted:          {http.StatusFailedDependency, "aborted", "Batch aborted"},
+	KindUnauthorized:     {http.StatusUnauthorized, "unauthorized", "Authentication required"},
+}
+
+// Error ошибка API. Detail и Fields отправляются клиенту,
+// Err остается на сервере и попадает только в лог.
+type Error struct {
+	Kind   Kind
+	Detail string
+	Fields []FieldError
+	Err    error
+}
+
+func (e *Error) Error() string {
+	if e.Detail != "" {
+		return e.Detail
+	}
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return kinds[e.Kind].title
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// validationError возвращает ошибку некорректного запроса
+// с ошибками в отдельных полях.
+func validationError(detail string, fields ...FieldError) *Error {
+	return &Error{Kind: KindValidation, Detail: detail, Fields: fields, Err: ErrBadInput}
+}
+
+// fieldError возвращает ошибку некорректного значения одного поля.
+func fieldError(field, format string, args ...any) *Error {
+	msg := fmt.Sprintf(format, args...)
+	return validationError(fmt.Sprintf("invalid '%s': %s", field, msg),
+		FieldError{Field: field, Message: msg})
+}
+
+// asError приводит любую ошибку к *Error. Ошибки хранилища
+// превращаются в типы по sentinel-ошибкам domain и context,
+// все остальные считаются внутренними ошибками сервера.
+func asError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	var verr *domain.ValidationError
+	if errors.As(err, &verr) {
+		return validationError(verr.Error(), verr.Fields...)
+	}
+
+	e = &Error{Kind: KindInternal, Err: err}
+	switch {
+	case errors.Is(err, ErrBadInput), errors.Is(err, domain.ErrInvalid), errors.Is(err, domain.ErrUnknownOp):
+		e.Kind, e.Detail = KindValidation, err.Error()
+	case errors.Is(err, domain.ErrNotFound):
+		e.Kind, e.Detail = KindNotFound, domain.ErrNotFound.Error()
+	case errors.Is(err, domain.ErrConflict):
+		e.Kind, e.Detail = KindConflict, domain.ErrConflict.Error()
+	case errors.Is(err, domain.ErrAborted):
+		e.Kind, e.Detail = KindAborted, "operation was not applied because another operation in the batch failed"
+	case errors.Is(err, auth.ErrUnauthenticated):
+		e.Kind, e.Detail = KindUnauthorized, err.Error()
+	case errors.Is(err, ErrPrecondition):
+		e.Kind, e.Detail = KindPrecondition, ErrPrecondition.Error()
+	case errors.Is(err, context.DeadlineExceeded):
+		e.Kind, e.Detail = KindTimeout, "storage did not respond in time"
+	case errors.Is(err, domain.ErrUnavailable), errors.Is(err, context.Canceled):
+		e.Kind, e.Detail = KindUnavailable, "storage is temporarily unavailable"
+	}
+	return e
+}
+
+// problem формирует ответ RFC 7807 для ошибки.
+func (e *Error) problem() Problem {
+	info := kinds[e.Kind]
+	p := Problem{
+		Type:   "/problems/" + info.slug,
+		Title:  info.title,
+		Status: info.status,
+		Detail: e.Detail,
+		Errors: e.Fields,
+	}
+	if e.Kind == KindInternal {
+		p.Detail = ErrInternal.Error() // подробности только в логе
+	}
+	return p
+}
+
+// writeError отправляет клиенту ошибку в формате
+// application/problem+json. Ошибки сервера (5xx) логируются.
+// correlation id совпадает с id запроса, по которому ответ
+// находится в журнале.
+func (api *API) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	e := asError(err)
+	p := e.problem()
+	p.Instance = r.URL.Path
+	if p.CorrelationID = logging.RequestID(r.Context()); p.CorrelationID == "" {
+		p.CorrelationID = randomID()
+	}
+
+	if p.Status >= http.StatusInternalServerError {
+		api.logger.ErrorContext(r.Context(), "request failed",
+			"method", r.Method, "path", r.URL.Path, "status", p.Status, "err", e.Err)
+		if e.Err != nil {
+			trace.SpanFromContext(r.Context()).RecordError(e.Err)
+		}
+	}
+
+	writeProblem(w, p)
+}
+
+// WriteJSONError отправляет клиенту ошибку err со статусом code
+// в формате application/problem+json.
+//
+// Deprecated: статус ответа должен следовать из типа ошибки,
+// обработчики пакета используют writeError.
+func (api *API) WriteJSONError(w http.ResponseWriter, err error, code int) {
+	p := asError(err).problem()
+	if p.Status != code {
+		p = Problem{Type: "about:blank", Title: http.StatusText(code), Status: code, Detail: err.Error()}
+		if code >= http.StatusInternalServerError {
+			p.Detail = ErrInternal.Error()
+		}
+	}
+	writeProblem(w, p)
+}
+
+// writeProblem записывает ответ RFC 7807.
+func writeProblem(w http.ResponseWriter, p Problem) {
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(p.Status)
+	_ = json.NewEncoder(w).Encode(&p)
+}
+
+// writeConditionalError отправляет клиенту ошибку изменения
+// объекта. Если изменение было условным (If-Match), то конфликт
+// версий означает несработавшее предусловие, то есть 412.
+func (api *API) writeConditionalError(w http.ResponseWriter, r *http.Request, err error, conditional bool) {
+	if conditional && errors.Is(err, domain.ErrConflict) {
+		err = ErrPrecondition
+	}
+	api.writeError(w, r, err)
+}
+
+// randomID возвращает случайный идентификатор запроса.
+func randomID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rtemka/rbtest/domain"
+	"github.com/rtemka/rbtest/pkg/logging"
+	"github.com/rtemka/rbtest/pkg/repo/memdb"
+)
+
+func TestAsError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{fieldError("id", "is required"), http.StatusBadRequest},
+		{fmt.Errorf("%w: bad input", ErrBadInput), http.StatusBadRequest},
+		{domain.ErrNotFound, http.StatusNotFound},
+		{fmt.Errorf("wrapped: %w", domain.ErrConflict), http.StatusConflict},
+		{ErrPrecondition, http.StatusPreconditionFailed},
+		{fmt.Errorf("find: %w", domain.ErrUnavailable), http.StatusServiceUnavailable},
+		{context.Canceled, http.StatusServiceUnavailable},
+		{fmt.Errorf("find: %w", context.DeadlineExceeded), http.StatusGatewayTimeout},
+		{errors.New("disk is on fire"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		if got := asError(tt.err).problem().Status; got != tt.want {
+			t.Errorf("asError(%v) status = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestWriteJSONError(t *testing.T) {
+	api := newTestAPI()
+	tests := []struct {
+		err       error
+		code      int
+		wantType  string
+		wantTitle string
+	}{
+		{domain.ErrNotFound, http.StatusNotFound, "/problems/not-found", "Item not found"},
+		{errors.New("teapot"), http.StatusTeapot, "about:blank", http.StatusText(http.StatusTeapot)},
+	}
+
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		api.WriteJSONError(rr, tt.err, tt.code)
+
+		var p Problem
+		if err := json.NewDecoder(rr.Body).Decode(&p); err != nil {
+			t.Fatalf("decode problem = err %v", err)
+		}
+		if rr.Code != tt.code || p.Status != tt.code || p.Type != tt.wantType || p.Title != tt.wantTitle {
+			t.Errorf("WriteJSONError(%v, %d) = %d %+v, want type %q", tt.err, tt.code, rr.Code, p, tt.wantType)
+		}
+	}
+}
+
+// failingRepo возвращает err из всех методов чтения объекта.
+type failingRepo struct {
+	domain.Repository
+	err error
+}
+
+func (r failingRepo) Item(context.Context, int64) (item, error) {
+	return item{}, r.err
+}
+
+// problemOf выполняет запрос и разбирает ответ с ошибкой.
+func problemOf(t *testing.T, api *API, r *http.Request) Problem {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	api.Router().ServeHTTP(rr, r)
+
+	if ct := rr.Header().Get("Content-Type"); ct != ProblemContentType {
+		t.Errorf("Content-Type = %q, want %q", ct, ProblemContentType)
+	}
+	var p Problem
+	if err := json.NewDecoder(rr.Body).Decode(&p); err != nil {
+		t.Fatalf("decode problem = err %v", err)
+	}
+	if p.Status != rr.Code {
+		t.Errorf("problem status = %d, response status = %d", p.Status, rr.Code)
+	}
+	return p
+}
+
+func TestAPIProblem(t *testing.T) {
+	t.Run("Validation", func(t *testing.T) {
+		p := problemOf(t, newTestAPI(), httptest.NewRequest(http.MethodGet, "/items?limit=0", nil))
+
+		if p.Status != http.StatusBadRequest || p.Type != "/problems/validation" {
+			t.Errorf("problem = %+v, want validation 400", p)
+		}
+		if p.Instance != "/items" {
+			t.Errorf("instance = %q, want %q", p.Instance, "/items")
+		}
+		if len(p.Errors) != 1 || p.Errors[0].Field != "limit" {
+			t.Errorf("errors = %+v, want one error for 'limit'", p.Errors)
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		p := problemOf(t, newTestAPI(), httptest.NewRequest(http.MethodGet, "/items/42", nil))
+
+		if p.Status != http.StatusNotFound || p.Type != "/problems/not-found" {
+			t.Errorf("problem = %+v, want not-found 404", p)
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		repo := failingRepo{Repository: memdb.New(), err: context.DeadlineExceeded}
+		api := New(repo, logging.Discard(), time.Minute)
+
+		p := problemOf(t, api, httptest.NewRequest(http.MethodGet, "/items/1", nil))
+
+		if p.Status != http.StatusGatewayTimeout {
+			t.Errorf("status = %d, want %d", p.Status, http.StatusGatewayTimeout)
+		}
+		if p.CorrelationID == "" {
+			t.Error("correlation_id is empty")
+		}
+	})
+
+	t.Run("InternalHidden", func(t *testing.T) {
+		repo := failingRepo{Repository: memdb.New(), err: errors.New("secret dsn")}
+		api := New(repo, logging.Discard(), time.Minute)
+
+		p := problemOf(t, api, httptest.NewRequest(http.MethodGet, "/items/1", nil))
+
+		if p.Status != http.StatusInternalServerError || p.Detail != ErrInternal.Error() {
+			t.Errorf("problem = %+v, want internal error without details", p)
+		}
+	})
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rtemka/rbtest/pkg/cache"
+	"github.com/rtemka/rbtest/pkg/logging"
+	"github.com/rtemka/rbtest/pkg/repo/memdb"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// spans собирает спаны тестов. Трассировка настраивается
+// один раз: трассировщики пакета привязываются к первой
+// установленной глобальной трассировке.
+var spans = func() *tracetest.SpanRecorder {
+	r := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(r)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return r
+}()
+
+func TestAPITracing(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var buf bytes.Buffer
+	logger := logging.New(&buf, slog.LevelInfo)
+	api := New(cache.New(ctx, memdb.New(testItems...), logging.Discard(), time.Minute), logger, time.Minute)
+
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	tests := []struct {
+		path        string
+		traceparent string
+		wantStatus  int
+		wantHit     bool
+	}{
+		{path: "/items/1", traceparent: "00-" + traceID + "-" + spanID + "-01", wantStatus: http.StatusOK, wantHit: true},
+		{path: "/items/42", wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		buf.Reset()
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.traceparent != "" {
+			req.Header.Set("traceparent", tt.traceparent)
+		}
+		rr := httptest.NewRecorder()
+		api.router.ServeHTTP(rr, req)
+
+		// кэш обновляется в фоне, поэтому спаны ищутся по связям
+		ended := spans.Ended()
+		server := ended[len(ended)-1]
+		for _, s := range ended {
+			if s.Name() == "GET /items/{id}" {
+				server = s
+			}
+		}
+		if got, want := server.Name(), "GET /items/{id}"; got != want {
+			t.Fatalf("%s span name = %q, want %q", tt.path, got, want)
+		}
+		var child sdktrace.ReadOnlySpan = server
+		for _, s := range ended {
+			if s.Parent().SpanID() == server.SpanContext().SpanID() {
+				child = s
+			}
+		}
+		if tt.traceparent != "" {
+			if got := server.Parent(); got.TraceID().String() != traceID || got.SpanID().String() != spanID || !got.IsRemote() {
+				t.Errorf("%s span parent = %s/%s, want remote %s/%s", tt.path, got.TraceID(), got.SpanID(), traceID, spanID)
+			}
+		} else if server.Parent().IsValid() {
+			t.Errorf("%s span parent = %s, want none", tt.path, server.Parent().TraceID())
+		}
+		if !hasAttr(server.Attributes(), attribute.Int("http.response.status_code", tt.wantStatus)) ||
+			!hasAttr(server.Attributes(), attribute.String(logging.RequestIDKey, rr.Header().Get(RequestIDHeader))) {
+			t.Errorf("%s span attributes = %v, want status %d and request id", tt.path, server.Attributes(), tt.wantStatus)
+		}
+
+		if child.Name() != "cache.Item" || !hasAttr(child.Attributes(), attribute.Bool("cache.hit", tt.wantHit)) {
+			t.Errorf("%s child span = %s %v, want cache.Item with cache.hit=%t", tt.path, child.Name(), child.Attributes(), tt.wantHit)
+		}
+
+		var rec struct {
+			TraceID string `json:"trace_id"`
+		}
+		if err := json.Unmarshal(buf.Bytes(), &rec); err != nil || rec.TraceID != server.SpanContext().TraceID().String() {
+			t.Errorf("%s log record trace_id = %q, err %v, want %s", tt.path, rec.TraceID, err, server.SpanContext().TraceID())
+		}
+	}
+}
+
+// hasAttr сообщает, есть ли среди attrs атрибут want.
+func hasAttr(attrs []attribute.KeyValue, want attribute.KeyValue) bool {
+	for _, a := range attrs {
+		if a == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,307 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rtemka/rbtest/domain"
+	"github.com/rtemka/rbtest/pkg/events"
+)
+
+// ограничения и интервалы соединения WebSocket
+const (
+	wsSendBuffer   = 256 // сообщений в очереди на отправку
+	wsMaxMessage   = 64 << 10
+	wsMaxIDs       = 1000 // подписок на id на одно соединение
+	wsMaxPatterns  = 100  // подписок на шаблоны имен
+	wsWriteTimeout = 10 * time.Second
+	wsPongTimeout  = 60 * time.Second
+	wsPingInterval = wsPongTimeout * 9 / 10
+)
+
+// типы сообщений протокола /ws
+const (
+	wsSubscribe   = "subscribe"   // клиент: подписаться на ids и names
+	wsUnsubscribe = "unsubscribe" // клиент: отписаться от ids и names
+	wsPing        = "ping"        // клиент: проверка связи
+	wsPong        = "pong"        // сервер: ответ на ping
+	wsSubscribed  = "subscribed"  // сервер: текущие подписки после изменения
+	wsEvent       = "event"       // сервер: изменение объекта
+	wsReset       = "reset"       // сервер: события пропущены, список нужно перечитать
+	wsError       = "error"       // сервер: ошибка в сообщении клиента
+)
+
+// wsRequest сообщение клиента.
+type wsRequest struct {
+	Type  string   `json:"type"`
+	IDs   []int64  `json:"ids,omitempty"`
+	Names []string `json:"names,omitempty"` // шаблоны имен в синтаксисе path.Match
+}
+
+// wsMessage сообщение сервера.
+type wsMessage struct {
+	Type    string          `json:"type"`
+	EventID uint64          `json:"event_id,omitempty"`
+	Op      domain.ChangeOp `json:"op,omitempty"`
+	Item    *item           `json:"item,omitempty"`
+	IDs     []int64         `json:"ids,omitempty"`
+	Names   []string        `json:"names,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// wsUpgrader проверяет Origin по умолчанию: соединение
+// разрешено только со страниц того же хоста.
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4 << 10,
+	WriteBufferSize: 4 << 10,
+}
+
+// wsFilter подписки соединения.
+type wsFilter struct {
+	mu    sync.Mutex
+	ids   map[int64]bool
+	names map[string]bool
+}
+
+// match сообщает, подписано ли соединение на объект.
+// Изменение объекта проверяется по его новому имени.
+func (f *wsFilter) match(it item) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.ids[it.ID] {
+		return true
+	}
+	for pattern := range f.names {
+		if ok, _ := path.Match(pattern, it.Name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// update применяет подписку или отписку и возвращает
+// подписки после изменения.
+func (f *wsFilter) update(req wsRequest) (wsMessage, error) {
+	for _, id := range req.IDs {
+		if err := domain.ValidateID(id); err != nil {
+			return wsMessage{}, fmt.Errorf("id %d must be positive", id)
+		}
+	}
+	for _, pattern := range req.Names {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return wsMessage{}, fmt.Errorf("name pattern %q is malformed", pattern)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.ids == nil {
+		f.ids, f.names = make(map[int64]bool), make(map[string]bool)
+	}
+	if req.Type == wsSubscribe {
+		if len(f.ids)+len(req.IDs) > wsMaxIDs || len(f.names)+len(req.Names) > wsMaxPatterns {
+			return wsMessage{}, fmt.Errorf("at most %d ids and %d name patterns are allowed", wsMaxIDs, wsMaxPatterns)
+		}
+	}
+	for _, id := range req.IDs {
+		if req.Type == wsSubscribe {
+			f.ids[id] = true
+		} else {
+			delete(f.ids, id)
+		}
+	}
+	for _, pattern := range req.Names {
+		if req.Type == wsSubscribe {
+			f.names[pattern] = true
+		} else {
+			delete(f.names, pattern)
+		}
+	}
+
+	msg := wsMessage{Type: wsSubscribed}
+	for id := range f.ids {
+		msg.IDs = append(msg.IDs, id)
+	}
+	for pattern := range f.names {
+		msg.Names = append(msg.Names, pattern)
+	}
+	sort.Slice(msg.IDs, func(i, j int) bool { return msg.IDs[i] < msg.IDs[j] })
+	sort.Strings(msg.Names)
+	return msg, nil
+}
+
+// wsConn соединение WebSocket. Писать в сокет может только
+// writeLoop, остальные горутины ставят сообщения в очередь send.
+type wsConn struct {
+	conn   *websocket.Conn
+	send   chan wsMessage
+	filter wsFilter
+	cancel context.CancelFunc
+
+	once  sync.Once
+	close []byte // кадр закрытия, заданный причиной остановки
+}
+
+// stop останавливает соединение. Первая причина побеждает,
+// nil означает, что кадр закрытия отправлять не нужно.
+func (c *wsConn) stop(code int, text string) {
+	c.once.Do(func() {
+		if code != 0 {
+			c.close = websocket.FormatCloseMessage(code, text)
+		}
+		c.cancel()
+	})
+}
+
+// enqueue ставит сообщение в очередь. Если очередь полна,
+// клиент не успевает читать, и соединение закрывается.
+func (c *wsConn) enqueue(msg wsMessage) bool {
+	select {
+	case c.send <- msg:
+		return true
+	default:
+		c.stop(websocket.ClosePolicyViolation, "slow consumer")
+		return false
+	}
+}
+
+// readLoop читает сообщения клиента, пока соединение открыто.
+func (c *wsConn) readLoop() {
+	c.conn.SetReadLimit(wsMaxMessage)
+	_ = c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if errors.Is(err, websocket.ErrReadLimit) {
+				c.stop(websocket.CloseMessageTooBig, "message is too large")
+			}
+			c.stop(0, "") // клиент ушел или соединение оборвалось
+			return
+		}
+
+		var req wsRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			if !c.enqueue(wsMessage{Type: wsError, Error: "message must be a JSON object"}) {
+				return
+			}
+			continue
+		}
+
+		var msg wsMessage
+		switch req.Type {
+		case wsSubscribe, wsUnsubscribe:
+			if msg, err = c.filter.update(req); err != nil {
+				msg = wsMessage{Type: wsError, Error: err.Error()}
+			}
+		case wsPing:
+			msg = wsMessage{Type: wsPong}
+		default:
+			msg = wsMessage{Type: wsError, Error: fmt.Sprintf("unknown message type %q", req.Type)}
+		}
+		if !c.enqueue(msg) {
+			return
+		}
+	}
+}
+
+// pump переносит подходящие под подписки события из рассылки
+// в очередь соединения.
+func (c *wsConn) pump(ctx context.Context, feed *events.Feed, notify <-chan struct{}, after uint64) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, open := <-notify:
+			if !open {
+				c.stop(websocket.CloseGoingAway, "server is shutting down")
+				return
+			}
+		}
+
+		evs, last, ok := feed.Since(after)
+		after = last
+		if !ok && !c.enqueue(wsMessage{Type: wsReset, EventID: last}) {
+			return
+		}
+		for _, ev := range evs {
+			if !c.filter.match(ev.Change.Item) {
+				continue
+			}
+			it := ev.Change.Item
+			msg := wsMessage{Type: wsEvent, EventID: ev.ID, Op: ev.Change.Op, Item: &it}
+			if !c.enqueue(msg) {
+				return
+			}
+		}
+	}
+}
+
+// writeLoop отправляет сообщения из очереди и пинги,
+// пока соединение не остановлено, затем закрывает его.
+func (c *wsConn) writeLoop(ctx context.Context) {
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	defer c.conn.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// без другой причины остановки отменен контекст
+			// запроса, то есть приложение завершается
+			c.stop(websocket.CloseGoingAway, "server is shutting down")
+			if c.close != nil {
+				_ = c.conn.WriteControl(websocket.CloseMessage, c.close, time.Now().Add(wsWriteTimeout))
+			}
+			return
+		case msg := <-c.send:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := c.conn.WriteJSON(msg); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// wsHandler принимает соединения WebSocket. Клиент подписывается
+// на изменения объектов по id или шаблону имени и получает их
+// сообщениями event. Соединение закрывается, если клиент не
+// успевает читать, не отвечает на пинги или контекст запроса
+// (контекст приложения у сервера) отменен.
+func (api *API) wsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return // Upgrade уже ответил клиенту
+		}
+
+		ctx, cancel := context.WithCancel(r.Context())
+		c := &wsConn{conn: conn, send: make(chan wsMessage, wsSendBuffer), cancel: cancel}
+		defer c.stop(0, "")
+
+		notify, unsubscribe := api.events.Subscribe()
+		defer unsubscribe()
+		_, after, _ := api.events.Since(0)
+
+		go c.readLoop()
+		go c.pump(ctx, api.events, notify, after)
+		c.writeLoop(ctx)
+	}
+}
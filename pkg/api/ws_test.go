@@ -0,0 +1,132 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rtemka/rbtest/domain"
+	"github.com/rtemka/rbtest/pkg/events"
+	"github.com/rtemka/rbtest/pkg/logging"
+	"github.com/rtemka/rbtest/pkg/repo/memdb"
+)
+
+func TestWSFilter(t *testing.T) {
+	var f wsFilter
+
+	tests := []struct {
+		req     wsRequest
+		wantErr bool
+		match   map[string]bool // имя объекта с id 1 -> ожидаемый match
+	}{
+		{
+			req:   wsRequest{Type: wsSubscribe, Names: []string{"user-*"}},
+			match: map[string]bool{"user-1": true, "admin": false},
+		},
+		{
+			req:   wsRequest{Type: wsSubscribe, IDs: []int64{1}},
+			match: map[string]bool{"admin": true},
+		},
+		{
+			req:   wsRequest{Type: wsUnsubscribe, IDs: []int64{1}, Names: []string{"user-*"}},
+			match: map[string]bool{"user-1": false, "admin": false},
+		},
+		{req: wsRequest{Type: wsSubscribe, Names: []string{"[a-"}}, wantErr: true},
+		{req: wsRequest{Type: wsSubscribe, IDs: []int64{-1}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		_, err := f.update(tt.req)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("update(%+v) = err %v, want error %v", tt.req, err, tt.wantErr)
+		}
+		for name, want := range tt.match {
+			if got := f.match(item{ID: 1, Name: name}); got != want {
+				t.Errorf("after %+v match(%q) = %v, want %v", tt.req, name, got, want)
+			}
+		}
+	}
+}
+
+func TestWSSlowConsumer(t *testing.T) {
+	_, cancel := context.WithCancel(context.Background())
+	c := &wsConn{send: make(chan wsMessage, 1), cancel: cancel}
+
+	if !c.enqueue(wsMessage{Type: wsPong}) {
+		t.Fatal("enqueue() = false, want true while buffer has room")
+	}
+	if c.enqueue(wsMessage{Type: wsPong}) {
+		t.Fatal("enqueue() = true, want false when buffer is full")
+	}
+	if c.close == nil {
+		t.Error("slow consumer is not closed")
+	}
+}
+
+func TestAPIWebSocket(t *testing.T) {
+	appCtx, stopApp := context.WithCancel(context.Background())
+	defer stopApp()
+
+	feed := events.New(16)
+	api := New(memdb.New(), logging.Discard(), time.Minute, WithEvents(feed))
+	srv := httptest.NewUnstartedServer(api.Router())
+	srv.Config.BaseContext = func(net.Listener) context.Context { return appCtx }
+	srv.Start()
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Dial() = err %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	exchange := func(req wsRequest, want wsMessage) {
+		t.Helper()
+		if err := conn.WriteJSON(req); err != nil {
+			t.Fatalf("WriteJSON() = err %v", err)
+		}
+		var got wsMessage
+		if err := conn.ReadJSON(&got); err != nil {
+			t.Fatalf("ReadJSON() = err %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("reply to %+v = %+v, want %+v", req, got, want)
+		}
+	}
+
+	exchange(wsRequest{Type: wsPing}, wsMessage{Type: wsPong})
+	exchange(wsRequest{Type: "hello"}, wsMessage{Type: wsError, Error: `unknown message type "hello"`})
+	exchange(wsRequest{Type: wsSubscribe, IDs: []int64{2}, Names: []string{"a*"}},
+		wsMessage{Type: wsSubscribed, IDs: []int64{2}, Names: []string{"a*"}})
+
+	feed.Publish([]domain.Change{
+		{Op: domain.ChangeCreated, Item: item{ID: 1, Name: "b", Version: 1}},
+		{Op: domain.ChangeUpdated, Item: item{ID: 2, Name: "b", Version: 2}},
+		{Op: domain.ChangeDeleted, Item: item{ID: 3, Name: "abc", Version: 1}},
+	})
+	for _, want := range []struct {
+		id uint64
+		op domain.ChangeOp
+	}{{2, domain.ChangeUpdated}, {3, domain.ChangeDeleted}} {
+		var got wsMessage
+		if err := conn.ReadJSON(&got); err != nil {
+			t.Fatalf("ReadJSON() = err %v", err)
+		}
+		if got.Type != wsEvent || got.EventID != want.id || got.Op != want.op {
+			t.Errorf("event = %+v, want event %d %s", got, want.id, want.op)
+		}
+	}
+
+	// отмена контекста приложения закрывает соединение
+	stopApp()
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("ReadMessage() after shutdown = err %v, want close %d", err, websocket.CloseGoingAway)
+	}
+}
@@ -0,0 +1,229 @@
+// Пакет auth проверяет подлинность клиентов API: по статическим
+// ключам API, хранящимся в виде хеша, и по токенам JWT,
+// подписанным общим секретом HMAC или ключом из файла JWKS.
+// Проверенный клиент (Principal) передается через контекст.
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Способы проверки подлинности.
+const (
+	MethodAPIKey = "api_key"
+	MethodJWT    = "jwt"
+)
+
+// APIKeyHeader заголовок с ключом API. Ключ также можно
+// передать в заголовке Authorization: ApiKey <ключ>.
+const APIKeyHeader = "X-API-Key"
+
+// Realm область защиты в заголовке WWW-Authenticate.
+const Realm = "rbtest"
+
+// minSecretLen минимальная длина секрета HMAC в байтах.
+const minSecretLen = 32
+
+// leeway допустимое расхождение часов при проверке exp и nbf.
+const leeway = 30 * time.Second
+
+var (
+	// ErrUnauthenticated клиент не прошел проверку подлинности.
+	ErrUnauthenticated = errors.New("authentication failed")
+	// ErrNoCredentials клиент не предъявил ни ключа, ни токена.
+	ErrNoCredentials = fmt.Errorf("%w: credentials are missing", ErrUnauthenticated)
+)
+
+// Principal проверенный клиент.
+type Principal struct {
+	Subject string // имя ключа API или claim sub токена
+	Method  string // MethodAPIKey или MethodJWT
+}
+
+type principalKey struct{}
+
+// WithPrincipal возвращает контекст с клиентом p.
+func WithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext возвращает клиента из контекста. false
+// означает, что запрос не проходил проверку подлинности.
+func FromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// Header источник заголовков запроса, например, http.Header.
+type Header interface {
+	Get(key string) string
+}
+
+// Authenticator проверяет подлинность клиентов.
+// Безопасен для одновременного использования.
+type Authenticator struct {
+	keys     map[string]string // хеш ключа API -> имя ключа
+	secret   []byte            // секрет HMAC, nil - токены HMAC не принимаются
+	jwks     KeySet            // открытые ключи токенов
+	audience string
+	issuer   string
+	parser   *jwt.Parser
+}
+
+// Option настраивает Authenticator.
+type Option func(*Authenticator)
+
+// WithAPIKeys принимает ключи API из keys.
+func WithAPIKeys(keys []APIKey) Option {
+	return func(a *Authenticator) {
+		for _, k := range keys {
+			a.keys[strings.ToLower(k.SHA256)] = k.Name
+		}
+	}
+}
+
+// WithHMAC принимает токены, подписанные секретом
+// (HS256, HS384, HS512).
+func WithHMAC(secret []byte) Option {
+	return func(a *Authenticator) { a.secret = secret }
+}
+
+// WithJWKS принимает токены, подписанные закрытыми
+// ключами для открытых ключей из keys.
+func WithJWKS(keys KeySet) Option {
+	return func(a *Authenticator) { a.jwks = keys }
+}
+
+// WithAudience задает обязательное значение claim aud токена.
+func WithAudience(aud string) Option {
+	return func(a *Authenticator) { a.audience = aud }
+}
+
+// WithIssuer задает обязательное значение claim iss токена.
+func WithIssuer(iss string) Option {
+	return func(a *Authenticator) { a.issuer = iss }
+}
+
+// New возвращает Authenticator. Нужен хотя бы один способ
+// проверки, а для токенов - еще и audience.
+func New(opts ...Option) (*Authenticator, error) {
+	a := Authenticator{keys: make(map[string]string)}
+	for _, opt := range opts {
+		opt(&a)
+	}
+
+	var methods []string
+	if a.secret != nil {
+		if len(a.secret) < minSecretLen {
+			return nil, fmt.Errorf("auth: HMAC secret must be at least %d bytes", minSecretLen)
+		}
+		methods = append(methods, "HS256", "HS384", "HS512")
+	}
+	if len(a.jwks.keys) > 0 {
+		methods = append(methods, a.jwks.algs()...)
+	}
+
+	switch {
+	case len(a.keys) == 0 && len(methods) == 0:
+		return nil, errors.New("auth: no API keys, HMAC secret or JWKS configured")
+	case len(methods) > 0 && a.audience == "":
+		return nil, errors.New("auth: token audience must be set")
+	}
+
+	popts := []jwt.ParserOption{
+		jwt.WithValidMethods(methods),
+		jwt.WithExpirationRequired(),
+		jwt.WithAudience(a.audience),
+		jwt.WithLeeway(leeway),
+	}
+	if a.issuer != "" {
+		popts = append(popts, jwt.WithIssuer(a.issuer))
+	}
+	a.parser = jwt.NewParser(popts...)
+
+	return &a, nil
+}
+
+// Authenticate проверяет ключ API из заголовка X-API-Key
+// или Authorization: ApiKey, либо токен из заголовка
+// Authorization: Bearer. Ошибки оборачивают ErrUnauthenticated.
+func (a *Authenticator) Authenticate(h Header) (Principal, error) {
+	if key := h.Get(APIKeyHeader); key != "" {
+		return a.apiKey(key)
+	}
+
+	authz := h.Get("Authorization")
+	if authz == "" {
+		return Principal{}, ErrNoCredentials
+	}
+	scheme, cred, _ := strings.Cut(authz, " ")
+	cred = strings.TrimSpace(cred)
+	switch {
+	case cred == "":
+		return Principal{}, fmt.Errorf("%w: malformed Authorization header", ErrUnauthenticated)
+	case strings.EqualFold(scheme, "ApiKey"):
+		return a.apiKey(cred)
+	case strings.EqualFold(scheme, "Bearer"):
+		return a.token(cred)
+	}
+	return Principal{}, fmt.Errorf("%w: unsupported authorization scheme %q", ErrUnauthenticated, scheme)
+}
+
+// Challenge возвращает значение заголовка WWW-Authenticate
+// для ошибки err из Authenticate.
+func (a *Authenticator) Challenge(err error) string {
+	c := fmt.Sprintf("Bearer realm=%q", Realm)
+	if !errors.Is(err, ErrNoCredentials) {
+		c += `, error="invalid_token"`
+	}
+	return c
+}
+
+// apiKey находит ключ API по его хешу.
+func (a *Authenticator) apiKey(key string) (Principal, error) {
+	if len(a.keys) == 0 {
+		return Principal{}, fmt.Errorf("%w: API keys are not accepted", ErrUnauthenticated)
+	}
+	name, ok := a.keys[HashAPIKey(key)]
+	if !ok {
+		return Principal{}, fmt.Errorf("%w: unknown API key", ErrUnauthenticated)
+	}
+	return Principal{Subject: name, Method: MethodAPIKey}, nil
+}
+
+// token проверяет подпись, срок действия, audience
+// и issuer токена.
+func (a *Authenticator) token(s string) (Principal, error) {
+	if a.secret == nil && len(a.jwks.keys) == 0 {
+		return Principal{}, fmt.Errorf("%w: bearer tokens are not accepted", ErrUnauthenticated)
+	}
+
+	var claims jwt.RegisteredClaims
+	if _, err := a.parser.ParseWithClaims(s, &claims, a.key); err != nil {
+		return Principal{}, fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+	if claims.Subject == "" {
+		return Principal{}, fmt.Errorf("%w: token has no subject", ErrUnauthenticated)
+	}
+	return Principal{Subject: claims.Subject, Method: MethodJWT}, nil
+}
+
+// key выбирает ключ проверки подписи токена: секрет HMAC
+// или открытый ключ JWKS по заголовку kid.
+func (a *Authenticator) key(t *jwt.Token) (any, error) {
+	if _, ok := t.Method.(*jwt.SigningMethodHMAC); ok {
+		if a.secret == nil {
+			// иначе подпись проверялась бы пустым ключом
+			return nil, errors.New("HMAC tokens are not accepted")
+		}
+		return a.secret, nil
+	}
+	kid, _ := t.Header["kid"].(string)
+	return a.jwks.key(kid, t.Method.Alg())
+}
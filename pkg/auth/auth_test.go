@@ -0,0 +1,227 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var secret = []byte("0123456789abcdef0123456789abcdef")
+
+// sign подписывает токен с claims ключом key.
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key any, claims jwt.MapClaims) string {
+	t.Helper()
+	tok := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		tok.Header["kid"] = kid
+	}
+	s, err := tok.SignedString(key)
+	if err != nil {
+		t.Fatalf("SignedString() = err %v", err)
+	}
+	return s
+}
+
+// claims возвращает claims токена для audience "rbtest",
+// истекающего через exp.
+func claims(sub string, exp time.Duration) jwt.MapClaims {
+	return jwt.MapClaims{"sub": sub, "aud": "rbtest", "exp": time.Now().Add(exp).Unix()}
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func TestAuthenticate(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, err := json.Marshal(map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa-1", "alg": "RS256", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "OKP", "kid": "ed-1", "crv": "Ed25519", "x": b64(edPub)},
+		{"kty": "RSA", "kid": "enc-1", "use": "enc", "n": "AQAB", "e": "AQAB"}, // пропускается
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwks, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadJWKS(path)
+	if err != nil {
+		t.Fatalf("LoadJWKS() = err %v", err)
+	}
+
+	a, err := New(
+		WithAPIKeys([]APIKey{{Name: "ci", SHA256: HashAPIKey("ci-key")}}),
+		WithHMAC(secret), WithJWKS(keys), WithAudience("rbtest"))
+	if err != nil {
+		t.Fatalf("New() = err %v", err)
+	}
+	jwksOnly, err := New(WithJWKS(keys), WithAudience("rbtest"), WithIssuer("idp"))
+	if err != nil {
+		t.Fatalf("New() = err %v", err)
+	}
+
+	withIss := claims("carol", time.Hour)
+	withIss["iss"] = "idp"
+	noExp := jwt.MapClaims{"sub": "alice", "aud": "rbtest"}
+	otherAud := claims("alice", time.Hour)
+	otherAud["aud"] = "other"
+
+	tests := []struct {
+		name   string
+		a      *Authenticator
+		header map[string]string
+		want   Principal
+		noCred bool
+		fail   bool
+	}{
+		{name: "api key header", a: a, header: map[string]string{"X-API-Key": "ci-key"},
+			want: Principal{Subject: "ci", Method: MethodAPIKey}},
+		{name: "api key scheme", a: a, header: map[string]string{"Authorization": "ApiKey ci-key"},
+			want: Principal{Subject: "ci", Method: MethodAPIKey}},
+		{name: "unknown api key", a: a, header: map[string]string{"X-API-Key": "guess"}, fail: true},
+		{name: "api keys not configured", a: jwksOnly, header: map[string]string{"X-API-Key": "ci-key"}, fail: true},
+		{name: "no credentials", a: a, noCred: true, fail: true},
+		{name: "unsupported scheme", a: a, header: map[string]string{"Authorization": "Basic Y2k6a2V5"}, fail: true},
+		{name: "empty bearer", a: a, header: map[string]string{"Authorization": "Bearer "}, fail: true},
+
+		{name: "hmac", a: a, header: map[string]string{"Authorization": "Bearer " +
+			sign(t, jwt.SigningMethodHS256, "", secret, claims("alice", time.Hour))},
+			want: Principal{Subject: "alice", Method: MethodJWT}},
+		{name: "hmac other secret", a: a, header: map[string]string{"Authorization": "Bearer " +
+			sign(t, jwt.SigningMethodHS256, "", []byte("fedcba9876543210fedcba9876543210"), claims("alice", time.Hour))},
+			fail: true},
+		{name: "expired", a: a, header: map[string]string{"Authorization": "Bearer " +
+			sign(t, jwt.SigningMethodHS256, "", secret, claims("alice", -time.Hour))}, fail: true},
+		{name: "no expiry", a: a, header: map[string]string{"Authorization": "Bearer " +
+			sign(t, jwt.SigningMethodHS256, "", secret, noExp)}, fail: true},
+		{name: "other audience", a: a, header: map[string]string{"Authorization": "Bearer " +
+			sign(t, jwt.SigningMethodHS256, "", secret, otherAud)}, fail: true},
+		{name: "no subject", a: a, header: map[string]string{"Authorization": "Bearer " +
+			sign(t, jwt.SigningMethodHS256, "", secret, claims("", time.Hour))}, fail: true},
+		{name: "alg none", a: a, header: map[string]string{"Authorization": "Bearer " +
+			sign(t, jwt.SigningMethodNone, "", jwt.UnsafeAllowNoneSignatureType, claims("alice", time.Hour))},
+			fail: true},
+
+		{name: "rsa", a: a, header: map[string]string{"Authorization": "Bearer " +
+			sign(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims("bob", time.Hour))},
+			want: Principal{Subject: "bob", Method: MethodJWT}},
+		{name: "rsa wrong alg for key", a: a, header: map[string]string{"Authorization": "Bearer " +
+			sign(t, jwt.SigningMethodPS256, "rsa-1", rsaKey, claims("bob", time.Hour))}, fail: true},
+		{name: "unknown kid", a: a, header: map[string]string{"Authorization": "Bearer " +
+			sign(t, jwt.SigningMethodRS256, "rsa-2", rsaKey, claims("bob", time.Hour))}, fail: true},
+		{name: "ed25519 with issuer", a: jwksOnly, header: map[string]string{"Authorization": "Bearer " +
+			sign(t, jwt.SigningMethodEdDSA, "ed-1", edKey, withIss)},
+			want: Principal{Subject: "carol", Method: MethodJWT}},
+		{name: "missing issuer", a: jwksOnly, header: map[string]string{"Authorization": "Bearer " +
+			sign(t, jwt.SigningMethodEdDSA, "ed-1", edKey, claims("carol", time.Hour))}, fail: true},
+		{name: "hmac not configured", a: jwksOnly, header: map[string]string{"Authorization": "Bearer " +
+			sign(t, jwt.SigningMethodHS256, "", []byte{}, withIss)}, fail: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for k, v := range tt.header {
+				h.Set(k, v)
+			}
+
+			got, err := tt.a.Authenticate(h)
+			if tt.fail != (err != nil) || err != nil && !errors.Is(err, ErrUnauthenticated) {
+				t.Fatalf("Authenticate() = err %v, want failure %t", err, tt.fail)
+			}
+			if errors.Is(err, ErrNoCredentials) != tt.noCred {
+				t.Errorf("Authenticate() = err %v, want ErrNoCredentials %t", err, tt.noCred)
+			}
+			if got != tt.want {
+				t.Errorf("Authenticate() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	keys := []APIKey{{Name: "ci", SHA256: HashAPIKey("ci-key")}}
+
+	tests := []struct {
+		name    string
+		opts    []Option
+		wantErr bool
+	}{
+		{name: "api keys", opts: []Option{WithAPIKeys(keys)}},
+		{name: "hmac", opts: []Option{WithHMAC(secret), WithAudience("rbtest")}},
+		{name: "nothing", wantErr: true},
+		{name: "short secret", opts: []Option{WithHMAC([]byte("short")), WithAudience("rbtest")}, wantErr: true},
+		{name: "no audience", opts: []Option{WithHMAC(secret)}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		if _, err := New(tt.opts...); (err != nil) != tt.wantErr {
+			t.Errorf("New(%s) = err %v, want error %t", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	tests := []struct {
+		name string
+		jwks string
+	}{
+		{name: "not json", jwks: `keys`},
+		{name: "empty", jwks: `{"keys":[]}`},
+		{name: "unknown kty", jwks: `{"keys":[{"kty":"oct","k":"c2VjcmV0"}]}`},
+		{name: "short rsa", jwks: `{"keys":[{"kty":"RSA","n":"AQAB","e":"AQAB"}]}`},
+		{name: "off curve", jwks: `{"keys":[{"kty":"EC","crv":"P-256","x":"AQ","y":"AQ"}]}`},
+		{name: "bad ed25519", jwks: `{"keys":[{"kty":"OKP","crv":"Ed25519","x":"AQ"}]}`},
+		{name: "duplicate kid", jwks: `{"keys":[` +
+			`{"kty":"OKP","crv":"Ed25519","x":"` + b64(make([]byte, 32)) + `"},` +
+			`{"kty":"OKP","crv":"Ed25519","x":"` + b64(make([]byte, 32)) + `"}]}`},
+	}
+
+	for _, tt := range tests {
+		if _, err := ParseJWKS([]byte(tt.jwks)); err == nil {
+			t.Errorf("ParseJWKS(%s) = nil, want error", tt.name)
+		}
+	}
+}
+
+func TestLoadAPIKeys(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		file    string
+		wantErr bool
+	}{
+		{name: "ok", file: `[{"name":"ci","sha256":"` + HashAPIKey("ci-key") + `"}]`},
+		{name: "no name", file: `[{"sha256":"` + HashAPIKey("ci-key") + `"}]`, wantErr: true},
+		{name: "duplicate", file: `[{"name":"ci","sha256":"` + HashAPIKey("a") + `"},{"name":"ci","sha256":"` + HashAPIKey("b") + `"}]`, wantErr: true},
+		{name: "plain key", file: `[{"name":"ci","sha256":"ci-key"}]`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name+".json")
+		if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadAPIKeys(path); (err != nil) != tt.wantErr {
+			t.Errorf("LoadAPIKeys(%s) = err %v, want error %t", tt.name, err, tt.wantErr)
+		}
+	}
+}
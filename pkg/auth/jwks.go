@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+)
+
+// minRSABits минимальный размер ключа RSA.
+const minRSABits = 2048
+
+// KeySet открытые ключи проверки подписи токенов из JWKS
+// (RFC 7517). Поддерживаются ключи RSA, EC (P-256, P-384,
+// P-521) и OKP (Ed25519).
+type KeySet struct {
+	keys map[string]jwk // по kid, ключ без kid хранится под ""
+}
+
+// jwk открытый ключ и алгоритм, для которого он выпущен.
+type jwk struct {
+	key crypto.PublicKey
+	alg string // пустая строка - любой алгоритм для типа ключа
+}
+
+// rawJWK ключ в формате JWK.
+type rawJWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// LoadJWKS читает набор ключей из JWKS-файла.
+func LoadJWKS(path string) (KeySet, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return KeySet{}, err
+	}
+	ks, err := ParseJWKS(b)
+	if err != nil {
+		return KeySet{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return ks, nil
+}
+
+// ParseJWKS разбирает набор ключей JWKS. Ключи шифрования
+// (use "enc") пропускаются.
+func ParseJWKS(b []byte) (KeySet, error) {
+	var set struct {
+		Keys []rawJWK `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return KeySet{}, fmt.Errorf("auth: jwks: %w", err)
+	}
+
+	ks := KeySet{keys: make(map[string]jwk, len(set.Keys))}
+	for i, raw := range set.Keys {
+		if raw.Use == "enc" {
+			continue
+		}
+		key, err := raw.publicKey()
+		if err != nil {
+			return KeySet{}, fmt.Errorf("auth: jwks: key %d (kid %q): %w", i, raw.Kid, err)
+		}
+		if _, ok := ks.keys[raw.Kid]; ok {
+			return KeySet{}, fmt.Errorf("auth: jwks: duplicate kid %q", raw.Kid)
+		}
+		ks.keys[raw.Kid] = jwk{key: key, alg: raw.Alg}
+	}
+	if len(ks.keys) == 0 {
+		return KeySet{}, errors.New("auth: jwks: no signature keys")
+	}
+	return ks, nil
+}
+
+// key возвращает ключ kid для алгоритма alg.
+func (ks KeySet) key(kid, alg string) (crypto.PublicKey, error) {
+	k, ok := ks.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if k.alg != "" && k.alg != alg {
+		return nil, fmt.Errorf("key %q is for %s, not %s", kid, k.alg, alg)
+	}
+	return k.key, nil
+}
+
+// algs возвращает алгоритмы подписи, которые можно
+// проверить ключами набора. Алгоритм ключа, не подходящий
+// к его типу, не принимается.
+func (ks KeySet) algs() []string {
+	seen := map[string]bool{}
+	for _, k := range ks.keys {
+		var algs []string
+		switch k.key.(type) {
+		case *rsa.PublicKey:
+			algs = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"}
+		case *ecdsa.PublicKey:
+			algs = []string{"ES256", "ES384", "ES512"}
+		case ed25519.PublicKey:
+			algs = []string{"EdDSA"}
+		}
+		for _, alg := range algs {
+			if k.alg == "" || k.alg == alg {
+				seen[alg] = true
+			}
+		}
+	}
+
+	out := make([]string, 0, len(seen))
+	for alg := range seen {
+		out = append(out, alg)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// publicKey строит открытый ключ по параметрам JWK.
+func (raw rawJWK) publicKey() (crypto.PublicKey, error) {
+	switch raw.Kty {
+	case "RSA":
+		n, err := decodeInt(raw.N)
+		if err != nil {
+			return nil, fmt.Errorf("n: %w", err)
+		}
+		e, err := decodeInt(raw.E)
+		if err != nil || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("e: invalid exponent")
+		}
+		if n.BitLen() < minRSABits {
+			return nil, fmt.Errorf("RSA key must be at least %d bits", minRSABits)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch raw.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", raw.Crv)
+		}
+		x, err := decodeInt(raw.X)
+		if err != nil {
+			return nil, fmt.Errorf("x: %w", err)
+		}
+		y, err := decodeInt(raw.Y)
+		if err != nil {
+			return nil, fmt.Errorf("y: %w", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if raw.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", raw.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(raw.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("x: invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", raw.Kty)
+}
+
+// decodeInt декодирует число в base64url без выравнивания.
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
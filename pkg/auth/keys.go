@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// APIKey ключ API в конфигурации. Сам ключ не хранится,
+// только его хеш SHA-256: ключи случайные и длинные,
+// поэтому медленный хеш для них не нужен.
+type APIKey struct {
+	Name   string `json:"name"`   // имя клиента, становится Principal.Subject
+	SHA256 string `json:"sha256"` // хеш ключа в hex, см. HashAPIKey
+}
+
+// HashAPIKey возвращает хеш ключа API для конфигурации.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadAPIKeys читает ключи API из JSON-файла вида
+//
+//	[{"name": "ci", "sha256": "<hex>"}]
+func LoadAPIKeys(path string) ([]APIKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []APIKey
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, fmt.Errorf("auth: %s: %w", path, err)
+	}
+
+	names := make(map[string]bool, len(keys))
+	for i, k := range keys {
+		if k.Name == "" {
+			return nil, fmt.Errorf("auth: %s: key %d has no name", path, i)
+		}
+		if names[k.Name] {
+			return nil, fmt.Errorf("auth: %s: duplicate key name %q", path, k.Name)
+		}
+		names[k.Name] = true
+		if b, err := hex.DecodeString(k.SHA256); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("auth: %s: key %q: sha256 must be %d hex characters", path, k.Name, 2*sha256.Size)
+		}
+	}
+	return keys, nil
+}
@@ -2,11 +2,18 @@ package cache
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rtemka/rbtest/domain"
+	"github.com/rtemka/rbtest/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type item = domain.Item
@@ -15,19 +22,114 @@ type repo = domain.Repository
 // Cache хранит все текущие объекты БД в памяти,
 // обновляет по заданному интервалу, а также когда
 // происходят операции удаления или обновления.
+// Данные хранятся в виде неизменяемого снимка, который
+// при обновлении заменяется целиком, поэтому чтение
+// обходится без блокировок.
 type Cache struct {
-	mu     sync.RWMutex
-	data   []item // здесь можно исользовать мапу, но обойдемся слайсом
+	snap   atomic.Pointer[snapshot] // nil, пока кэш ни разу не загружен
+	wmu    sync.Mutex               // упорядочивает загрузку и замену снимка
 	repo   repo
-	logger *log.Logger
+	logger *slog.Logger
+	feed   bool                // обновлять кэш по потоку изменений БД
+	poll   time.Duration       // интервал загрузки, пока поток изменений недоступен
+	hook   domain.ChangeHook   // получает изменения снимка, может быть nil
+	onLoad RefreshHook         // получает результат каждой загрузки, может быть nil
+	tombs  map[int64]time.Time // время удаления недавно удаленных объектов, под wmu
+}
+
+// tombstoneTTL сколько кэш помнит удаленный объект: столько
+// могут запаздывать события потока изменений и записи,
+// завершившиеся в БД раньше удаления.
+const tombstoneTTL = time.Minute
+
+// tracer создает спаны операций кэша.
+var tracer = otel.Tracer("github.com/rtemka/rbtest/pkg/cache")
+
+// Атрибуты спанов кэша.
+const (
+	hitKey    = attribute.Key("cache.hit")    // объект найден в снимке
+	forcedKey = attribute.Key("cache.forced") // загрузка вызвана чтением из незагруженного кэша
+	sizeKey   = attribute.Key("cache.items")  // объектов в загруженном снимке
+)
+
+// Option настраивает кэш.
+type Option func(*Cache)
+
+// WithChangeFeed включает обновление кэша по потоку изменений,
+// если БД его поддерживает (реализует domain.Watcher). Изменения
+// применяются по одному, а полная перезагрузка выполняется
+// только для сверки раз в интервал обновления и после обрыва
+// потока. Пока подписаться не удается (например, mongo без
+// replica set), кэш обновляется целиком каждые poll, и каждый
+// раз подписка повторяется. Если БД не умеет сообщать об
+// изменениях, кэш обновляется целиком по интервалу обновления.
+func WithChangeFeed(poll time.Duration) Option {
+	return func(c *Cache) {
+		c.feed = true
+		c.poll = poll
+	}
+}
+
+// WithChangeHook передает hook изменения объектов кэша: записи
+// через кэш, события потока изменений и различия, найденные при
+// перезагрузке из БД. Передаются только изменения, которые
+// действительно изменили снимок, поэтому одно и то же
+// изменение, пришедшее дважды (от записи и из потока),
+// передается один раз. Hook вызывается по порядку
+// под блокировкой записи кэша.
+func WithChangeHook(hook domain.ChangeHook) Option {
+	return func(c *Cache) { c.hook = hook }
+}
+
+// RefreshHook получает длительность и ошибку загрузки кэша из БД.
+type RefreshHook func(d time.Duration, err error)
+
+// WithRefreshHook передает hook результат каждой полной
+// загрузки кэша из БД, например, для метрик.
+func WithRefreshHook(hook RefreshHook) Option {
+	return func(c *Cache) { c.onLoad = hook }
+}
+
+// Stats состояние кэша.
+type Stats struct {
+	Size     int       // объектов в снимке
+	LoadedAt time.Time // время последней загрузки из БД, нулевое, если загрузок не было
+}
+
+// Stats возвращает состояние текущего снимка кэша.
+func (c *Cache) Stats() Stats {
+	s := c.snap.Load()
+	if s == nil {
+		return Stats{}
+	}
+	return Stats{Size: len(s.items), LoadedAt: s.loadedAt}
+}
+
+// Check возвращает проверку готовности кэша: кэш загружен
+// из БД хотя бы раз, и последняя полная загрузка была не
+// раньше, чем maxAge назад.
+func (c *Cache) Check(maxAge time.Duration) func(ctx context.Context) error {
+	return func(context.Context) error {
+		st := c.Stats()
+		if st.LoadedAt.IsZero() {
+			return errors.New("cache is not loaded yet")
+		}
+		if age := time.Since(st.LoadedAt); age > maxAge {
+			return fmt.Errorf("cache snapshot is stale: loaded %s ago", age.Round(time.Second))
+		}
+		return nil
+	}
 }
 
 // New возвращает новый объект кэша.
-func New(ctx context.Context, db repo, logger *log.Logger, updInterval time.Duration) *Cache {
+func New(ctx context.Context, db repo, logger *slog.Logger, updInterval time.Duration, opts ...Option) *Cache {
 	c := Cache{
 		repo:   db,
 		logger: logger,
 	}
+	for _, opt := range opts {
+		opt(&c)
+	}
 
 	go c.cacheLoader(ctx, updInterval) // горутина для обновления кэша.
 
@@ -35,55 +137,149 @@ func New(ctx context.Context, db repo, logger *log.Logger, updInterval time.Dura
 }
 
 // update обновляет кэш целиком, ошибка для удобства
-// логируется.
-func (c *Cache) update(ctx context.Context) {
+// пишется в журнал. Чтение из БД выполняется под wmu, чтобы
+// изменение, примененное во время загрузки, не было
+// затерто более старым снимком.
+func (c *Cache) update(ctx context.Context, forced bool) {
+	ctx, span := tracer.Start(ctx, "cache.refresh", trace.WithAttributes(forcedKey.Bool(forced)))
+	var err error
+	defer func() { tracing.End(span, err) }()
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
 
+	start := time.Now()
 	items, err := c.repo.Items(ctx)
+	if c.onLoad != nil {
+		c.onLoad(time.Since(start), err)
+	}
 	if err != nil {
-		c.logger.Println(err)
+		c.logger.ErrorContext(ctx, "cache refresh failed", "err", err)
 		return
 	}
-	c.mu.Lock()
-	c.data = items
-	c.mu.Unlock()
+
+	span.SetAttributes(sizeKey.Int(len(items)))
+	n := newSnapshot(items, time.Now())
+	c.logger.DebugContext(ctx, "cache refreshed", "items", len(items), "latency", n.loadedAt.Sub(start))
+	c.notify(c.snap.Swap(n), n)
 }
 
-// all возвращает полную копию кэша для дальнешего использования.
-func (c *Cache) all(ctx context.Context) []item {
-	c.mu.RLock()
-	var out = make([]item, len(c.data))
-	_ = copy(out, c.data)
-	c.mu.RUnlock()
+// apply применяет к кэшу изменения объектов, заменяя
+// снимок один раз на все изменения.
+func (c *Cache) apply(ctx context.Context, changes ...domain.Change) {
+	for _, change := range changes {
+		if change.Op == domain.ChangeReset {
+			c.update(ctx, false)
+			return
+		}
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	s := c.snap.Load()
+	if s == nil {
+		return // изменения будут учтены при первой загрузке
+	}
+	n, applied := s.patch(c.alive(ctx, changes))
+	c.bury(applied)
+	c.snap.Store(n)
+	if c.hook != nil && len(applied) > 0 {
+		c.hook(applied)
+	}
+}
+
+// alive проверяет по БД изменения недавно удаленных объектов:
+// событие о старой версии, пришедшее из потока после записи
+// удаления через кэш, или запись, завершившаяся в БД раньше
+// удаления, вернули бы удаленный объект в снимок. Изменение
+// применяется, только если объект снова есть в БД (например,
+// создан заново с тем же id), и тогда в том виде, в каком он
+// хранится. Вызывается под wmu.
+func (c *Cache) alive(ctx context.Context, changes []domain.Change) []domain.Change {
+	now := time.Now()
+	for id, at := range c.tombs {
+		if now.Sub(at) > tombstoneTTL {
+			delete(c.tombs, id)
+		}
+	}
+	if len(c.tombs) == 0 {
+		return changes
+	}
+
+	out := make([]domain.Change, 0, len(changes))
+	for _, change := range changes {
+		if _, ok := c.tombs[change.Item.ID]; !ok || change.Op == domain.ChangeDeleted {
+			out = append(out, change)
+			continue
+		}
+		it, err := c.repo.Item(ctx, change.Item.ID)
+		switch {
+		case err == nil:
+			out = append(out, domain.Change{Op: change.Op, Item: it})
+		case !errors.Is(err, domain.ErrNotFound):
+			// кэш сверится с БД при следующей загрузке
+			c.logger.WarnContext(ctx, "cache change of deleted item not checked", "id", change.Item.ID, "err", err)
+		}
+	}
 	return out
 }
 
-// len возвращает количество элементов в кэше.
-func (c *Cache) len() int {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	return len(c.data)
+// bury запоминает удаленные объекты из примененных изменений
+// applied и забывает созданные заново. Вызывается под wmu.
+func (c *Cache) bury(applied []domain.Change) {
+	for _, change := range applied {
+		if change.Op != domain.ChangeDeleted {
+			delete(c.tombs, change.Item.ID)
+			continue
+		}
+		if c.tombs == nil {
+			c.tombs = make(map[int64]time.Time)
+		}
+		c.tombs[change.Item.ID] = time.Now()
+	}
 }
 
-// get производит поиск объекта в кэше по id
-// за линейное время.
-func (c *Cache) get(id int64) item {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+// notify передает hook различия между снимками old и n
+// после полной загрузки. Первая загрузка кэша изменением
+// не считается. Вызывается под wmu.
+func (c *Cache) notify(old, n *snapshot) {
+	if c.hook == nil || old == nil {
+		return
+	}
+	if changes := old.diff(n); len(changes) > 0 {
+		c.hook(changes)
+	}
+}
 
-	for i := range c.data {
-		if c.data[i].ID == id {
-			return c.data[i]
-		}
+// load возвращает текущий снимок кэша. Если кэш еще
+// ни разу не загружался, то загружает его из БД, отмечая
+// это в спане ctx событием cache.forced_refresh.
+// Если загрузить не удалось, возвращается пустой снимок.
+func (c *Cache) load(ctx context.Context) *snapshot {
+	if s := c.snap.Load(); s != nil {
+		return s
+	}
+	trace.SpanFromContext(ctx).AddEvent("cache.forced_refresh")
+	c.update(ctx, true)
+	if s := c.snap.Load(); s != nil {
+		return s
 	}
-	return item{}
+	return newSnapshot(nil, time.Time{})
 }
 
 // cacheLoader обновляет кэш каждый раз через interval.
+// В режиме потока изменений передает работу feedLoader.
 func (c *Cache) cacheLoader(ctx context.Context, interval time.Duration) {
 	upd := func() {
 		chc, cancel := context.WithTimeout(ctx, 5*time.Second)
 		defer cancel()
-		c.update(chc)
+		c.update(chc, false)
+	}
+
+	if w, ok := c.repo.(domain.Watcher); ok && c.feed {
+		c.feedLoader(ctx, w, interval, upd)
+		return
 	}
 
 	upd() // первый раз сразу
@@ -98,6 +294,54 @@ func (c *Cache) cacheLoader(ctx context.Context, interval time.Duration) {
 	}
 }
 
+// feedLoader подписывается на поток изменений БД и применяет
+// их к кэшу. Раз в interval кэш сверяется с БД целиком.
+// Если поток прервался, кэш перезагружается и подписка
+// возобновляется. Если подписаться не удалось, кэш
+// перезагружается и подписка повторяется через c.poll.
+func (c *Cache) feedLoader(ctx context.Context, w domain.Watcher, interval time.Duration, upd func()) {
+	for {
+		changes, err := w.Watch(ctx)
+		upd() // загружаем после подписки, чтобы не пропустить изменения
+		if err != nil {
+			c.logger.WarnContext(ctx, "change feed subscription failed, polling", "err", err, "interval", c.poll)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(c.poll):
+				continue
+			}
+		}
+
+		c.consume(ctx, changes, interval, upd)
+		if ctx.Err() != nil {
+			return
+		}
+		c.logger.InfoContext(ctx, "change feed closed, resubscribing")
+	}
+}
+
+// consume применяет изменения из канала, пока он не закрыт
+// или не отменен ctx, и сверяет кэш с БД раз в interval.
+func (c *Cache) consume(ctx context.Context, changes <-chan domain.Change, interval time.Duration, upd func()) {
+	reconcile := time.NewTicker(interval)
+	defer reconcile.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case change, ok := <-changes:
+			if !ok {
+				return
+			}
+			c.apply(ctx, change)
+		case <-reconcile.C:
+			upd()
+		}
+	}
+}
+
 // Имитируем контрак БД, чтобы работать поверх неё.
 
 // Close закрываем подключение к БД.
@@ -107,36 +351,146 @@ func (c *Cache) Close() error {
 
 // Items возвращает списком все объекты из БД.
 func (c *Cache) Items(ctx context.Context) ([]item, error) {
-	if c.len() == 0 {
-		c.update(ctx)
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	return c.all(ctx), nil
+	ctx, span := tracer.Start(ctx, "cache.Items")
+	defer span.End()
+	return c.load(ctx).all(), nil
 }
 
-// Items возвращает списком все объекты из БД.
-func (c *Cache) Item(ctx context.Context, id int64) (item, error) {
-	if c.len() == 0 {
-		c.update(ctx)
+// IterateItems обходит объекты текущего снимка кэша.
+// Снимок не изменяется, поэтому объекты не копируются.
+func (c *Cache) IterateItems(ctx context.Context, fn func(item) error) error {
+	ctx, span := tracer.Start(ctx, "cache.IterateItems")
+	defer span.End()
+	for _, it := range c.load(ctx).items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(it); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// Item находит объект по id. Если объекта нет в кэше,
+// то он запрашивается из БД, так как кэш мог еще не
+// обновиться после добавления объекта. Попадание в кэш
+// отмечается в спане атрибутом cache.hit.
+func (c *Cache) Item(ctx context.Context, id int64) (_ item, err error) {
+	if err := ctx.Err(); err != nil {
+		return item{}, err
+	}
+	ctx, span := tracer.Start(ctx, "cache.Item")
+	defer func() { tracing.End(span, err) }()
+
+	item, ok := c.load(ctx).get(id)
+	span.SetAttributes(hitKey.Bool(ok))
+	if ok {
+		return item, nil
+	}
+	return c.repo.Item(ctx, id)
+}
+
+// ListItems возвращает страницу объектов по запросу,
+// запрос выполняется над данными в памяти.
+func (c *Cache) ListItems(ctx context.Context, q domain.ListQuery) (domain.ItemsPage, error) {
+	if err := ctx.Err(); err != nil {
+		return domain.ItemsPage{}, err
+	}
+	ctx, span := tracer.Start(ctx, "cache.ListItems")
+	defer span.End()
+	return c.load(ctx).list(q), nil
+}
+
+// Операции записи сразу применяют изменение к кэшу,
+// чтобы клиент видел результат своей записи, не дожидаясь
+// очередного обновления.
+
+// CreateItem добавляет в БД объект, присваивая ему новый id.
+func (c *Cache) CreateItem(ctx context.Context, item item) (_ item, err error) {
+	ctx, span := tracer.Start(ctx, "cache.CreateItem")
+	defer func() { tracing.End(span, err) }()
+
+	item, err = c.repo.CreateItem(ctx, item)
+	if err != nil {
+		return item, err
 	}
-	return c.get(id), nil
+	c.apply(ctx, domain.Change{Op: domain.ChangeCreated, Item: item})
+	return item, nil
 }
 
 // DeleteItem удаляет из БД объект по id.
-func (c *Cache) DeleteItem(ctx context.Context, id int64) error {
-	err := c.repo.DeleteItem(ctx, id)
+func (c *Cache) DeleteItem(ctx context.Context, id, version int64) (err error) {
+	ctx, span := tracer.Start(ctx, "cache.DeleteItem")
+	defer func() { tracing.End(span, err) }()
+
+	err = c.repo.DeleteItem(ctx, id, version)
 	if err != nil {
 		return err
 	}
-	go c.update(context.Background())
+	c.apply(ctx, domain.Change{Op: domain.ChangeDeleted, Item: item{ID: id}})
 	return nil
 }
 
-// UpdateItem обновляет в БД объект.
-func (c *Cache) UpdateItem(ctx context.Context, item item) error {
-	err := c.repo.UpdateItem(ctx, item)
+// ModifyItem изменяет объект в БД функцией fn.
+func (c *Cache) ModifyItem(ctx context.Context, id, version int64, fn domain.ModifyFunc) (_ item, err error) {
+	ctx, span := tracer.Start(ctx, "cache.ModifyItem")
+	defer func() { tracing.End(span, err) }()
+
+	item, err := c.repo.ModifyItem(ctx, id, version, fn)
 	if err != nil {
-		return err
+		return item, err
 	}
-	go c.update(context.Background())
-	return nil
+	c.apply(ctx, domain.Change{Op: domain.ChangeUpdated, Item: item})
+	return item, nil
+}
+
+// Batch выполняет пакет операций в БД и применяет к кэшу
+// все успешные операции разом.
+func (c *Cache) Batch(ctx context.Context, ops []domain.BatchOperation, atomic bool) (_ []domain.BatchResult, err error) {
+	ctx, span := tracer.Start(ctx, "cache.Batch")
+	defer func() { tracing.End(span, err) }()
+
+	results, err := c.repo.Batch(ctx, ops, atomic)
+	if err != nil {
+		return results, err
+	}
+
+	changes := make([]domain.Change, 0, len(results))
+	for i, res := range results {
+		if res.Err != nil {
+			continue
+		}
+		op := domain.ChangeUpdated
+		switch ops[i].Op {
+		case domain.BatchCreate:
+			op = domain.ChangeCreated
+		case domain.BatchDelete:
+			op = domain.ChangeDeleted
+		case domain.BatchPut:
+			if res.Created {
+				op = domain.ChangeCreated
+			}
+		}
+		changes = append(changes, domain.Change{Op: op, Item: res.Item})
+	}
+	c.apply(ctx, changes...)
+
+	return results, nil
+}
+
+// UpdateItem обновляет в БД объект и возвращает его новую версию.
+func (c *Cache) UpdateItem(ctx context.Context, item item) (_ item, err error) {
+	ctx, span := tracer.Start(ctx, "cache.UpdateItem")
+	defer func() { tracing.End(span, err) }()
+
+	item, err = c.repo.UpdateItem(ctx, item)
+	if err != nil {
+		return item, err
+	}
+	c.apply(ctx, domain.Change{Op: domain.ChangeUpdated, Item: item})
+	return item, nil
 }
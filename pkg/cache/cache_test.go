@@ -0,0 +1,558 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rtemka/rbtest/domain"
+	"github.com/rtemka/rbtest/pkg/logging"
+	"github.com/rtemka/rbtest/pkg/repo/memdb"
+	"github.com/rtemka/rbtest/pkg/repo/repotest"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// testItems возвращает n объектов с id от 1 до n в обратном порядке.
+func testItems(n int) []item {
+	items := make([]item, 0, n)
+	for i := n; i > 0; i-- {
+		items = append(items, item{ID: int64(i), Name: fmt.Sprintf("item %03d", i%100)})
+	}
+	return items
+}
+
+func TestSnapshotList(t *testing.T) {
+	items := testItems(50)
+	s := newSnapshot(items, time.Now())
+
+	queries := []domain.ListQuery{
+		{},
+		{Limit: 7},
+		{Limit: 7, After: &domain.Cursor{ID: 20}},
+		{Limit: 7, Desc: true},
+		{Limit: 7, Desc: true, After: &domain.Cursor{ID: 20}},
+		{Limit: 3, NameContains: "1"},
+		{Limit: 3, Desc: true, NamePrefix: "item 04"},
+		{Sort: domain.SortByName, Limit: 5, After: &domain.Cursor{ID: 10, Name: "item 010"}},
+		{After: &domain.Cursor{ID: 100}},
+	}
+
+	for _, q := range queries {
+		got := s.list(q)
+		want := q.Page(items)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("list(%+v) = %v, want %v", q, got, want)
+		}
+	}
+}
+
+func TestSnapshotPatch(t *testing.T) {
+	one := item{ID: 1, Name: "one", Version: 2}
+	s := newSnapshot([]item{one}, time.Now())
+	two := item{ID: 2, Name: "two", Version: 1}
+	oneUpd := item{ID: 1, Name: "one upd", Version: 3}
+
+	tests := []struct {
+		name    string
+		changes []domain.Change
+		want    []domain.Change
+	}{
+		{name: "create",
+			changes: []domain.Change{{Op: domain.ChangeCreated, Item: two}},
+			want:    []domain.Change{{Op: domain.ChangeCreated, Item: two}}},
+		{name: "stale update",
+			changes: []domain.Change{{Op: domain.ChangeUpdated, Item: item{ID: 1, Name: "old", Version: 1}}}},
+		{name: "repeated update",
+			changes: []domain.Change{{Op: domain.ChangeUpdated, Item: one}}},
+		{name: "delete missing",
+			changes: []domain.Change{{Op: domain.ChangeDeleted, Item: item{ID: 2}}}},
+		{name: "delete carries the item",
+			changes: []domain.Change{{Op: domain.ChangeDeleted, Item: item{ID: 1}}},
+			want:    []domain.Change{{Op: domain.ChangeDeleted, Item: one}}},
+		{name: "several",
+			changes: []domain.Change{
+				{Op: domain.ChangeCreated, Item: oneUpd}, // объект уже есть
+				{Op: domain.ChangeUpdated, Item: one},    // запоздавшее
+				{Op: domain.ChangeUpdated, Item: two},    // объекта нет
+				{Op: domain.ChangeDeleted, Item: item{ID: 3}},
+			},
+			want: []domain.Change{
+				{Op: domain.ChangeUpdated, Item: oneUpd},
+				{Op: domain.ChangeCreated, Item: two},
+			}},
+	}
+
+	for _, tt := range tests {
+		n, got := s.patch(tt.changes)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("patch(%s) applied = %v, want %v", tt.name, got, tt.want)
+		}
+		if (len(got) == 0) != (n == s) {
+			t.Errorf("patch(%s) replaced the snapshot = %t, want %t", tt.name, n != s, len(got) > 0)
+		}
+	}
+}
+
+var seed = []item{
+	{ID: 1, Name: "test one", Version: 1},
+	{ID: 2, Name: "test two", Version: 1},
+}
+
+func TestCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := New(ctx, memdb.New(seed...), logging.Discard(), time.Minute)
+
+	items, err := c.Items(ctx)
+	if err != nil {
+		t.Fatalf("Items() = err %v", err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("Items() len = %d, want %d", len(items), 2)
+	}
+
+	got, err := c.Item(ctx, items[1].ID)
+	if err != nil {
+		t.Fatalf("Item() = err %v", err)
+	}
+	if got != items[1] {
+		t.Errorf("Item() = %v, want %v", got, items[1])
+	}
+}
+
+func TestConformance(t *testing.T) {
+	repotest.RunConformance(t, func(t *testing.T) domain.Repository {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		return New(ctx, memdb.New(), logging.Discard(), time.Hour)
+	})
+}
+
+// feedRepo источник изменений в памяти для тестов режима
+// потока изменений без replica set mongo. Каждый вызов Watch
+// создает новый поток и публикует его в канал subs.
+type feedRepo struct {
+	*memdb.MemDB
+	subs chan chan domain.Change
+}
+
+func (r *feedRepo) Watch(ctx context.Context) (<-chan domain.Change, error) {
+	ch := make(chan domain.Change)
+	r.subs <- ch
+	return ch, nil
+}
+
+// waitFor ждет, пока условие не станет истинным.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCacheChangeFeed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	repo := &feedRepo{MemDB: memdb.New(seed...), subs: make(chan chan domain.Change, 1)}
+	c := New(ctx, repo, logging.Discard(), time.Hour, WithChangeFeed(time.Hour))
+
+	has := func(id int64) bool {
+		s := c.snap.Load()
+		if s == nil {
+			return false
+		}
+		_, ok := s.get(id)
+		return ok
+	}
+
+	stream := <-repo.subs
+	waitFor(t, "initial load", func() bool { return has(1) && has(2) })
+
+	stream <- domain.Change{Op: domain.ChangeCreated, Item: item{ID: 3, Name: "three"}}
+	waitFor(t, "created item", func() bool { return has(3) })
+
+	stream <- domain.Change{Op: domain.ChangeDeleted, Item: item{ID: 1}}
+	waitFor(t, "deleted item", func() bool { return !has(1) })
+
+	// после обрыва потока кэш перечитывается из БД
+	// и подписка возобновляется
+	close(stream)
+	stream = <-repo.subs
+	waitFor(t, "reload", func() bool { return has(1) && !has(3) })
+
+	stream <- domain.Change{Op: domain.ChangeReset}
+	stream <- domain.Change{Op: domain.ChangeUpdated, Item: item{ID: 2, Name: "two", Version: 2}}
+	waitFor(t, "updated item", func() bool {
+		it, _ := c.snap.Load().get(2)
+		return it.Name == "two"
+	})
+
+	// событие о более старой версии не должно затирать новую
+	stream <- domain.Change{Op: domain.ChangeUpdated, Item: item{ID: 2, Name: "stale", Version: 1}}
+	stream <- domain.Change{Op: domain.ChangeCreated, Item: item{ID: 4, Name: "four", Version: 1}}
+	waitFor(t, "created item", func() bool { return has(4) })
+	if it, _ := c.snap.Load().get(2); it.Name != "two" {
+		t.Errorf("stale change applied: got %v", it)
+	}
+}
+
+// noFeedRepo БД, на поток изменений которой подписаться
+// нельзя, как mongo без replica set.
+type noFeedRepo struct {
+	*memdb.MemDB
+}
+
+func (noFeedRepo) Watch(context.Context) (<-chan domain.Change, error) {
+	return nil, errors.New("change streams are only supported on replica sets")
+}
+
+func TestCacheChangeFeedUnavailable(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// сверка раз в час, но без потока кэш опрашивает БД чаще
+	db := memdb.New(seed...)
+	c := New(ctx, noFeedRepo{db}, logging.Discard(), time.Hour, WithChangeFeed(10*time.Millisecond))
+	waitFor(t, "initial load", func() bool { return c.snap.Load() != nil })
+
+	created, err := db.CreateItem(ctx, item{Name: "bypass"})
+	if err != nil {
+		t.Fatalf("CreateItem() = err %v", err)
+	}
+	waitFor(t, "polled item", func() bool {
+		_, ok := c.snap.Load().get(created.ID)
+		return ok
+	})
+}
+
+func TestCacheWrites(t *testing.T) {
+	ctx := context.Background()
+
+	// кэш без фонового обновления
+	c := &Cache{repo: memdb.New(seed...), logger: logging.Discard()}
+	c.update(ctx, false)
+
+	created, err := c.CreateItem(ctx, item{Name: "created"})
+	if err != nil {
+		t.Fatalf("CreateItem() = err %v", err)
+	}
+
+	page, err := c.ListItems(ctx, domain.ListQuery{Desc: true, Limit: 1})
+	if err != nil {
+		t.Fatalf("ListItems() = err %v", err)
+	}
+	if len(page.Items) != 1 || page.Items[0] != created {
+		t.Errorf("ListItems() = %v, want %v", page.Items, created)
+	}
+
+	updated, err := c.UpdateItem(ctx, item{ID: created.ID, Name: "updated"})
+	if err != nil {
+		t.Fatalf("UpdateItem() = err %v", err)
+	}
+	if got, _ := c.Item(ctx, created.ID); got != updated {
+		t.Errorf("Item() = %v, want %v", got, updated)
+	}
+
+	if err := c.DeleteItem(ctx, 1, 0); err != nil {
+		t.Fatalf("DeleteItem() = err %v", err)
+	}
+	if _, ok := c.snap.Load().get(1); ok {
+		t.Errorf("DeleteItem() item is still in cache")
+	}
+}
+
+func TestCacheChangeHook(t *testing.T) {
+	ctx := context.Background()
+
+	var got []domain.Change
+	db := memdb.New(seed...)
+	c := &Cache{repo: db, logger: logging.Discard(),
+		hook: func(changes []domain.Change) { got = append(got, changes...) }}
+	c.update(ctx, false) // первая загрузка не считается изменением
+
+	created, err := c.CreateItem(ctx, item{Name: "created"})
+	if err != nil {
+		t.Fatalf("CreateItem() = err %v", err)
+	}
+	// то же изменение из потока не повторяется
+	c.apply(ctx, domain.Change{Op: domain.ChangeCreated, Item: created})
+
+	if err := c.DeleteItem(ctx, 1, 0); err != nil {
+		t.Fatalf("DeleteItem() = err %v", err)
+	}
+
+	// изменения в обход кэша видны после перезагрузки
+	updated, err := db.UpdateItem(ctx, item{ID: 2, Name: "two"})
+	if err != nil {
+		t.Fatalf("UpdateItem() = err %v", err)
+	}
+	c.update(ctx, false)
+
+	want := []domain.Change{
+		{Op: domain.ChangeCreated, Item: created},
+		{Op: domain.ChangeDeleted, Item: seed[0]},
+		{Op: domain.ChangeUpdated, Item: updated},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("hook got %v, want %v", got, want)
+	}
+}
+
+// TestCacheStaleChangeAfterDelete проверяет, что запоздавшее
+// изменение удаленного через кэш объекта не возвращает его.
+func TestCacheStaleChangeAfterDelete(t *testing.T) {
+	ctx := context.Background()
+
+	var got []domain.Change
+	db := memdb.New(seed...)
+	c := &Cache{repo: db, logger: logging.Discard(),
+		hook: func(changes []domain.Change) { got = append(got, changes...) }}
+	c.update(ctx, false)
+
+	updated, err := c.UpdateItem(ctx, item{ID: 1, Name: "one"})
+	if err != nil {
+		t.Fatalf("UpdateItem() = err %v", err)
+	}
+	if err := c.DeleteItem(ctx, 1, 0); err != nil {
+		t.Fatalf("DeleteItem() = err %v", err)
+	}
+	// события потока об изменениях до удаления
+	c.apply(ctx, domain.Change{Op: domain.ChangeUpdated, Item: updated})
+	c.apply(ctx, domain.Change{Op: domain.ChangeCreated, Item: seed[0]})
+
+	if _, ok := c.snap.Load().get(1); ok {
+		t.Fatalf("stale change brought the deleted item back")
+	}
+	want := []domain.Change{
+		{Op: domain.ChangeUpdated, Item: updated},
+		{Op: domain.ChangeDeleted, Item: updated},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("hook got %v, want %v", got, want)
+	}
+
+	// объект, созданный заново с тем же id, виден сразу
+	res, err := c.Batch(ctx, []domain.BatchOperation{{Op: domain.BatchPut, Item: item{ID: 1, Name: "again"}}}, false)
+	if err != nil || res[0].Err != nil {
+		t.Fatalf("Batch() = %v, err %v", res, err)
+	}
+	if it, ok := c.snap.Load().get(1); !ok || it != res[0].Item {
+		t.Errorf("cache item = %v, %t, want %v", it, ok, res[0].Item)
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	var loads []error
+	c := &Cache{repo: memdb.New(seed...), logger: logging.Discard(),
+		onLoad: func(_ time.Duration, err error) { loads = append(loads, err) }}
+
+	if got := c.Stats(); got != (Stats{}) {
+		t.Errorf("Stats() before load = %+v, want zero", got)
+	}
+
+	c.update(context.Background(), false)
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.update(canceled, false) // неудачная загрузка оставляет прежний снимок
+
+	if got := c.Stats(); got.Size != len(seed) || got.LoadedAt.IsZero() {
+		t.Errorf("Stats() = %+v, want %d items and load time", got, len(seed))
+	}
+	if len(loads) != 2 || loads[0] != nil || !errors.Is(loads[1], context.Canceled) {
+		t.Errorf("refresh hook got %v, want [nil context.Canceled]", loads)
+	}
+}
+
+func TestCacheCheck(t *testing.T) {
+	c := &Cache{repo: memdb.New(seed...), logger: logging.Discard()}
+	check := c.Check(time.Minute)
+
+	if err := check(context.Background()); err == nil {
+		t.Errorf("Check() before load = nil, want error")
+	}
+
+	c.update(context.Background(), false)
+	if err := check(context.Background()); err != nil {
+		t.Errorf("Check() after load = err %v, want nil", err)
+	}
+
+	c.snap.Store(newSnapshot(seed, time.Now().Add(-2*time.Minute)))
+	if err := check(context.Background()); err == nil {
+		t.Errorf("Check() with stale snapshot = nil, want error")
+	}
+}
+
+// spans собирает спаны тестов. Трассировка настраивается
+// один раз: трассировщики пакета привязываются к первой
+// установленной глобальной трассировке.
+var spans = func() *tracetest.SpanRecorder {
+	r := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(r)))
+	return r
+}()
+
+func TestCacheTracing(t *testing.T) {
+	c := &Cache{repo: memdb.New(seed...), logger: logging.Discard()}
+	ctx, root := otel.Tracer("test").Start(context.Background(), "test")
+	_, _ = c.Item(ctx, 1)  // первое чтение загружает кэш
+	_, _ = c.Item(ctx, 42) // промах, объект ищется в БД
+	root.End()
+
+	type span struct {
+		name   string
+		attrs  string
+		events string
+		parent string
+	}
+	var ended []sdktrace.ReadOnlySpan
+	names := map[trace.SpanID]string{}
+	for _, s := range spans.Ended() {
+		if s.SpanContext().TraceID() == root.SpanContext().TraceID() { // без спанов других тестов
+			ended = append(ended, s)
+			names[s.SpanContext().SpanID()] = s.Name()
+		}
+	}
+
+	var got []span
+	for _, s := range ended {
+		var attrs, events []string
+		for _, a := range s.Attributes() {
+			attrs = append(attrs, string(a.Key)+"="+a.Value.Emit())
+		}
+		for _, e := range s.Events() {
+			events = append(events, e.Name)
+		}
+		got = append(got, span{name: s.Name(), attrs: strings.Join(attrs, ","),
+			events: strings.Join(events, ","), parent: names[s.Parent().SpanID()]})
+	}
+
+	want := []span{
+		{name: "cache.refresh", attrs: "cache.forced=true,cache.items=2", parent: "cache.Item"},
+		{name: "cache.Item", attrs: "cache.hit=true", events: "cache.forced_refresh", parent: "test"},
+		{name: "cache.Item", attrs: "cache.hit=false", events: "exception", parent: "test"},
+		{name: "test"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("spans = %+v, want %+v", got, want)
+	}
+}
+
+// mutexCache прежняя реализация хранения кэша:
+// слайс под RWMutex и линейный поиск. Нужна для
+// сравнения в бенчмарках.
+type mutexCache struct {
+	mu   sync.RWMutex
+	data []item
+}
+
+func (c *mutexCache) all() []item {
+	c.mu.RLock()
+	var out = make([]item, len(c.data))
+	_ = copy(out, c.data)
+	c.mu.RUnlock()
+	return out
+}
+
+func (c *mutexCache) get(id int64) (item, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for i := range c.data {
+		if c.data[i].ID == id {
+			return c.data[i], true
+		}
+	}
+	return item{}, false
+}
+
+const benchSize = 10000
+
+func BenchmarkGet(b *testing.B) {
+	items := testItems(benchSize)
+
+	b.Run("mutex", func(b *testing.B) {
+		c := mutexCache{data: items}
+		b.RunParallel(func(pb *testing.PB) {
+			var id int64
+			for pb.Next() {
+				id = id%benchSize + 1
+				_, _ = c.get(id)
+			}
+		})
+	})
+
+	b.Run("snapshot", func(b *testing.B) {
+		var c Cache
+		c.snap.Store(newSnapshot(items, time.Now()))
+		b.RunParallel(func(pb *testing.PB) {
+			var id int64
+			for pb.Next() {
+				id = id%benchSize + 1
+				_, _ = c.snap.Load().get(id)
+			}
+		})
+	})
+}
+
+func BenchmarkAll(b *testing.B) {
+	items := testItems(benchSize)
+
+	b.Run("mutex", func(b *testing.B) {
+		c := mutexCache{data: items}
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				_ = c.all()
+			}
+		})
+	})
+
+	b.Run("snapshot", func(b *testing.B) {
+		var c Cache
+		c.snap.Store(newSnapshot(items, time.Now()))
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				_ = c.snap.Load().all()
+			}
+		})
+	})
+}
+
+func BenchmarkListPage(b *testing.B) {
+	items := testItems(benchSize)
+	q := domain.ListQuery{Limit: 100, After: &domain.Cursor{ID: benchSize / 2}}
+
+	b.Run("mutex", func(b *testing.B) {
+		c := mutexCache{data: items}
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				c.mu.RLock()
+				_ = q.Page(c.data)
+				c.mu.RUnlock()
+			}
+		})
+	})
+
+	b.Run("snapshot", func(b *testing.B) {
+		var c Cache
+		c.snap.Store(newSnapshot(items, time.Now()))
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				_ = c.snap.Load().list(q)
+			}
+		})
+	})
+}
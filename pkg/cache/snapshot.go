@@ -0,0 +1,238 @@
+package cache
+
+import (
+	"sort"
+	"time"
+
+	"github.com/rtemka/rbtest/domain"
+)
+
+// snapshot неизменяемый снимок содержимого БД.
+// После публикации снимок не изменяется, поэтому
+// читать его можно без блокировок.
+type snapshot struct {
+	items    []item         // объекты, упорядоченные по id
+	byID     map[int64]item // индекс объектов по id
+	loadedAt time.Time      // время загрузки снимка из БД
+}
+
+// newSnapshot строит снимок из объектов БД.
+// Переданный слайс не изменяется.
+func newSnapshot(items []item, loadedAt time.Time) *snapshot {
+	s := snapshot{
+		items:    make([]item, len(items)),
+		byID:     make(map[int64]item, len(items)),
+		loadedAt: loadedAt,
+	}
+	copy(s.items, items)
+	sort.Slice(s.items, func(i, j int) bool { return s.items[i].ID < s.items[j].ID })
+
+	for i := range s.items {
+		s.byID[s.items[i].ID] = s.items[i]
+	}
+	return &s
+}
+
+// get находит объект по id за константное время.
+func (s *snapshot) get(id int64) (item, bool) {
+	it, ok := s.byID[id]
+	return it, ok
+}
+
+// all возвращает копию всех объектов снимка.
+func (s *snapshot) all() []item {
+	out := make([]item, len(s.items))
+	copy(out, s.items)
+	return out
+}
+
+// list выполняет запрос списка над снимком. При сортировке
+// по id используется упорядоченность снимка: начало страницы
+// находится бинарным поиском, а просмотр останавливается,
+// как только страница заполнена.
+func (s *snapshot) list(q domain.ListQuery) domain.ItemsPage {
+	if q.Sort == domain.SortByName {
+		return q.Page(s.items)
+	}
+
+	limit := q.PageLimit()
+	out := make([]item, 0, limit+1)
+
+	if !q.Desc {
+		start := 0
+		if q.After != nil {
+			start = sort.Search(len(s.items), func(i int) bool { return s.items[i].ID > q.After.ID })
+		}
+		for i := start; i < len(s.items) && len(out) <= limit; i++ {
+			if q.Match(s.items[i]) {
+				out = append(out, s.items[i])
+			}
+		}
+	} else {
+		end := len(s.items)
+		if q.After != nil {
+			end = sort.Search(len(s.items), func(i int) bool { return s.items[i].ID >= q.After.ID })
+		}
+		for i := end - 1; i >= 0 && len(out) <= limit; i-- {
+			if q.Match(s.items[i]) {
+				out = append(out, s.items[i])
+			}
+		}
+	}
+
+	return q.Cut(out)
+}
+
+// patch возвращает новый снимок с примененными изменениями
+// и сами примененные изменения. Запоздавшие изменения старых
+// версий объектов и изменения, которые ничего не меняют,
+// пропускаются. Удаление содержит объект целиком, каким он
+// был до удаления. Исходный снимок не изменяется.
+func (s *snapshot) patch(changes []domain.Change) (*snapshot, []domain.Change) {
+	switch len(changes) {
+	case 0:
+		return s, nil
+	case 1:
+		return s.patchOne(changes[0])
+	}
+
+	byID := make(map[int64]item, len(s.byID)+len(changes))
+	for k, v := range s.byID {
+		byID[k] = v
+	}
+	var applied []domain.Change
+	for _, change := range changes {
+		cur, exists := byID[change.Item.ID]
+		if change, ok := effect(cur, exists, change); ok {
+			applied = append(applied, change)
+			if change.Op == domain.ChangeDeleted {
+				delete(byID, change.Item.ID)
+			} else {
+				byID[change.Item.ID] = change.Item
+			}
+		}
+	}
+	if len(applied) == 0 {
+		return s, nil
+	}
+
+	items := make([]item, 0, len(byID))
+	for _, it := range byID {
+		items = append(items, it)
+	}
+	return newSnapshot(items, s.loadedAt), applied
+}
+
+// patchOne применяет одно изменение без полной перестройки снимка.
+func (s *snapshot) patchOne(change domain.Change) (*snapshot, []domain.Change) {
+	cur, exists := s.get(change.Item.ID)
+	change, ok := effect(cur, exists, change)
+	switch {
+	case !ok:
+		return s, nil
+	case change.Op == domain.ChangeDeleted:
+		return s.without(change.Item.ID), []domain.Change{change}
+	}
+	return s.with(change.Item), []domain.Change{change}
+}
+
+// effect возвращает изменение, которое change на самом деле
+// вносит в объект cur (exists - объект есть в снимке), или
+// false, если ничего не меняется: событие о старой версии,
+// повтор уже примененного изменения, удаление отсутствующего.
+func effect(cur item, exists bool, change domain.Change) (domain.Change, bool) {
+	switch change.Op {
+	case domain.ChangeCreated, domain.ChangeUpdated:
+		switch {
+		case !exists:
+			return domain.Change{Op: domain.ChangeCreated, Item: change.Item}, true
+		case cur.Version > change.Item.Version || cur == change.Item:
+			return domain.Change{}, false
+		}
+		return domain.Change{Op: domain.ChangeUpdated, Item: change.Item}, true
+	case domain.ChangeDeleted:
+		if !exists {
+			return domain.Change{}, false
+		}
+		return domain.Change{Op: domain.ChangeDeleted, Item: cur}, true
+	}
+	return domain.Change{}, false
+}
+
+// with возвращает новый снимок, в котором объект добавлен
+// или заменен. Исходный снимок не изменяется.
+func (s *snapshot) with(it item) *snapshot {
+	n := snapshot{
+		items:    make([]item, 0, len(s.items)+1),
+		byID:     make(map[int64]item, len(s.byID)+1),
+		loadedAt: s.loadedAt,
+	}
+
+	i := sort.Search(len(s.items), func(i int) bool { return s.items[i].ID >= it.ID })
+	n.items = append(n.items, s.items[:i]...)
+	n.items = append(n.items, it)
+	if i < len(s.items) && s.items[i].ID == it.ID {
+		i++ // заменяем существующий объект
+	}
+	n.items = append(n.items, s.items[i:]...)
+
+	for k, v := range s.byID {
+		n.byID[k] = v
+	}
+	n.byID[it.ID] = it
+
+	return &n
+}
+
+// without возвращает новый снимок без объекта с указанным id.
+// Если объекта нет, возвращается исходный снимок.
+func (s *snapshot) without(id int64) *snapshot {
+	if _, ok := s.byID[id]; !ok {
+		return s
+	}
+
+	n := snapshot{
+		items:    make([]item, 0, len(s.items)-1),
+		byID:     make(map[int64]item, len(s.byID)-1),
+		loadedAt: s.loadedAt,
+	}
+
+	for i := range s.items {
+		if s.items[i].ID != id {
+			n.items = append(n.items, s.items[i])
+			n.byID[s.items[i].ID] = s.items[i]
+		}
+	}
+
+	return &n
+}
+
+// diff возвращает изменения, превращающие снимок s в n,
+// в порядке id. Снимки сравниваются слиянием упорядоченных
+// объектов, одинаковые объекты пропускаются. Удаление
+// содержит объект целиком, каким он был до удаления.
+func (s *snapshot) diff(n *snapshot) []domain.Change {
+	if s == n {
+		return nil
+	}
+
+	var changes []domain.Change
+	i, j := 0, 0
+	for i < len(s.items) || j < len(n.items) {
+		switch {
+		case j == len(n.items) || i < len(s.items) && s.items[i].ID < n.items[j].ID:
+			changes = append(changes, domain.Change{Op: domain.ChangeDeleted, Item: s.items[i]})
+			i++
+		case i == len(s.items) || n.items[j].ID < s.items[i].ID:
+			changes = append(changes, domain.Change{Op: domain.ChangeCreated, Item: n.items[j]})
+			j++
+		default:
+			if s.items[i] != n.items[j] {
+				changes = append(changes, domain.Change{Op: domain.ChangeUpdated, Item: n.items[j]})
+			}
+			i++
+			j++
+		}
+	}
+	return changes
+}
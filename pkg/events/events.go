@@ -0,0 +1,107 @@
+// Пакет events нумерует изменения объектов и рассылает их
+// подписчикам: потоку SSE, WebSocket и gRPC.
+package events
+
+import (
+	"sync"
+
+	"github.com/rtemka/rbtest/domain"
+)
+
+// Event изменение объекта с порядковым номером.
+type Event struct {
+	ID     uint64
+	Change domain.Change
+}
+
+// Feed рассылает изменения объектов подписчикам. Последние
+// события хранятся в кольцевом буфере, чтобы переподключившийся
+// клиент получил пропущенное.
+type Feed struct {
+	mu     sync.Mutex
+	buf    []Event // событие с номером id хранится в buf[id%len(buf)]
+	last   uint64  // номер последнего события
+	subs   map[chan struct{}]struct{}
+	closed bool
+}
+
+// New возвращает рассылку с буфером на size событий.
+func New(size int) *Feed {
+	return &Feed{
+		buf:  make([]Event, max(size, 1)),
+		subs: make(map[chan struct{}]struct{}),
+	}
+}
+
+// Publish нумерует изменения и будит подписчиков, не дожидаясь
+// их. Подходит в качестве domain.ChangeHook.
+func (e *Feed) Publish(changes []domain.Change) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, change := range changes {
+		e.last++
+		e.buf[e.last%uint64(len(e.buf))] = Event{ID: e.last, Change: change}
+	}
+	for sub := range e.subs {
+		select {
+		case sub <- struct{}{}:
+		default: // подписчик уже разбужен
+		}
+	}
+}
+
+// Close закрывает каналы всех подписчиков, например, перед
+// остановкой сервера. Новые подписки сразу закрыты.
+func (e *Feed) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.closed = true
+	for sub := range e.subs {
+		close(sub)
+		delete(e.subs, sub)
+	}
+}
+
+// Subscribe возвращает канал, в который приходит сигнал
+// о новых событиях, и функцию отписки. После Close канал
+// закрывается.
+func (e *Feed) Subscribe() (<-chan struct{}, func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	sub := make(chan struct{}, 1)
+	if e.closed {
+		close(sub)
+		return sub, func() {}
+	}
+	e.subs[sub] = struct{}{}
+
+	return sub, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if _, ok := e.subs[sub]; ok {
+			delete(e.subs, sub)
+			close(sub)
+		}
+	}
+}
+
+// Since возвращает события после события с номером after
+// и номер последнего события. ok равно false, если часть
+// событий уже вытеснена из буфера или after из будущего
+// (например, сервер перезапускался).
+func (e *Feed) Since(after uint64) (events []Event, last uint64, ok bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	size := uint64(len(e.buf))
+	if after > e.last || e.last-after > size {
+		return nil, e.last, false
+	}
+	for id := after + 1; id <= e.last; id++ {
+		events = append(events, e.buf[id%size])
+	}
+	return events, e.last, true
+}
@@ -0,0 +1,46 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/rtemka/rbtest/domain"
+)
+
+type item = domain.Item
+
+func TestEventsSince(t *testing.T) {
+	e := New(3)
+	for i := 1; i <= 5; i++ {
+		e.Publish([]domain.Change{{Op: domain.ChangeCreated, Item: item{ID: int64(i)}}})
+	}
+
+	tests := []struct {
+		after   uint64
+		wantIDs []uint64
+		wantOK  bool
+	}{
+		{after: 5, wantIDs: nil, wantOK: true},
+		{after: 3, wantIDs: []uint64{4, 5}, wantOK: true},
+		{after: 2, wantIDs: []uint64{3, 4, 5}, wantOK: true},
+		{after: 1, wantOK: false}, // событие 2 вытеснено
+		{after: 9, wantOK: false}, // номер из будущего
+	}
+
+	for _, tt := range tests {
+		events, last, ok := e.Since(tt.after)
+		if ok != tt.wantOK || last != 5 {
+			t.Errorf("Since(%d) = last %d, ok %v, want 5, %v", tt.after, last, ok, tt.wantOK)
+			continue
+		}
+		var ids []uint64
+		for _, ev := range events {
+			if int64(ev.ID) != ev.Change.Item.ID {
+				t.Errorf("Since(%d) event %d holds item %d", tt.after, ev.ID, ev.Change.Item.ID)
+			}
+			ids = append(ids, ev.ID)
+		}
+		if len(ids) != len(tt.wantIDs) || (len(ids) > 0 && ids[0] != tt.wantIDs[0]) {
+			t.Errorf("Since(%d) = %v, want %v", tt.after, ids, tt.wantIDs)
+		}
+	}
+}
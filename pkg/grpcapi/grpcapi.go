@@ -0,0 +1,258 @@
+// Пакет grpcapi реализует gRPC-сервис объектов ItemService
+// поверх того же контракта БД, что и REST API.
+package grpcapi
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/rtemka/rbtest/domain"
+	"github.com/rtemka/rbtest/pkg/events"
+	"github.com/rtemka/rbtest/pkg/grpcapi/itempb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type item = domain.Item
+type repo = domain.Repository
+
+// requestTimeout ограничение времени вызова, если клиент
+// не задал свой срок.
+const requestTimeout = 5 * time.Second
+
+// Service сервис объектов. Реализует itempb.ItemServiceServer.
+type Service struct {
+	itempb.UnimplementedItemServiceServer
+
+	repo   repo
+	logger *slog.Logger
+	events *events.Feed // изменения для Watch, nil - Watch выключен
+}
+
+// Option настраивает сервис.
+type Option func(*Service)
+
+// WithEvents включает Watch по изменениям из feed.
+func WithEvents(feed *events.Feed) Option {
+	return func(s *Service) { s.events = feed }
+}
+
+// New возвращает сервис поверх repo.
+func New(repo repo, logger *slog.Logger, opts ...Option) *Service {
+	s := Service{repo: repo, logger: logger}
+	for _, opt := range opts {
+		opt(&s)
+	}
+	return &s
+}
+
+// withTimeout ограничивает вызов requestTimeout,
+// если у ctx еще нет срока.
+func withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, requestTimeout)
+}
+
+// GetItem возвращает объект по id.
+func (s *Service) GetItem(ctx context.Context, req *itempb.GetItemRequest) (*itempb.Item, error) {
+	if err := domain.ValidateID(req.GetId()); err != nil {
+		return nil, s.status(err, false)
+	}
+
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	it, err := s.repo.Item(ctx, req.GetId())
+	if err != nil {
+		return nil, s.status(err, false)
+	}
+	return toProto(it), nil
+}
+
+// ListItems возвращает страницу списка объектов.
+func (s *Service) ListItems(ctx context.Context, req *itempb.ListItemsRequest) (*itempb.ListItemsResponse, error) {
+	q, err := listQuery(req)
+	if err != nil {
+		return nil, s.status(err, false)
+	}
+
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	page, err := s.repo.ListItems(ctx, q)
+	if err != nil {
+		return nil, s.status(err, false)
+	}
+
+	resp := itempb.ListItemsResponse{Items: make([]*itempb.Item, len(page.Items))}
+	for i, it := range page.Items {
+		resp.Items[i] = toProto(it)
+	}
+	if page.Next != nil {
+		resp.NextPageToken = page.Next.Encode()
+	}
+	return &resp, nil
+}
+
+// listQuery переводит запрос списка в domain.ListQuery
+// по тем же правилам, что и параметры REST API.
+func listQuery(req *itempb.ListItemsRequest) (domain.ListQuery, error) {
+	q := domain.ListQuery{
+		Sort:         domain.SortByID,
+		Limit:        int(req.GetPageSize()),
+		NamePrefix:   req.GetNamePrefix(),
+		NameContains: req.GetNameContains(),
+	}
+
+	if q.Limit < 0 || q.Limit > domain.MaxListLimit {
+		return q, fieldError("page_size", "must be between 0 and %d", domain.MaxListLimit)
+	}
+
+	switch req.GetSort() {
+	case "", "id":
+	case "-id":
+		q.Desc = true
+	case "name":
+		q.Sort = domain.SortByName
+	case "-name":
+		q.Sort, q.Desc = domain.SortByName, true
+	default:
+		return q, fieldError("sort", "must be one of id, -id, name, -name")
+	}
+
+	if token := req.GetPageToken(); token != "" {
+		c, err := domain.DecodeCursor(token)
+		if err != nil {
+			return q, fieldError("page_token", "is not a token returned by the server")
+		}
+		q.After = &c
+	}
+	return q, nil
+}
+
+// CreateItem добавляет объект.
+func (s *Service) CreateItem(ctx context.Context, req *itempb.CreateItemRequest) (*itempb.Item, error) {
+	it := item{Name: req.GetName()}
+	if err := it.Validate(); err != nil {
+		return nil, s.status(err, false)
+	}
+
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	created, err := s.repo.CreateItem(ctx, it)
+	if err != nil {
+		return nil, s.status(err, false)
+	}
+	return toProto(created), nil
+}
+
+// UpdateItem обновляет объект. Несовпадение заданной версии
+// возвращается как FailedPrecondition (412 в REST), конфликт
+// при безусловном обновлении - как Aborted (409).
+func (s *Service) UpdateItem(ctx context.Context, req *itempb.UpdateItemRequest) (*itempb.Item, error) {
+	if req.GetItem() == nil {
+		return nil, s.status(fieldError("item", "is required"), false)
+	}
+	it := fromProto(req.GetItem())
+	if err := domain.ValidateID(it.ID); err != nil {
+		return nil, s.status(err, false)
+	}
+	if err := it.Validate(); err != nil {
+		return nil, s.status(err, false)
+	}
+
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	updated, err := s.repo.UpdateItem(ctx, it)
+	if err != nil {
+		return nil, s.status(err, it.Version != 0)
+	}
+	return toProto(updated), nil
+}
+
+// DeleteItem удаляет объект.
+func (s *Service) DeleteItem(ctx context.Context, req *itempb.DeleteItemRequest) (*itempb.DeleteItemResponse, error) {
+	if err := domain.ValidateID(req.GetId()); err != nil {
+		return nil, s.status(err, false)
+	}
+	if req.GetVersion() < 0 {
+		return nil, s.status(fieldError("version", "must not be negative"), false)
+	}
+
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	if err := s.repo.DeleteItem(ctx, req.GetId(), req.GetVersion()); err != nil {
+		return nil, s.status(err, req.GetVersion() != 0)
+	}
+	return &itempb.DeleteItemResponse{}, nil
+}
+
+// Watch отправляет изменения объектов. С after_event_id клиент
+// сначала получает пропущенные события, а если их уже нет
+// в буфере - событие OP_RESET. При остановке сервера вызов
+// завершается с кодом Unavailable.
+func (s *Service) Watch(req *itempb.WatchRequest, stream itempb.ItemService_WatchServer) error {
+	if s.events == nil {
+		return status.Error(codes.Unimplemented, "change feed is disabled")
+	}
+
+	notify, unsubscribe := s.events.Subscribe()
+	defer unsubscribe()
+
+	after := req.GetAfterEventId()
+	if after == 0 {
+		_, after, _ = s.events.Since(0)
+	}
+
+	for {
+		evs, last, ok := s.events.Since(after)
+		if !ok {
+			evs = []events.Event{{ID: last, Change: domain.Change{Op: domain.ChangeReset}}}
+		}
+		for _, ev := range evs {
+			if err := stream.Send(eventToProto(ev)); err != nil {
+				return err
+			}
+		}
+		after = last
+
+		select {
+		case <-stream.Context().Done():
+			return s.status(stream.Context().Err(), false)
+		case _, open := <-notify:
+			if !open {
+				return status.Error(codes.Unavailable, "server is shutting down")
+			}
+		}
+	}
+}
+
+func toProto(it item) *itempb.Item {
+	return &itempb.Item{Id: it.ID, Name: it.Name, Version: it.Version}
+}
+
+func fromProto(it *itempb.Item) item {
+	return item{ID: it.GetId(), Name: it.GetName(), Version: it.GetVersion()}
+}
+
+// eventOps типы изменений в событиях Watch.
+var eventOps = map[domain.ChangeOp]itempb.ItemEvent_Op{
+	domain.ChangeCreated: itempb.ItemEvent_OP_CREATED,
+	domain.ChangeUpdated: itempb.ItemEvent_OP_UPDATED,
+	domain.ChangeDeleted: itempb.ItemEvent_OP_DELETED,
+	domain.ChangeReset:   itempb.ItemEvent_OP_RESET,
+}
+
+func eventToProto(ev events.Event) *itempb.ItemEvent {
+	out := itempb.ItemEvent{EventId: ev.ID, Op: eventOps[ev.Change.Op]}
+	if ev.Change.Op != domain.ChangeReset {
+		out.Item = toProto(ev.Change.Item)
+	}
+	return &out
+}
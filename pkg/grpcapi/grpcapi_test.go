@@ -0,0 +1,269 @@
+package grpcapi
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rtemka/rbtest/domain"
+	"github.com/rtemka/rbtest/pkg/auth"
+	"github.com/rtemka/rbtest/pkg/events"
+	"github.com/rtemka/rbtest/pkg/grpcapi/itempb"
+	"github.com/rtemka/rbtest/pkg/logging"
+	"github.com/rtemka/rbtest/pkg/repo/memdb"
+	"github.com/rtemka/rbtest/pkg/repo/observe"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newClient запускает сервис на bufconn и возвращает клиента.
+func newClient(t *testing.T, svc *Service, opts ...grpc.ServerOption) itempb.ItemServiceClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(opts...)
+	itempb.RegisterItemServiceServer(srv, svc)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("NewClient() = err %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return itempb.NewItemServiceClient(conn)
+}
+
+func TestService(t *testing.T) {
+	client := newClient(t, New(memdb.New(), logging.Discard()))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, name := range []string{"b", "a", "c"} {
+		if _, err := client.CreateItem(ctx, &itempb.CreateItemRequest{Name: name}); err != nil {
+			t.Fatalf("CreateItem(%q) = err %v", name, err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		call func() error
+		want codes.Code
+	}{
+		{"get", func() error {
+			it, err := client.GetItem(ctx, &itempb.GetItemRequest{Id: 1})
+			if err == nil && (it.Name != "b" || it.Version != 1) {
+				t.Errorf("GetItem(1) = %v, want b version 1", it)
+			}
+			return err
+		}, codes.OK},
+		{"get missing", func() error {
+			_, err := client.GetItem(ctx, &itempb.GetItemRequest{Id: 42})
+			return err
+		}, codes.NotFound},
+		{"get bad id", func() error {
+			_, err := client.GetItem(ctx, &itempb.GetItemRequest{Id: -1})
+			return err
+		}, codes.InvalidArgument},
+		{"create invalid", func() error {
+			_, err := client.CreateItem(ctx, &itempb.CreateItemRequest{Name: " "})
+			return err
+		}, codes.InvalidArgument},
+		{"update", func() error {
+			it, err := client.UpdateItem(ctx, &itempb.UpdateItemRequest{Item: &itempb.Item{Id: 2, Name: "aa", Version: 1}})
+			if err == nil && it.Version != 2 {
+				t.Errorf("UpdateItem() version = %d, want 2", it.Version)
+			}
+			return err
+		}, codes.OK},
+		{"update stale version", func() error {
+			_, err := client.UpdateItem(ctx, &itempb.UpdateItemRequest{Item: &itempb.Item{Id: 2, Name: "ab", Version: 1}})
+			return err
+		}, codes.FailedPrecondition},
+		{"update without item", func() error {
+			_, err := client.UpdateItem(ctx, &itempb.UpdateItemRequest{})
+			return err
+		}, codes.InvalidArgument},
+		{"list bad sort", func() error {
+			_, err := client.ListItems(ctx, &itempb.ListItemsRequest{Sort: "version"})
+			return err
+		}, codes.InvalidArgument},
+		{"list bad token", func() error {
+			_, err := client.ListItems(ctx, &itempb.ListItemsRequest{PageToken: "!"})
+			return err
+		}, codes.InvalidArgument},
+		{"delete stale version", func() error {
+			_, err := client.DeleteItem(ctx, &itempb.DeleteItemRequest{Id: 3, Version: 5})
+			return err
+		}, codes.FailedPrecondition},
+		{"delete", func() error {
+			_, err := client.DeleteItem(ctx, &itempb.DeleteItemRequest{Id: 3, Version: 1})
+			return err
+		}, codes.OK},
+		{"watch disabled", func() error {
+			stream, err := client.Watch(ctx, &itempb.WatchRequest{})
+			if err != nil {
+				return err
+			}
+			_, err = stream.Recv()
+			return err
+		}, codes.Unimplemented},
+	}
+
+	for _, tt := range tests {
+		if got := status.Code(tt.call()); got != tt.want {
+			t.Errorf("%s: code = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	// постраничный список по имени
+	var names []string
+	req := itempb.ListItemsRequest{PageSize: 1, Sort: "name"}
+	for {
+		resp, err := client.ListItems(ctx, &req)
+		if err != nil {
+			t.Fatalf("ListItems() = err %v", err)
+		}
+		for _, it := range resp.Items {
+			names = append(names, it.Name)
+		}
+		if resp.NextPageToken == "" {
+			break
+		}
+		req.PageToken = resp.NextPageToken
+	}
+	if len(names) != 2 || names[0] != "aa" || names[1] != "b" {
+		t.Errorf("ListItems() names = %v, want [aa b]", names)
+	}
+}
+
+func TestServiceFieldViolations(t *testing.T) {
+	client := newClient(t, New(memdb.New(), logging.Discard()))
+
+	_, err := client.ListItems(context.Background(), &itempb.ListItemsRequest{PageSize: -1})
+	var fields []string
+	for _, d := range status.Convert(err).Details() {
+		if br, ok := d.(*errdetails.BadRequest); ok {
+			for _, v := range br.FieldViolations {
+				fields = append(fields, v.Field)
+			}
+		}
+	}
+	if len(fields) != 1 || fields[0] != "page_size" {
+		t.Errorf("ListItems(page_size -1) field violations = %v, want [page_size]", fields)
+	}
+}
+
+func TestServiceWatch(t *testing.T) {
+	feed := events.New(2)
+	client := newClient(t, New(memdb.New(), logging.Discard(), WithEvents(feed)))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	feed.Publish([]domain.Change{
+		{Op: domain.ChangeCreated, Item: item{ID: 1, Name: "one", Version: 1}},
+		{Op: domain.ChangeUpdated, Item: item{ID: 1, Name: "two", Version: 2}},
+	})
+	stream, err := client.Watch(ctx, &itempb.WatchRequest{AfterEventId: 1})
+	if err != nil {
+		t.Fatalf("Watch() = err %v", err)
+	}
+
+	// первое событие из буфера, следующее уже по подписке
+	recv := func(wantID uint64, wantOp itempb.ItemEvent_Op) {
+		t.Helper()
+		ev, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Recv() = err %v", err)
+		}
+		if ev.EventId != wantID || ev.Op != wantOp || ev.Item.GetId() != 1 {
+			t.Errorf("Recv() = %v, want event %d %s of item 1", ev, wantID, wantOp)
+		}
+	}
+	recv(2, itempb.ItemEvent_OP_UPDATED)
+	feed.Publish([]domain.Change{{Op: domain.ChangeDeleted, Item: item{ID: 1, Name: "two", Version: 2}}})
+	recv(3, itempb.ItemEvent_OP_DELETED)
+
+	// пропущенные события вытеснены из буфера
+	feed.Publish([]domain.Change{{Op: domain.ChangeCreated, Item: item{ID: 2}}, {Op: domain.ChangeCreated, Item: item{ID: 3}}})
+	resumed, err := client.Watch(ctx, &itempb.WatchRequest{AfterEventId: 1})
+	if err != nil {
+		t.Fatalf("Watch(after 1) = err %v", err)
+	}
+	if ev, err := resumed.Recv(); err != nil || ev.Op != itempb.ItemEvent_OP_RESET || ev.EventId != 5 {
+		t.Errorf("Recv() after gap = %v, err %v, want reset with id 5", ev, err)
+	}
+
+	// закрытие ленты завершает вызов
+	feed.Close()
+	for {
+		if _, err = stream.Recv(); err != nil {
+			break
+		}
+	}
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("Recv() after Close = err %v, want Unavailable", err)
+	}
+}
+
+func TestServiceAuth(t *testing.T) {
+	a, err := auth.New(auth.WithAPIKeys([]auth.APIKey{{Name: "ci", SHA256: auth.HashAPIKey("ci-key")}}))
+	if err != nil {
+		t.Fatalf("auth.New() = err %v", err)
+	}
+	// БД видит клиента, от имени которого сделан вызов
+	var principals []string
+	repo := observe.Wrap(memdb.New(item{ID: 1, Name: "one", Version: 1}), func(ctx context.Context, _ string, _ time.Duration, _ error) {
+		p, _ := auth.FromContext(ctx)
+		principals = append(principals, p.Subject)
+	})
+	feed := events.New(2)
+	feed.Publish([]domain.Change{
+		{Op: domain.ChangeCreated, Item: item{ID: 2, Name: "two", Version: 1}},
+		{Op: domain.ChangeUpdated, Item: item{ID: 2, Name: "two", Version: 2}},
+	})
+	client := newClient(t, New(repo, logging.Discard(), WithEvents(feed)),
+		grpc.ChainUnaryInterceptor(UnaryAuth(a)), grpc.ChainStreamInterceptor(StreamAuth(a)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	authed := metadata.AppendToOutgoingContext(ctx, "x-api-key", "ci-key")
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want codes.Code
+	}{
+		{name: "no credentials", ctx: ctx, want: codes.Unauthenticated},
+		{name: "unknown key", ctx: metadata.AppendToOutgoingContext(ctx, "authorization", "ApiKey guess"), want: codes.Unauthenticated},
+		{name: "api key", ctx: authed, want: codes.OK},
+	}
+	for _, tt := range tests {
+		_, err := client.GetItem(tt.ctx, &itempb.GetItemRequest{Id: 1})
+		if got := status.Code(err); got != tt.want {
+			t.Errorf("GetItem(%s) = %s, want %s", tt.name, got, tt.want)
+		}
+
+		// событие из буфера приходит сразу после подписки
+		stream, err := client.Watch(tt.ctx, &itempb.WatchRequest{AfterEventId: 1})
+		if err == nil {
+			_, err = stream.Recv()
+		}
+		if got := status.Code(err); got != tt.want {
+			t.Errorf("Watch(%s) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	if len(principals) != 1 || principals[0] != "ci" {
+		t.Errorf("repository principals = %v, want [ci]", principals)
+	}
+}
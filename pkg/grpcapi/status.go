@@ -0,0 +1,58 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rtemka/rbtest/domain"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fieldError ошибка в поле запроса.
+func fieldError(field, format string, args ...any) error {
+	return &domain.ValidationError{Fields: []domain.FieldError{
+		{Field: field, Message: fmt.Sprintf(format, args...)},
+	}}
+}
+
+// status переводит ошибку в статус gRPC по тем же правилам,
+// что и REST API переводит ее в HTTP-статус. Если вызов был
+// условным (задана версия), конфликт версий означает
+// несработавшее предусловие. Внутренние ошибки логируются,
+// а клиенту уходит только код.
+func (s *Service) status(err error, conditional bool) error {
+	var verr *domain.ValidationError
+	switch {
+	case errors.As(err, &verr):
+		st := status.New(codes.InvalidArgument, verr.Error())
+		br := errdetails.BadRequest{}
+		for _, f := range verr.Fields {
+			br.FieldViolations = append(br.FieldViolations,
+				&errdetails.BadRequest_FieldViolation{Field: f.Field, Description: f.Message})
+		}
+		if d, err := st.WithDetails(&br); err == nil {
+			st = d
+		}
+		return st.Err()
+	case errors.Is(err, domain.ErrInvalid):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, domain.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, domain.ErrConflict) && conditional:
+		return status.Error(codes.FailedPrecondition, "item version does not match")
+	case errors.Is(err, domain.ErrConflict):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, "request timed out")
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, "request canceled")
+	case errors.Is(err, domain.ErrUnavailable):
+		return status.Error(codes.Unavailable, "storage unavailable")
+	}
+
+	s.logger.Error("call failed", "err", err)
+	return status.Error(codes.Internal, "internal server error")
+}
@@ -0,0 +1,126 @@
+// Пакет health собирает проверки зависимостей приложения
+// для проб живости и готовности.
+package health
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Состояние приложения или проверки.
+const (
+	StatusOK           = "ok"
+	StatusFail         = "fail"
+	StatusShuttingDown = "shutting_down"
+)
+
+// Check проверяет зависимость, nil означает, что
+// зависимость в порядке. Проверка должна укладываться
+// в срок ctx.
+type Check func(ctx context.Context) error
+
+// Result результат одной проверки.
+type Result struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Report результат проверки готовности.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks,omitempty"`
+}
+
+// OK сообщает, что приложение готово принимать запросы.
+func (r Report) OK() bool {
+	return r.Status == StatusOK
+}
+
+// Checker хранит проверки зависимостей. Безопасен
+// для одновременного использования.
+type Checker struct {
+	mu       sync.Mutex
+	checks   map[string]Check
+	draining atomic.Bool
+	timeout  time.Duration
+}
+
+// Option настраивает Checker.
+type Option func(*Checker)
+
+// WithTimeout ограничивает время каждой проверки,
+// по умолчанию 2 секунды.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Checker) { c.timeout = d }
+}
+
+// New возвращает Checker без проверок.
+func New(opts ...Option) *Checker {
+	c := Checker{
+		checks:  make(map[string]Check),
+		timeout: 2 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return &c
+}
+
+// Register добавляет проверку зависимости name, проверка
+// с тем же именем заменяется.
+func (c *Checker) Register(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks[name] = check
+}
+
+// Drain отмечает начало остановки приложения: с этого
+// момента оно не готово принимать запросы.
+func (c *Checker) Drain() {
+	c.draining.Store(true)
+}
+
+// Ready выполняет все проверки одновременно и сообщает,
+// готово ли приложение принимать запросы. Во время
+// остановки проверки не выполняются.
+func (c *Checker) Ready(ctx context.Context) Report {
+	if c.draining.Load() {
+		return Report{Status: StatusShuttingDown}
+	}
+
+	c.mu.Lock()
+	checks := make(map[string]Check, len(c.checks))
+	for name, check := range c.checks {
+		checks[name] = check
+	}
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	r := Report{Status: StatusOK, Checks: make(map[string]Result, len(checks))}
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			res := Result{Status: StatusOK}
+			if err := check(ctx); err != nil {
+				res = Result{Status: StatusFail, Error: err.Error()}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			r.Checks[name] = res
+			if res.Status != StatusOK {
+				r.Status = StatusFail
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	return r
+}
@@ -0,0 +1,71 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChecker(t *testing.T) {
+	ok := func(context.Context) error { return nil }
+	down := func(context.Context) error { return errors.New("connection refused") }
+	hang := func(ctx context.Context) error { <-ctx.Done(); return ctx.Err() }
+
+	tests := []struct {
+		name   string
+		checks map[string]Check
+		drain  bool
+		want   Report
+	}{
+		{
+			name: "no checks",
+			want: Report{Status: StatusOK, Checks: map[string]Result{}},
+		},
+		{
+			name:   "all ok",
+			checks: map[string]Check{"db": ok, "cache": ok},
+			want: Report{Status: StatusOK, Checks: map[string]Result{
+				"db": {Status: StatusOK}, "cache": {Status: StatusOK}}},
+		},
+		{
+			name:   "one failed",
+			checks: map[string]Check{"db": down, "cache": ok},
+			want: Report{Status: StatusFail, Checks: map[string]Result{
+				"db": {Status: StatusFail, Error: "connection refused"}, "cache": {Status: StatusOK}}},
+		},
+		{
+			name:   "timeout",
+			checks: map[string]Check{"db": hang},
+			want: Report{Status: StatusFail, Checks: map[string]Result{
+				"db": {Status: StatusFail, Error: context.DeadlineExceeded.Error()}}},
+		},
+		{
+			name:   "draining",
+			checks: map[string]Check{"db": ok},
+			drain:  true,
+			want:   Report{Status: StatusShuttingDown},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(WithTimeout(10 * time.Millisecond))
+			for name, check := range tt.checks {
+				c.Register(name, check)
+			}
+			if tt.drain {
+				c.Drain()
+			}
+
+			got := c.Ready(context.Background())
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Ready() = %+v, want %+v", got, tt.want)
+			}
+			if got.OK() != (tt.want.Status == StatusOK) {
+				t.Errorf("Ready().OK() = %t, want %t", got.OK(), !got.OK())
+			}
+		})
+	}
+}
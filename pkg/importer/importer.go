@@ -0,0 +1,232 @@
+// Пакет importer загружает объекты из файлов JSON, NDJSON
+// и CSV в любую БД, реализующую domain.Repository. Им
+// пользуются и REST API, и команда testapp import.
+package importer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/rtemka/rbtest/domain"
+)
+
+type item = domain.Item
+
+// Format формат входных данных.
+type Format string
+
+const (
+	FormatJSON   Format = "json"   // JSON-массив объектов
+	FormatNDJSON Format = "ndjson" // по одному JSON-объекту на строку
+	FormatCSV    Format = "csv"    // заголовок с колонками id, name, version
+)
+
+// FormatOf определяет формат по расширению файла.
+func FormatOf(path string) (Format, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return FormatJSON, nil
+	case ".ndjson", ".jsonl":
+		return FormatNDJSON, nil
+	case ".csv":
+		return FormatCSV, nil
+	}
+	return "", fmt.Errorf("importer: unknown format of file %q", path)
+}
+
+// Mode режим загрузки.
+type Mode string
+
+const (
+	ModeUpsert  Mode = "upsert"  // объекты с существующим id обновляются
+	ModeInsert  Mode = "insert"  // существующий id - ошибка записи
+	ModeReplace Mode = "replace" // как upsert, плюс удаление объектов не из файла
+)
+
+// ParseMode разбирает режим загрузки, пустая строка - ModeUpsert.
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(s); m {
+	case "":
+		return ModeUpsert, nil
+	case ModeUpsert, ModeInsert, ModeReplace:
+		return m, nil
+	}
+	return "", fmt.Errorf("importer: unknown mode %q", s)
+}
+
+// MaxErrors сколько ошибок попадает в отчет, остальные
+// только подсчитываются.
+const MaxErrors = 1000
+
+// Options параметры загрузки.
+type Options struct {
+	Format Format
+	Mode   Mode
+	DryRun bool // только проверить файл и посчитать изменения
+}
+
+// LineError ошибка в записи файла. Line - номер строки,
+// с которой начинается запись, 0 - ошибка не относится
+// к конкретной записи.
+type LineError struct {
+	Line    int    `json:"line"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e LineError) String() string {
+	if e.Field == "" {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+	}
+	return fmt.Sprintf("line %d: '%s' %s", e.Line, e.Field, e.Message)
+}
+
+// Report итог загрузки. В режиме DryRun счетчики показывают,
+// сколько объектов было бы создано, обновлено и удалено.
+type Report struct {
+	Mode    Mode        `json:"mode"`
+	DryRun  bool        `json:"dry_run"`
+	Records int         `json:"records"` // прочитано записей
+	Created int         `json:"created"`
+	Updated int         `json:"updated"`
+	Deleted int         `json:"deleted"`
+	Errors  []LineError `json:"errors,omitempty"`
+	Omitted int         `json:"errors_omitted,omitempty"` // ошибки сверх MaxErrors
+}
+
+// OK сообщает, прошла ли загрузка без ошибок.
+func (r *Report) OK() bool { return len(r.Errors) == 0 }
+
+// fail добавляет ошибку в отчет.
+func (r *Report) fail(line int, field, format string, args ...any) {
+	if len(r.Errors) >= MaxErrors {
+		r.Omitted++
+		return
+	}
+	r.Errors = append(r.Errors, LineError{Line: line, Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// entry объект из файла вместе с номером строки.
+type entry struct {
+	line int
+	item item
+}
+
+// Import читает объекты из r и записывает их в repo.
+//
+// Сначала разбирается и проверяется весь файл: если в нем есть
+// ошибки, ничего не записывается. Затем объекты записываются
+// пакетами по domain.MaxBatchSize: без id - создаются с новым id,
+// с id - создаются с этим id или, кроме режима ModeInsert,
+// обновляются. Версия из файла не используется. Ошибки записи
+// отдельных объектов попадают в отчет и не прерывают загрузку.
+//
+// В режиме ModeReplace после записи удаляются объекты, которых
+// нет в файле. Загрузка не атомарна: другие клиенты видят
+// промежуточное состояние.
+//
+// Ошибка возвращается, только если не удалось прочитать r или
+// обратиться к БД, отчет при этом содержит уже сделанное.
+func Import(ctx context.Context, repo domain.Repository, r io.Reader, opts Options) (*Report, error) {
+	if opts.Mode == "" {
+		opts.Mode = ModeUpsert
+	}
+	rep := &Report{Mode: opts.Mode, DryRun: opts.DryRun}
+
+	entries, err := parse(rep, r, opts.Format)
+	if err != nil || !rep.OK() {
+		return rep, err
+	}
+
+	// существующие id нужны, чтобы предсказать результат
+	// без записи и найти объекты для удаления
+	var existing map[int64]bool
+	if opts.DryRun || opts.Mode == ModeReplace {
+		existing = make(map[int64]bool)
+		err := domain.Iterate(ctx, repo, func(it item) error {
+			existing[it.ID] = true
+			return nil
+		})
+		if err != nil {
+			return rep, err
+		}
+	}
+
+	ops := make([]domain.BatchOperation, 0, len(entries))
+	lines := make([]int, 0, len(entries))
+	for _, e := range entries {
+		op := domain.BatchPut
+		if e.item.ID == 0 || opts.Mode == ModeInsert {
+			op = domain.BatchCreate
+		}
+		ops = append(ops, domain.BatchOperation{Op: op, Item: e.item})
+		lines = append(lines, e.line)
+	}
+	if opts.Mode == ModeReplace {
+		keep := make(map[int64]bool, len(entries))
+		for _, e := range entries {
+			keep[e.item.ID] = true
+		}
+		for id := range existing {
+			if !keep[id] {
+				ops = append(ops, domain.BatchOperation{Op: domain.BatchDelete, Item: item{ID: id}})
+				lines = append(lines, 0)
+			}
+		}
+	}
+
+	if opts.DryRun {
+		predict(rep, ops, lines, existing)
+		return rep, nil
+	}
+
+	for start := 0; start < len(ops); start += domain.MaxBatchSize {
+		end := min(start+domain.MaxBatchSize, len(ops))
+		results, err := repo.Batch(ctx, ops[start:end], false)
+		if err != nil {
+			return rep, err
+		}
+		for i, res := range results {
+			count(rep, ops[start+i], lines[start+i], res)
+		}
+	}
+	return rep, nil
+}
+
+// predict заполняет отчет пробной загрузки по существующим id.
+func predict(rep *Report, ops []domain.BatchOperation, lines []int, existing map[int64]bool) {
+	for i, op := range ops {
+		switch {
+		case op.Op == domain.BatchDelete:
+			rep.Deleted++
+		case op.Item.ID == 0 || !existing[op.Item.ID]:
+			rep.Created++
+		case op.Op == domain.BatchPut:
+			rep.Updated++
+		default:
+			rep.fail(lines[i], "id", "already exists")
+		}
+	}
+}
+
+// count учитывает в отчете результат одной операции.
+func count(rep *Report, op domain.BatchOperation, line int, res domain.BatchResult) {
+	switch {
+	case op.Op == domain.BatchDelete && errors.Is(res.Err, domain.ErrNotFound):
+		// объект уже удален кем-то другим
+	case op.Op == domain.BatchCreate && op.Item.ID != 0 && errors.Is(res.Err, domain.ErrConflict):
+		rep.fail(line, "id", "already exists")
+	case res.Err != nil:
+		rep.fail(line, "", "%v", res.Err)
+	case op.Op == domain.BatchDelete:
+		rep.Deleted++
+	case res.Created:
+		rep.Created++
+	default:
+		rep.Updated++
+	}
+}
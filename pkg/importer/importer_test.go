@@ -0,0 +1,166 @@
+package importer
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/rtemka/rbtest/domain"
+	"github.com/rtemka/rbtest/pkg/repo/memdb"
+)
+
+func TestImport(t *testing.T) {
+	// в БД перед загрузкой объекты 1 "a" и 2 "b"
+	tests := []struct {
+		name       string
+		input      string
+		opts       Options
+		wantReport Report
+		wantItems  []item // nil - не проверять
+	}{
+		{
+			name: "jsonUpsert",
+			input: `[
+				{"id": 1, "name": "a2", "version": 7},
+				{"name": "new"},
+				{"id": 10, "name": "ten"}
+			]`,
+			opts:       Options{Format: FormatJSON},
+			wantReport: Report{Mode: ModeUpsert, Records: 3, Created: 2, Updated: 1},
+			wantItems: []item{
+				{ID: 1, Name: "a2", Version: 2}, {ID: 2, Name: "b", Version: 1},
+				{ID: 3, Name: "new", Version: 1}, {ID: 10, Name: "ten", Version: 1},
+			},
+		},
+		{
+			name:  "ndjsonInsert",
+			input: "{\"id\": 2, \"name\": \"b2\"}\n\n{\"id\": 5, \"name\": \"five\"}\n",
+			opts:  Options{Format: FormatNDJSON, Mode: ModeInsert},
+			wantReport: Report{Mode: ModeInsert, Records: 2, Created: 1,
+				Errors: []LineError{{Line: 1, Field: "id", Message: "already exists"}}},
+			wantItems: []item{
+				{ID: 1, Name: "a", Version: 1}, {ID: 2, Name: "b", Version: 1},
+				{ID: 5, Name: "five", Version: 1},
+			},
+		},
+		{
+			name:       "csvReplace",
+			input:      "name,id\n\"b, 2\",2\nc,\n",
+			opts:       Options{Format: FormatCSV, Mode: ModeReplace},
+			wantReport: Report{Mode: ModeReplace, Records: 2, Created: 1, Updated: 1, Deleted: 1},
+			wantItems:  []item{{ID: 2, Name: "b, 2", Version: 2}, {ID: 3, Name: "c", Version: 1}},
+		},
+		{
+			name:       "dryRun",
+			input:      "id,name\n1,a2\n,new\n",
+			opts:       Options{Format: FormatCSV, Mode: ModeReplace, DryRun: true},
+			wantReport: Report{Mode: ModeReplace, DryRun: true, Records: 2, Created: 1, Updated: 1, Deleted: 1},
+			wantItems:  []item{{ID: 1, Name: "a", Version: 1}, {ID: 2, Name: "b", Version: 1}},
+		},
+		{
+			name: "invalidJSON",
+			input: `[
+				{"name": ""},
+				{"id": "x", "name": "a"},
+				{"name": "ok", "color": "red"},
+				{"id": 7, "name": "a"},
+				{"id": 7, "name": "b"}
+			]`,
+			opts: Options{Format: FormatJSON},
+			wantReport: Report{Mode: ModeUpsert, Records: 5, Errors: []LineError{
+				{Line: 2, Field: "name", Message: "is required"},
+				{Line: 3, Field: "id", Message: "must be of type int64"},
+				{Line: 4, Field: "color", Message: "is not allowed"},
+				{Line: 6, Field: "id", Message: "duplicates line 5"},
+			}},
+			wantItems: []item{{ID: 1, Name: "a", Version: 1}, {ID: 2, Name: "b", Version: 1}},
+		},
+		{
+			name:  "syntaxNDJSON",
+			input: "{\"name\": \"a\"}\n{\"name\": \n{\"name\": \" b\"}\n",
+			opts:  Options{Format: FormatNDJSON},
+			wantReport: Report{Mode: ModeUpsert, Records: 3, Errors: []LineError{
+				{Line: 2, Message: "must be a valid JSON object"},
+				{Line: 3, Field: "name", Message: "must not start or end with whitespace"},
+			}},
+		},
+		{
+			name:  "badCSVHeader",
+			input: "id,title\n1,a\n",
+			opts:  Options{Format: FormatCSV},
+			wantReport: Report{Mode: ModeUpsert, Errors: []LineError{
+				{Line: 1, Field: "title", Message: "is not allowed"},
+				{Line: 1, Field: "name", Message: "column is required"},
+			}},
+		},
+		{
+			name:  "notArray",
+			input: `{"name": "a"}`,
+			opts:  Options{Format: FormatJSON},
+			wantReport: Report{Mode: ModeUpsert, Errors: []LineError{
+				{Line: 1, Message: "input must be a JSON array"},
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			repo := memdb.New(item{ID: 1, Name: "a", Version: 1}, item{ID: 2, Name: "b", Version: 1})
+
+			rep, err := Import(ctx, repo, strings.NewReader(tt.input), tt.opts)
+			if err != nil {
+				t.Fatalf("Import() = err %v", err)
+			}
+			if !reflect.DeepEqual(*rep, tt.wantReport) {
+				t.Errorf("Import() = %+v, want %+v", *rep, tt.wantReport)
+			}
+			if tt.wantItems == nil {
+				return
+			}
+
+			got, err := repo.Items(ctx)
+			if err != nil {
+				t.Fatalf("Items() = err %v", err)
+			}
+			sort.Slice(got, func(i, j int) bool { return got[i].ID < got[j].ID })
+			if !reflect.DeepEqual(got, tt.wantItems) {
+				t.Errorf("Items() = %v, want %v", got, tt.wantItems)
+			}
+		})
+	}
+}
+
+// legacyRepo имитирует mongo с документом, сохраненным без
+// версии: первое обновление такого документа дает версию 1.
+type legacyRepo struct {
+	*memdb.MemDB
+}
+
+func (r legacyRepo) Batch(ctx context.Context, ops []domain.BatchOperation, atomic bool) ([]domain.BatchResult, error) {
+	results, err := r.MemDB.Batch(ctx, ops, atomic)
+	for i := range results {
+		if results[i].Err == nil && !results[i].Created {
+			results[i].Item.Version--
+		}
+	}
+	return results, err
+}
+
+// TestImportLegacyItem проверяет, что обновление документа,
+// сохраненного без версии, считается обновлением, хотя дает
+// версию 1.
+func TestImportLegacyItem(t *testing.T) {
+	ctx := context.Background()
+	repo := legacyRepo{memdb.New(item{ID: 1, Name: "a"})}
+
+	rep, err := Import(ctx, repo, strings.NewReader(`[{"id": 1, "name": "a2"}, {"name": "b"}]`), Options{Format: FormatJSON})
+	if err != nil {
+		t.Fatalf("Import() = err %v", err)
+	}
+	if want := (Report{Mode: ModeUpsert, Records: 2, Created: 1, Updated: 1}); !reflect.DeepEqual(*rep, want) {
+		t.Errorf("Import() = %+v, want %+v", *rep, want)
+	}
+}
@@ -0,0 +1,216 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/rtemka/rbtest/domain"
+)
+
+// maxLineSize ограничение длины строки NDJSON.
+const maxLineSize = 1 << 20
+
+// parse читает записи файла в формате f. Ошибки в записях
+// попадают в отчет, ошибка возвращается только при сбое чтения.
+func parse(rep *Report, r io.Reader, f Format) ([]entry, error) {
+	p := parser{rep: rep, seen: make(map[int64]int)}
+	var err error
+	switch f {
+	case FormatJSON:
+		err = p.json(r)
+	case FormatNDJSON:
+		err = p.ndjson(r)
+	case FormatCSV:
+		err = p.csv(r)
+	default:
+		return nil, fmt.Errorf("importer: unknown format %q", f)
+	}
+	return p.entries, err
+}
+
+// parser накапливает записи и проверяет каждую из них.
+type parser struct {
+	rep     *Report
+	entries []entry
+	seen    map[int64]int // строка, на которой встретился id
+}
+
+// add проверяет объект из строки line и добавляет его.
+func (p *parser) add(line int, it item) {
+	p.rep.Records++
+
+	// версия из файла не используется: объекты обычно
+	// переносятся из другой БД со своей историей версий
+	it.Version = 0
+
+	var verr *domain.ValidationError
+	if err := it.Validate(); errors.As(err, &verr) {
+		for _, f := range verr.Fields {
+			p.rep.fail(line, f.Field, "%s", f.Message)
+		}
+		return
+	}
+	if it.ID != 0 {
+		if first, ok := p.seen[it.ID]; ok {
+			p.rep.fail(line, "id", "duplicates line %d", first)
+			return
+		}
+		p.seen[it.ID] = line
+	}
+	p.entries = append(p.entries, entry{line: line, item: it})
+}
+
+// decode строго разбирает JSON-объект из строки line.
+func (p *parser) decode(line int, data []byte) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	var it item
+	err := dec.Decode(&it)
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+		p.add(line, it)
+		return
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		p.rep.fail(line, typeErr.Field, "must be of type %s", typeErr.Type)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		p.rep.fail(line, field, "is not allowed")
+	default:
+		p.rep.fail(line, "", "must be a valid JSON object")
+	}
+	p.rep.Records++
+}
+
+// json читает JSON-массив. Массив читается в память целиком,
+// чтобы по смещению объекта найти номер его строки.
+func (p *parser) json(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	lineAt := func(offset int64) int {
+		return 1 + bytes.Count(data[:offset], []byte("\n"))
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		p.rep.fail(lineAt(dec.InputOffset()), "", "input must be a JSON array")
+		return nil
+	}
+	for dec.More() {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			// после синтаксической ошибки продолжать разбор нельзя
+			offset := dec.InputOffset()
+			var serr *json.SyntaxError
+			if errors.As(err, &serr) {
+				offset = serr.Offset
+			}
+			p.rep.fail(lineAt(min(offset, int64(len(data)))), "", "invalid JSON: %v", err)
+			return nil
+		}
+		p.decode(lineAt(dec.InputOffset()-int64(len(raw))), raw)
+	}
+	if _, err := dec.Token(); err != nil {
+		p.rep.fail(lineAt(int64(len(data))), "", "invalid JSON: %v", err)
+	}
+	return nil
+}
+
+// ndjson читает по объекту из каждой непустой строки.
+func (p *parser) ndjson(r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64<<10), maxLineSize)
+
+	line := 0
+	for sc.Scan() {
+		line++
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		p.decode(line, sc.Bytes())
+	}
+	if errors.Is(sc.Err(), bufio.ErrTooLong) {
+		p.rep.fail(line+1, "", "line must not exceed %d bytes", maxLineSize)
+		return nil
+	}
+	return sc.Err()
+}
+
+// csv читает CSV с заголовком. Колонка name обязательна,
+// id и version - нет, другие колонки не допускаются.
+func (p *parser) csv(r io.Reader) error {
+	cr := csv.NewReader(r)
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return p.csvError(err)
+	}
+
+	cols := map[string]int{"id": -1, "name": -1, "version": -1}
+	for i, name := range header {
+		name = strings.TrimSpace(strings.ToLower(name))
+		switch j, ok := cols[name]; {
+		case !ok:
+			p.rep.fail(1, name, "is not allowed")
+		case j >= 0:
+			p.rep.fail(1, name, "is duplicated")
+		default:
+			cols[name] = i
+		}
+	}
+	if cols["name"] < 0 {
+		p.rep.fail(1, "name", "column is required")
+	}
+	if !p.rep.OK() {
+		return nil
+	}
+
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if err := p.csvError(err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		line, _ := cr.FieldPos(0)
+		it := item{Name: rec[cols["name"]]}
+		if i := cols["id"]; i >= 0 && rec[i] != "" {
+			if it.ID, err = strconv.ParseInt(rec[i], 10, 64); err != nil {
+				p.rep.Records++
+				p.rep.fail(line, "id", "must be an integer")
+				continue
+			}
+		}
+		p.add(line, it)
+	}
+}
+
+// csvError добавляет в отчет ошибку формата CSV
+// и возвращает ошибки чтения.
+func (p *parser) csvError(err error) error {
+	var perr *csv.ParseError
+	if !errors.As(err, &perr) {
+		return err
+	}
+	p.rep.Records++
+	p.rep.fail(perr.StartLine, "", "%v", perr.Err)
+	return nil
+}
@@ -0,0 +1,133 @@
+// Пакет logging настраивает структурированный журнал
+// приложения (log/slog в формате JSON) и передает id запроса
+// через контекст во все записи, сделанные в его рамках.
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/rtemka/rbtest/domain"
+	"github.com/rtemka/rbtest/pkg/auth"
+	"github.com/rtemka/rbtest/pkg/repo/observe"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestIDKey имя атрибута id запроса в записях журнала.
+const RequestIDKey = "request_id"
+
+// PrincipalKey имя атрибута клиента, прошедшего
+// проверку подлинности, в записях журнала.
+const PrincipalKey = "principal"
+
+// Имена атрибутов трассировки в записях журнала.
+const (
+	TraceIDKey = "trace_id"
+	SpanIDKey  = "span_id"
+)
+
+type requestIDKey struct{}
+
+// WithRequestID возвращает контекст с id запроса.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID возвращает id запроса из контекста
+// или пустую строку.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// New возвращает журнал в формате JSON с записями от level
+// и выше. Записи, сделанные с контекстом запроса
+// (InfoContext и т.п.), получают атрибут request_id, клиента
+// principal, а если в контексте есть спан трассировки -
+// trace_id и span_id.
+func New(w io.Writer, level slog.Leveler) *slog.Logger {
+	return slog.New(contextHandler{slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})})
+}
+
+// ParseLevel разбирает уровень журнала: debug, info, warn
+// или error. Пустая строка означает info.
+func ParseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	if s == "" {
+		return l, nil
+	}
+	if err := l.UnmarshalText([]byte(s)); err != nil {
+		return l, fmt.Errorf("unknown log level %q, want debug, info, warn or error", s)
+	}
+	return l, nil
+}
+
+// Discard возвращает журнал, который ничего не пишет.
+func Discard() *slog.Logger {
+	return slog.New(discardHandler{})
+}
+
+// contextHandler добавляет к записи id запроса, клиента
+// и трассировки из контекста.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String(RequestIDKey, id))
+	}
+	if p, ok := auth.FromContext(ctx); ok {
+		r.AddAttrs(slog.String(PrincipalKey, p.Subject))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String(TraceIDKey, sc.TraceID().String()), slog.String(SpanIDKey, sc.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// Repository возвращает обертку над r, которая пишет каждый
+// вызов БД в журнал на уровне debug, а вызовы, на которые
+// хранилище не ответило, - на уровне warn. Записи получают
+// id запроса, в рамках которого сделан вызов.
+func Repository(r domain.Repository, logger *slog.Logger) domain.Repository {
+	return observe.Wrap(r, func(ctx context.Context, op string, d time.Duration, err error) {
+		level := slog.LevelDebug
+		if storageError(err) {
+			level = slog.LevelWarn
+		}
+		if !logger.Enabled(ctx, level) {
+			return
+		}
+		attrs := []slog.Attr{slog.String("op", op), slog.Duration("latency", d)}
+		if err != nil {
+			attrs = append(attrs, slog.String("err", err.Error()))
+		}
+		logger.LogAttrs(ctx, level, "repository call", attrs...)
+	})
+}
+
+// storageError сообщает, что хранилище недоступно
+// или не ответило вовремя.
+func storageError(err error) bool {
+	return errors.Is(err, domain.ErrUnavailable) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,87 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/rtemka/rbtest/domain"
+	"github.com/rtemka/rbtest/pkg/auth"
+	"github.com/rtemka/rbtest/pkg/repo/memdb"
+)
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    slog.Level
+		wantErr bool
+	}{
+		{"", slog.LevelInfo, false},
+		{"debug", slog.LevelDebug, false},
+		{"WARN", slog.LevelWarn, false},
+		{"error", slog.LevelError, false},
+		{"verbose", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseLevel(tt.in)
+		if (err != nil) != tt.wantErr || (!tt.wantErr && got != tt.want) {
+			t.Errorf("ParseLevel(%q) = %v, err %v, want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// records разбирает записи журнала в формате JSON.
+func records(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var out []map[string]any
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var rec map[string]any
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatalf("decode log record = err %v", err)
+		}
+		out = append(out, rec)
+	}
+	return out
+}
+
+func TestRepository(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, slog.LevelDebug).With("component", "repo")
+	r := Repository(memdb.New(), logger)
+
+	ctx := WithRequestID(context.Background(), "req-1")
+	ctx = auth.WithPrincipal(ctx, auth.Principal{Subject: "ci", Method: auth.MethodAPIKey})
+	if _, err := r.Item(ctx, 1); err == nil {
+		t.Fatal("Item(1) = nil error, want ErrNotFound")
+	}
+	if _, err := r.CreateItem(context.Background(), domain.Item{Name: "a"}); err != nil {
+		t.Fatalf("CreateItem() = err %v", err)
+	}
+
+	recs := records(t, &buf)
+	if len(recs) != 2 {
+		t.Fatalf("got %d log records, want 2", len(recs))
+	}
+	want := []map[string]any{
+		{"level": "DEBUG", "op": "item", "request_id": "req-1", "principal": "ci", "component": "repo", "err": domain.ErrNotFound.Error()},
+		{"level": "DEBUG", "op": "create_item", "request_id": nil, "principal": nil, "err": nil},
+	}
+	for i, w := range want {
+		for k, v := range w {
+			if recs[i][k] != v {
+				t.Errorf("record %d %s = %v, want %v", i, k, recs[i][k], v)
+			}
+		}
+	}
+
+	// на уровне info вызовы без ошибок хранилища не пишутся
+	buf.Reset()
+	r = Repository(memdb.New(), New(&buf, slog.LevelInfo))
+	_, _ = r.Item(ctx, 1)
+	if buf.Len() != 0 {
+		t.Errorf("info logger wrote %q, want nothing", buf.String())
+	}
+}
@@ -0,0 +1,120 @@
+// Пакет metrics собирает метрики приложения в формате Prometheus:
+// запросы HTTP, состояние кэша и вызовы БД.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rtemka/rbtest/pkg/cache"
+)
+
+// namespace префикс имен метрик приложения.
+const namespace = "rbtest"
+
+// Metrics метрики приложения. Хранит собственный реестр,
+// чтобы метрики разных экземпляров (например, в тестах)
+// не пересекались.
+type Metrics struct {
+	reg *prometheus.Registry
+
+	requests *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+
+	refresh         prometheus.Histogram
+	refreshFailures prometheus.Counter
+
+	repoLatency *prometheus.HistogramVec
+	repoErrors  *prometheus.CounterVec
+}
+
+// New возвращает метрики с зарегистрированными
+// метриками процесса и среды Go.
+func New() *Metrics {
+	m := Metrics{
+		reg: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "http", Name: "requests_total",
+			Help: "HTTP requests by route, method and status.",
+		}, []string{"route", "method", "status"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "http", Name: "request_duration_seconds",
+			Help:    "HTTP request latency by route, method and status.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+		refresh: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "cache", Name: "refresh_duration_seconds",
+			Help:    "Duration of full cache reloads from the database.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		refreshFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "cache", Name: "refresh_failures_total",
+			Help: "Failed full cache reloads from the database.",
+		}),
+		repoLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "repo", Name: "operation_duration_seconds",
+			Help:    "Database call latency by operation.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"op"}),
+		repoErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "repo", Name: "operation_errors_total",
+			Help: "Failed database calls by operation and error kind.",
+		}, []string{"op", "error"}),
+	}
+
+	m.reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests, m.latency,
+		m.refresh, m.refreshFailures,
+		m.repoLatency, m.repoErrors,
+	)
+	return &m
+}
+
+// Handler отдает метрики в текстовом формате Prometheus.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.reg, promhttp.HandlerOpts{Registry: m.reg})
+}
+
+// ObserveRequest учитывает обработанный запрос HTTP.
+// route - шаблон пути маршрута, а не сам путь, иначе
+// у метрики было бы по ряду на каждый id.
+func (m *Metrics) ObserveRequest(route, method string, status int, d time.Duration) {
+	code := strconv.Itoa(status)
+	m.requests.WithLabelValues(route, method, code).Inc()
+	m.latency.WithLabelValues(route, method, code).Observe(d.Seconds())
+}
+
+// ObserveRefresh учитывает загрузку кэша из БД.
+// Подходит для cache.WithRefreshHook.
+func (m *Metrics) ObserveRefresh(d time.Duration, err error) {
+	m.refresh.Observe(d.Seconds())
+	if err != nil {
+		m.refreshFailures.Inc()
+	}
+}
+
+// RegisterCache добавляет метрики размера кэша и возраста
+// его снимка. Значения читаются из c в момент сбора метрик.
+func (m *Metrics) RegisterCache(c *cache.Cache) {
+	m.reg.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "cache", Name: "items",
+			Help: "Items in the current cache snapshot.",
+		}, func() float64 { return float64(c.Stats().Size) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "cache", Name: "snapshot_age_seconds",
+			Help: "Time since the cache was last loaded from the database, 0 before the first load.",
+		}, func() float64 {
+			if at := c.Stats().LoadedAt; !at.IsZero() {
+				return time.Since(at).Seconds()
+			}
+			return 0
+		}),
+	)
+}
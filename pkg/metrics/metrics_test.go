@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rtemka/rbtest/domain"
+	"github.com/rtemka/rbtest/pkg/cache"
+	"github.com/rtemka/rbtest/pkg/logging"
+	"github.com/rtemka/rbtest/pkg/repo/memdb"
+)
+
+// watchRepo БД, которая умеет сообщать об изменениях.
+type watchRepo struct {
+	*memdb.MemDB
+}
+
+func (watchRepo) Watch(context.Context) (<-chan domain.Change, error) {
+	return nil, domain.ErrUnavailable
+}
+
+func TestRepository(t *testing.T) {
+	m := New()
+	ctx := context.Background()
+
+	r := m.Repository(memdb.New())
+	if _, ok := r.(domain.Watcher); ok {
+		t.Error("wrapped memdb implements domain.Watcher")
+	}
+	if _, err := r.CreateItem(ctx, domain.Item{Name: "a"}); err != nil {
+		t.Fatalf("CreateItem() = err %v", err)
+	}
+	if _, err := r.Item(ctx, 42); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("Item(42) = err %v, want ErrNotFound", err)
+	}
+	// ошибка обработчика обхода не ошибка БД
+	stop := errors.New("stop")
+	if err := domain.Iterate(ctx, r, func(domain.Item) error { return stop }); err != stop {
+		t.Fatalf("Iterate() = err %v, want %v", err, stop)
+	}
+
+	w, ok := m.Repository(watchRepo{memdb.New()}).(domain.Watcher)
+	if !ok {
+		t.Fatal("wrapped watcher does not implement domain.Watcher")
+	}
+	_, _ = w.Watch(ctx)
+
+	tests := []struct {
+		op, kind string
+		want     float64
+	}{
+		{"create_item", "not_found", 0},
+		{"item", "not_found", 1},
+		{"iterate_items", "other", 0},
+		{"watch", "unavailable", 1},
+	}
+	for _, tt := range tests {
+		if got := testutil.ToFloat64(m.repoErrors.WithLabelValues(tt.op, tt.kind)); got != tt.want {
+			t.Errorf("errors{op=%s,error=%s} = %v, want %v", tt.op, tt.kind, got, tt.want)
+		}
+	}
+	if got := testutil.CollectAndCount(m.repoLatency); got != 4 {
+		t.Errorf("latency series = %d, want 4", got)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	m := New()
+	c := cache.New(context.Background(), memdb.New(domain.Item{ID: 1, Name: "a"}),
+		logging.Discard(), time.Hour, cache.WithRefreshHook(m.ObserveRefresh))
+	m.RegisterCache(c)
+	if _, err := c.Items(context.Background()); err != nil {
+		t.Fatalf("Items() = err %v", err)
+	}
+	m.ObserveRequest("/items/{id}", "GET", 404, time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		`rbtest_http_requests_total{method="GET",route="/items/{id}",status="404"} 1`,
+		`rbtest_http_request_duration_seconds_count{method="GET",route="/items/{id}",status="404"} 1`,
+		"rbtest_cache_items 1",
+		"rbtest_cache_snapshot_age_seconds ",
+		"rbtest_cache_refresh_duration_seconds_count ",
+		"rbtest_cache_refresh_failures_total 0",
+		"go_goroutines ",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics do not contain %q", want)
+		}
+	}
+}
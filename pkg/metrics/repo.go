@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/rtemka/rbtest/domain"
+	"github.com/rtemka/rbtest/pkg/repo/observe"
+)
+
+// Repository возвращает обертку над r, которая учитывает
+// длительность и ошибки каждого вызова БД. Если r умеет
+// сообщать об изменениях (domain.Watcher), обертка тоже умеет.
+func (m *Metrics) Repository(r domain.Repository) domain.Repository {
+	return observe.Wrap(r, m.observeRepo)
+}
+
+// observeRepo учитывает вызов БД.
+func (m *Metrics) observeRepo(_ context.Context, op string, d time.Duration, err error) {
+	m.repoLatency.WithLabelValues(op).Observe(d.Seconds())
+	if err != nil {
+		m.repoErrors.WithLabelValues(op, errorKind(err)).Inc()
+	}
+}
+
+// errorKind тип ошибки БД для метки метрики.
+func errorKind(err error) string {
+	switch {
+	case errors.Is(err, domain.ErrNotFound):
+		return "not_found"
+	case errors.Is(err, domain.ErrConflict):
+		return "conflict"
+	case errors.Is(err, domain.ErrInvalid):
+		return "invalid"
+	case errors.Is(err, domain.ErrUnavailable):
+		return "unavailable"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	}
+	return "other"
+}
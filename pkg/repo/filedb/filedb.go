@@ -0,0 +1,669 @@
+// Пакет filedb реализует контракт БД поверх локального файла
+// без внешних зависимостей. Изменения дописываются в журнал
+// (append-only log), который периодически сжимается до снимка
+// текущих объектов. Все объекты держатся в памяти.
+package filedb
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/rtemka/rbtest/domain"
+)
+
+type item = domain.Item
+
+// имена файлов в каталоге данных
+const (
+	logName  = "items.log"
+	lockName = "LOCK"
+)
+
+// журнал сжимается, когда записей в нем больше, чем
+// compactFactor*(число объектов)+compactMin
+const (
+	compactFactor = 2
+	compactMin    = 1000
+)
+
+// ErrLocked возвращается Open, если каталог данных
+// уже используется другим процессом.
+var ErrLocked = errors.New("filedb: data directory is locked by another process")
+
+// ErrCorrupt возвращается Open, если журнал поврежден не в
+// хвосте: отрезать его означало бы потерять записи после
+// поврежденной.
+var ErrCorrupt = errors.New("filedb: log is corrupted")
+
+// ErrClosed возвращается при записи в закрытую БД.
+// Оборачивает domain.ErrUnavailable.
+var ErrClosed = fmt.Errorf("filedb: database is closed: %w", domain.ErrUnavailable)
+
+// типы записей журнала
+const (
+	opPut   = "put"   // объект добавлен или изменен
+	opDel   = "del"   // объект удален
+	opMeta  = "meta"  // служебная запись со счетчиком id
+	opBatch = "batch" // пакет записей, применяется целиком или никак
+)
+
+// record запись журнала.
+type record struct {
+	Op     string   `json:"op"`
+	Item   *item    `json:"item,omitempty"`
+	ID     int64    `json:"id,omitempty"`
+	LastID int64    `json:"last_id,omitempty"`
+	Batch  []record `json:"batch,omitempty"`
+}
+
+// Формат записи в файле: длина данных (uint32, big endian),
+// CRC32 данных (uint32, big endian), данные в JSON.
+const headerSize = 8
+
+// maxRecordSize максимальный размер данных записи. Пакет из
+// domain.MaxBatchSize операций намного меньше; длина больше
+// этой в заголовке означает поврежденный журнал.
+const maxRecordSize = 16 << 20
+
+// FileDB хранит объекты в файле журнала в каталоге данных.
+// Каждая запись синхронизируется с диском (fsync) до того, как
+// изменение становится видимым. При открытии журнал
+// проигрывается заново, а недописанный хвост (после сбоя)
+// отрезается; повреждение в середине журнала - ошибка Open.
+// Безопасна для конкурентного использования.
+type FileDB struct {
+	mu      sync.RWMutex
+	dir     string
+	f       *os.File // журнал, открытый на дозапись
+	size    int64    // размер корректной части журнала
+	records int      // число записей в журнале
+	lock    *dirLock
+	items   map[int64]item
+	lastID  int64 // последний выданный id, не уменьшается после удалений
+}
+
+// Open открывает или создает БД в каталоге dir и блокирует
+// каталог от использования другими процессами.
+func Open(dir string) (*FileDB, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	lock, err := lockDir(filepath.Join(dir, lockName))
+	if err != nil {
+		return nil, err
+	}
+
+	db := FileDB{
+		dir:   dir,
+		lock:  lock,
+		items: make(map[int64]item),
+	}
+
+	if err := db.open(); err != nil {
+		_ = lock.release()
+		return nil, err
+	}
+
+	return &db, nil
+}
+
+// open проигрывает журнал, отрезает поврежденный хвост
+// и открывает журнал на дозапись.
+func (db *FileDB) open() error {
+	path := filepath.Join(db.dir, logName)
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := db.replay(f, fi.Size()); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("filedb: replay %s: %w", path, err)
+	}
+
+	// отрезаем недописанный хвост и продолжаем писать с конца
+	// корректной части журнала
+	if err := f.Truncate(db.size); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if _, err := f.Seek(db.size, io.SeekStart); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	db.f = f
+	return syncDir(db.dir)
+}
+
+// replay читает журнал размером size и восстанавливает
+// состояние в памяти. Неполная или поврежденная запись, за
+// которой нет ни одной целой записи, - след сбоя посреди
+// записи (часто это хвост из нулей): чтение на ней
+// останавливается, db.size указывает на ее начало.
+// Поврежденная запись в середине журнала - ошибка ErrCorrupt.
+func (db *FileDB) replay(r io.Reader, size int64) error {
+	br := bufio.NewReader(r)
+	header := make([]byte, headerSize)
+
+	for {
+		left := size - db.size
+		if left < headerSize {
+			return nil // пусто или недописанный заголовок
+		}
+		if _, err := io.ReadFull(br, header); err != nil {
+			return err
+		}
+		left -= headerSize
+
+		n := int64(binary.BigEndian.Uint32(header[:4]))
+		if n > maxRecordSize || n > left {
+			return db.badRecord(header, br)
+		}
+
+		data := make([]byte, n)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return err
+		}
+		rec, ok := decode(header, data)
+		if !ok {
+			return db.badRecord(append(header, data...), br)
+		}
+
+		db.play(rec)
+		db.size += headerSize + n
+		db.records++
+	}
+}
+
+// badRecord решает, чем считать поврежденную запись в позиции
+// db.size, начало которой read уже прочитано из r. Если дальше
+// в журнале есть целая запись, журнал поврежден в середине,
+// иначе это недописанный хвост, и его можно отрезать.
+func (db *FileDB) badRecord(read []byte, r io.Reader) error {
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b := append(read, rest...)
+
+	for i := 1; i+headerSize <= len(b); i++ {
+		n := int(binary.BigEndian.Uint32(b[i:]))
+		if n == 0 || n > maxRecordSize || n > len(b)-i-headerSize {
+			continue
+		}
+		if _, ok := decode(b[i:i+headerSize], b[i+headerSize:i+headerSize+n]); ok {
+			return fmt.Errorf("%w: bad record at offset %d", ErrCorrupt, db.size)
+		}
+	}
+	return nil
+}
+
+// decode проверяет контрольную сумму из заголовка и разбирает
+// данные записи журнала.
+func decode(header, data []byte) (record, bool) {
+	var rec record
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:]) {
+		return rec, false
+	}
+	return rec, json.Unmarshal(data, &rec) == nil
+}
+
+// play применяет запись журнала к состоянию в памяти.
+func (db *FileDB) play(rec record) {
+	switch rec.Op {
+	case opPut:
+		if rec.Item == nil {
+			return
+		}
+		db.items[rec.Item.ID] = *rec.Item
+		if rec.Item.ID > db.lastID {
+			db.lastID = rec.Item.ID
+		}
+	case opDel:
+		delete(db.items, rec.ID)
+	case opMeta:
+		if rec.LastID > db.lastID {
+			db.lastID = rec.LastID
+		}
+	case opBatch:
+		for _, r := range rec.Batch {
+			db.play(r)
+		}
+	}
+}
+
+// encode сериализует запись журнала вместе с заголовком.
+func encode(rec record) ([]byte, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxRecordSize {
+		return nil, fmt.Errorf("filedb: record of %d bytes exceeds %d", len(data), maxRecordSize)
+	}
+	b := make([]byte, headerSize, headerSize+len(data))
+	binary.BigEndian.PutUint32(b[:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(b[4:], crc32.ChecksumIEEE(data))
+	return append(b, data...), nil
+}
+
+// write дописывает запись в журнал, после чего применяет
+// ее в памяти. Вызывается под блокировкой на запись.
+func (db *FileDB) write(rec record) error {
+	if err := db.append(rec); err != nil {
+		return err
+	}
+	db.play(rec)
+	db.autoCompact()
+	return nil
+}
+
+// append дописывает запись в журнал и синхронизирует его
+// с диском. Если запись не удалась, журнал откатывается
+// к прежнему размеру. Вызывается под блокировкой на запись.
+func (db *FileDB) append(rec record) error {
+	if db.f == nil {
+		return ErrClosed
+	}
+
+	b, err := encode(rec)
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.f.Write(b); err != nil {
+		db.rollback()
+		return err
+	}
+	if err := db.f.Sync(); err != nil {
+		db.rollback()
+		return err
+	}
+
+	db.size += int64(len(b))
+	db.records++
+	return nil
+}
+
+// autoCompact сжимает журнал, если в нем накопилось
+// слишком много записей. Вызывается под блокировкой на запись.
+func (db *FileDB) autoCompact() {
+	if db.records > compactFactor*len(db.items)+compactMin {
+		// ошибка сжатия не отменяет уже записанное изменение,
+		// журнал останется несжатым до следующей попытки
+		_ = db.compact()
+	}
+}
+
+// rollback отрезает от журнала частично записанные данные.
+func (db *FileDB) rollback() {
+	_ = db.f.Truncate(db.size)
+	_, _ = db.f.Seek(db.size, io.SeekStart)
+}
+
+// Compact сжимает журнал до снимка текущих объектов.
+func (db *FileDB) Compact() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.compact()
+}
+
+// compact записывает текущие объекты в новый журнал и атомарно
+// заменяет им старый. Вызывается под блокировкой на запись.
+func (db *FileDB) compact() error {
+	if db.f == nil {
+		return ErrClosed
+	}
+
+	path := filepath.Join(db.dir, logName)
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if f != nil {
+			_ = f.Close()
+			_ = os.Remove(tmp)
+		}
+	}()
+
+	recs := make([]record, 0, len(db.items)+1)
+	recs = append(recs, record{Op: opMeta, LastID: db.lastID})
+	for _, it := range db.sorted() {
+		it := it
+		recs = append(recs, record{Op: opPut, Item: &it})
+	}
+
+	w := bufio.NewWriter(f)
+	var size int64
+	for _, rec := range recs {
+		b, err := encode(rec)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		size += int64(len(b))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	// новый журнал уже на месте старого, дальше пишем в него
+	_ = db.f.Close()
+	db.f, f = f, nil
+	db.size = size
+	db.records = len(recs)
+
+	return syncDir(db.dir)
+}
+
+// sorted возвращает все объекты, упорядоченные по id.
+// Вызывается под блокировкой.
+func (db *FileDB) sorted() []item {
+	out := make([]item, 0, len(db.items))
+	for _, it := range db.items {
+		out = append(out, it)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// check находит объект для изменения и проверяет его версию.
+// Вызывается под блокировкой.
+func (db *FileDB) check(id, version int64) (item, error) {
+	stored, ok := db.items[id]
+	if !ok {
+		return item{}, domain.ErrNotFound
+	}
+	if version != 0 && version != stored.Version {
+		return item{}, domain.ErrConflict
+	}
+	return stored, nil
+}
+
+// Items возвращает списком все объекты из БД.
+func (db *FileDB) Items(ctx context.Context) ([]item, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.sorted(), nil
+}
+
+// Item находит объект по id.
+func (db *FileDB) Item(ctx context.Context, id int64) (item, error) {
+	if err := ctx.Err(); err != nil {
+		return item{}, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	it, ok := db.items[id]
+	if !ok {
+		return item{}, domain.ErrNotFound
+	}
+	return it, nil
+}
+
+// ListItems возвращает страницу объектов по запросу.
+func (db *FileDB) ListItems(ctx context.Context, q domain.ListQuery) (domain.ItemsPage, error) {
+	if err := ctx.Err(); err != nil {
+		return domain.ItemsPage{}, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return q.Page(db.sorted()), nil
+}
+
+// CreateItem добавляет в БД объект, присваивая ему новый id.
+func (db *FileDB) CreateItem(ctx context.Context, it item) (item, error) {
+	if err := ctx.Err(); err != nil {
+		return item{}, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	it.ID = db.lastID + 1
+	it.Version = 1
+
+	if err := db.write(record{Op: opPut, Item: &it}); err != nil {
+		return item{}, err
+	}
+	return it, nil
+}
+
+// DeleteItem удаляет из БД объект по id.
+func (db *FileDB) DeleteItem(ctx context.Context, id, version int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, err := db.check(id, version); err != nil {
+		return err
+	}
+	return db.write(record{Op: opDel, ID: id})
+}
+
+// UpdateItem обновляет в БД объект.
+func (db *FileDB) UpdateItem(ctx context.Context, it item) (item, error) {
+	if err := ctx.Err(); err != nil {
+		return item{}, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	stored, err := db.check(it.ID, it.Version)
+	if err != nil {
+		return item{}, err
+	}
+	it.Version = stored.Version + 1
+
+	if err := db.write(record{Op: opPut, Item: &it}); err != nil {
+		return item{}, err
+	}
+	return it, nil
+}
+
+// ModifyItem изменяет объект функцией fn под блокировкой.
+func (db *FileDB) ModifyItem(ctx context.Context, id, version int64, fn domain.ModifyFunc) (item, error) {
+	if err := ctx.Err(); err != nil {
+		return item{}, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	stored, err := db.check(id, version)
+	if err != nil {
+		return item{}, err
+	}
+	it, err := fn(stored)
+	if err != nil {
+		return item{}, err
+	}
+	it.ID, it.Version = id, stored.Version+1
+
+	if err := db.write(record{Op: opPut, Item: &it}); err != nil {
+		return item{}, err
+	}
+	return it, nil
+}
+
+// Batch выполняет пакет операций под одной блокировкой.
+// Примененные операции дописываются в журнал одной записью
+// с одним fsync, поэтому после сбоя пакет либо виден
+// целиком, либо не виден вовсе. Атомарный пакет при ошибке
+// откатывается к исходному состоянию.
+func (db *FileDB) Batch(ctx context.Context, ops []domain.BatchOperation, atomic bool) ([]domain.BatchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.f == nil {
+		return nil, ErrClosed
+	}
+
+	undo := make(map[int64]*item) // исходные объекты, nil - объекта не было
+	lastID := db.lastID
+	restore := func() {
+		for id, prev := range undo {
+			if prev == nil {
+				delete(db.items, id)
+			} else {
+				db.items[id] = *prev
+			}
+		}
+		db.lastID = lastID
+	}
+
+	results := make([]domain.BatchResult, len(ops))
+	recs := make([]record, 0, len(ops))
+	for i, op := range ops {
+		if _, seen := undo[op.Item.ID]; !seen {
+			if stored, ok := db.items[op.Item.ID]; ok {
+				undo[op.Item.ID] = &stored
+			}
+		}
+
+		_, existed := db.items[op.Item.ID]
+		rec, it, err := db.batchOp(op)
+		if err != nil {
+			if atomic {
+				restore()
+				return domain.Abort(ops, i, err), nil
+			}
+			results[i] = domain.BatchResult{Item: it, Err: err}
+			continue
+		}
+
+		if _, seen := undo[it.ID]; !seen {
+			undo[it.ID] = nil // созданный объект
+		}
+		db.play(rec)
+		recs = append(recs, rec)
+		results[i] = domain.BatchResult{Item: it, Created: op.Op != domain.BatchDelete && !existed}
+	}
+
+	if len(recs) == 0 {
+		return results, nil
+	}
+	if err := db.append(record{Op: opBatch, Batch: recs}); err != nil {
+		restore()
+		return nil, err
+	}
+	db.autoCompact()
+
+	return results, nil
+}
+
+// batchOp проверяет операцию пакета и возвращает запись
+// журнала для нее, не применяя ее. Вызывается под блокировкой.
+func (db *FileDB) batchOp(op domain.BatchOperation) (record, item, error) {
+	it := op.Item
+	if op.Op == domain.BatchPut {
+		op.Op = domain.BatchCreate
+		if _, ok := db.items[it.ID]; ok {
+			op.Op = domain.BatchUpdate
+		}
+	}
+
+	switch op.Op {
+	case domain.BatchCreate:
+		if it.ID == 0 {
+			it.ID = db.lastID + 1
+		} else if _, ok := db.items[it.ID]; ok {
+			return record{}, item{ID: it.ID}, domain.ErrConflict
+		}
+		it.Version = 1
+		return record{Op: opPut, Item: &it}, it, nil
+	case domain.BatchUpdate:
+		stored, err := db.check(it.ID, it.Version)
+		if err != nil {
+			return record{}, item{ID: it.ID}, err
+		}
+		it.Version = stored.Version + 1
+		return record{Op: opPut, Item: &it}, it, nil
+	case domain.BatchDelete:
+		if _, err := db.check(it.ID, it.Version); err != nil {
+			return record{}, item{ID: it.ID}, err
+		}
+		return record{Op: opDel, ID: it.ID}, item{ID: it.ID}, nil
+	}
+	return record{}, item{ID: it.ID}, domain.ErrUnknownOp
+}
+
+// Close закрывает журнал и снимает блокировку каталога.
+func (db *FileDB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.f == nil {
+		return nil
+	}
+	err := db.f.Close()
+	db.f = nil
+	if lerr := db.lock.release(); err == nil {
+		err = lerr
+	}
+	return err
+}
+
+// syncDir синхронизирует каталог, чтобы созданные
+// и переименованные файлы пережили сбой питания.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,334 @@
+package filedb
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rtemka/rbtest/domain"
+	"github.com/rtemka/rbtest/pkg/repo/repotest"
+)
+
+func TestConformance(t *testing.T) {
+	repotest.RunConformance(t, func(t *testing.T) domain.Repository {
+		db, err := Open(t.TempDir())
+		if err != nil {
+			t.Fatalf("Open() = err %v", err)
+		}
+		t.Cleanup(func() { _ = db.Close() })
+		return db
+	})
+}
+
+// reopen закрывает БД и открывает ее заново из того же каталога.
+func reopen(t *testing.T, db *FileDB) *FileDB {
+	t.Helper()
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close() = err %v", err)
+	}
+	db, err := Open(db.dir)
+	if err != nil {
+		t.Fatalf("Open() = err %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+// fill создает, изменяет и удаляет объекты и возвращает
+// ожидаемое содержимое БД.
+func fill(t *testing.T, db *FileDB) []item {
+	t.Helper()
+	ctx := context.Background()
+
+	var want []item
+	for _, name := range []string{"one", "two", "three"} {
+		it, err := db.CreateItem(ctx, item{Name: name})
+		if err != nil {
+			t.Fatalf("CreateItem() = err %v", err)
+		}
+		want = append(want, it)
+	}
+
+	upd, err := db.UpdateItem(ctx, item{ID: want[0].ID, Name: "one upd"})
+	if err != nil {
+		t.Fatalf("UpdateItem() = err %v", err)
+	}
+	want[0] = upd
+
+	// удаляем объект с максимальным id, чтобы проверить,
+	// что id не будет выдан повторно
+	if err := db.DeleteItem(ctx, want[2].ID, 0); err != nil {
+		t.Fatalf("DeleteItem() = err %v", err)
+	}
+	return want[:2]
+}
+
+func items(t *testing.T, db *FileDB) []item {
+	t.Helper()
+	got, err := db.Items(context.Background())
+	if err != nil {
+		t.Fatalf("Items() = err %v", err)
+	}
+	return got
+}
+
+func TestPersistence(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open() = err %v", err)
+	}
+
+	want := fill(t, db)
+	db = reopen(t, db)
+
+	if got := items(t, db); !reflect.DeepEqual(got, want) {
+		t.Errorf("Items() after reopen = %v, want %v", got, want)
+	}
+
+	created, err := db.CreateItem(context.Background(), item{Name: "four"})
+	if err != nil {
+		t.Fatalf("CreateItem() = err %v", err)
+	}
+	if created.ID != 4 {
+		t.Errorf("CreateItem() id = %d, want %d", created.ID, 4)
+	}
+}
+
+func TestRecoverTruncatedTail(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open() = err %v", err)
+	}
+	want := fill(t, db)
+	size := db.size
+	dir := db.dir
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close() = err %v", err)
+	}
+
+	// имитируем сбой посреди записи: дописываем начало записи
+	path := filepath.Join(dir, logName)
+	b, err := encode(record{Op: opPut, Item: &item{ID: 10, Name: "torn", Version: 1}})
+	if err != nil {
+		t.Fatalf("encode() = err %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() = err %v", err)
+	}
+	if _, err := f.Write(b[:len(b)-3]); err != nil {
+		t.Fatalf("Write() = err %v", err)
+	}
+	_ = f.Close()
+
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Open() = err %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	if got := items(t, db); !reflect.DeepEqual(got, want) {
+		t.Errorf("Items() after recovery = %v, want %v", got, want)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat() = err %v", err)
+	}
+	if fi.Size() != size {
+		t.Errorf("log size after recovery = %d, want %d", fi.Size(), size)
+	}
+
+	// запись после восстановления не должна потеряться
+	created, err := db.CreateItem(context.Background(), item{Name: "after"})
+	if err != nil {
+		t.Fatalf("CreateItem() = err %v", err)
+	}
+	db = reopen(t, db)
+	if _, err := db.Item(context.Background(), created.ID); err != nil {
+		t.Errorf("Item() = err %v", err)
+	}
+}
+
+func TestCorruptLog(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(b []byte, last int) []byte // last - начало последней записи
+		wantErr bool
+	}{
+		{name: "bit flip in the middle", wantErr: true,
+			corrupt: func(b []byte, _ int) []byte { b[headerSize+1] ^= 1; return b }},
+		{name: "huge length in the middle", wantErr: true,
+			corrupt: func(b []byte, _ int) []byte { binary.BigEndian.PutUint32(b, 1<<31); return b }},
+		{name: "bit flip in the last record",
+			corrupt: func(b []byte, last int) []byte { b[len(b)-2] ^= 1; return b }},
+		{name: "last record longer than the file",
+			corrupt: func(b []byte, last int) []byte { binary.BigEndian.PutUint32(b[last:], uint32(len(b))); return b }},
+		// дозапись расширила файл, но данные не дошли до диска
+		{name: "zero-filled tail",
+			corrupt: func(b []byte, last int) []byte { return append(b[:last], make([]byte, 4096)...) }},
+		{name: "last record data zeroed",
+			corrupt: func(b []byte, last int) []byte {
+				clear(b[last+headerSize:])
+				return append(b, make([]byte, 512)...)
+			}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := Open(t.TempDir())
+			if err != nil {
+				t.Fatalf("Open() = err %v", err)
+			}
+			want := fill(t, db)
+			last := db.size
+			if _, err := db.CreateItem(context.Background(), item{Name: "last"}); err != nil {
+				t.Fatalf("CreateItem() = err %v", err)
+			}
+			dir := db.dir
+			if err := db.Close(); err != nil {
+				t.Fatalf("Close() = err %v", err)
+			}
+
+			path := filepath.Join(dir, logName)
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("ReadFile() = err %v", err)
+			}
+			b = tt.corrupt(b, int(last))
+			if err := os.WriteFile(path, b, 0o644); err != nil {
+				t.Fatalf("WriteFile() = err %v", err)
+			}
+
+			db, err = Open(dir)
+			if tt.wantErr {
+				if !errors.Is(err, ErrCorrupt) {
+					t.Fatalf("Open() = err %v, want ErrCorrupt", err)
+				}
+				// журнал не тронут
+				if after, _ := os.ReadFile(path); len(after) != len(b) {
+					t.Errorf("log size = %d, want %d", len(after), len(b))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Open() = err %v", err)
+			}
+			t.Cleanup(func() { _ = db.Close() })
+			if got := items(t, db); !reflect.DeepEqual(got, want) {
+				t.Errorf("Items() after recovery = %v, want %v", got, want)
+			}
+			if after, _ := os.ReadFile(path); int64(len(after)) != last {
+				t.Errorf("log size after recovery = %d, want %d", len(after), last)
+			}
+		})
+	}
+}
+
+func TestCompact(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open() = err %v", err)
+	}
+	want := fill(t, db)
+	before := db.size
+
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact() = err %v", err)
+	}
+	if db.size >= before {
+		t.Errorf("Compact() size = %d, want < %d", db.size, before)
+	}
+
+	db = reopen(t, db)
+	if got := items(t, db); !reflect.DeepEqual(got, want) {
+		t.Errorf("Items() after compaction = %v, want %v", got, want)
+	}
+
+	// счетчик id пережил сжатие, хотя объекта с id 3 уже нет
+	created, err := db.CreateItem(context.Background(), item{Name: "four"})
+	if err != nil {
+		t.Fatalf("CreateItem() = err %v", err)
+	}
+	if created.ID != 4 {
+		t.Errorf("CreateItem() id = %d, want %d", created.ID, 4)
+	}
+}
+
+func TestAutoCompact(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open() = err %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	it, err := db.CreateItem(context.Background(), item{Name: "hot"})
+	if err != nil {
+		t.Fatalf("CreateItem() = err %v", err)
+	}
+	for i := 0; i < compactMin+10; i++ {
+		if it, err = db.UpdateItem(context.Background(), it); err != nil {
+			t.Fatalf("UpdateItem() = err %v", err)
+		}
+	}
+
+	if db.records > compactFactor+compactMin {
+		t.Errorf("records = %d, want log to be compacted", db.records)
+	}
+}
+
+func TestLock(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open() = err %v", err)
+	}
+
+	if _, err := Open(dir); !errors.Is(err, ErrLocked) {
+		t.Errorf("Open() second = err %v, want %v", err, ErrLocked)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close() = err %v", err)
+	}
+
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Open() after Close = err %v", err)
+	}
+	_ = db.Close()
+
+	if _, err := db.CreateItem(context.Background(), item{Name: "closed"}); !errors.Is(err, ErrClosed) {
+		t.Errorf("CreateItem() closed = err %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestBatchPersistence(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open() = err %v", err)
+	}
+	want := fill(t, db)
+
+	ops := []domain.BatchOperation{
+		{Op: domain.BatchCreate, Item: item{Name: "batched"}},
+		{Op: domain.BatchDelete, Item: item{ID: want[1].ID}},
+		{Op: domain.BatchUpdate, Item: item{ID: 1 << 40, Name: "missing"}},
+	}
+	results, err := db.Batch(context.Background(), ops, false)
+	if err != nil {
+		t.Fatalf("Batch() = err %v", err)
+	}
+	want = []item{want[0], results[0].Item}
+
+	db = reopen(t, db)
+	if got := items(t, db); !reflect.DeepEqual(got, want) {
+		t.Errorf("Items() after reopen = %v, want %v", got, want)
+	}
+}
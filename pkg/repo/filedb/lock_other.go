@@ -0,0 +1,33 @@
+//go:build !unix
+
+package filedb
+
+import (
+	"errors"
+	"os"
+)
+
+// dirLock блокировка каталога данных через эксклюзивное
+// создание файла. После аварийного завершения процесса
+// файл блокировки нужно удалить вручную.
+type dirLock struct {
+	path string
+}
+
+// lockDir захватывает блокировку, создавая файл path.
+func lockDir(path string) (*dirLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	_ = f.Close()
+	return &dirLock{path: path}, nil
+}
+
+// release снимает блокировку.
+func (l *dirLock) release() error {
+	return os.Remove(l.path)
+}
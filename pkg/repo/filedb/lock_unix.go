@@ -0,0 +1,41 @@
+//go:build unix
+
+package filedb
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// dirLock блокировка каталога данных через flock. Блокировка
+// снимается операционной системой при завершении процесса,
+// поэтому не остается висеть после сбоя.
+type dirLock struct {
+	f *os.File
+}
+
+// lockDir захватывает блокировку на файле path.
+func lockDir(path string) (*dirLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		_ = f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+
+	return &dirLock{f: f}, nil
+}
+
+// release снимает блокировку.
+func (l *dirLock) release() error {
+	_ = syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+	return l.f.Close()
+}
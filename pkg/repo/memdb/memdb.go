@@ -1,46 +1,313 @@
-// Пакет memdb реализует контракт БД, для тестов.
+// Пакет memdb реализует контракт БД в памяти.
+// Подходит для тестов и для локального запуска
+// сервиса без mongo.
 package memdb
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
 
 	"github.com/rtemka/rbtest/domain"
 )
 
 type item = domain.Item
 
-type MemDB struct{}
+// MemDB хранит объекты в памяти, безопасна для
+// конкурентного использования. Новые id назначаются
+// последовательно, начиная с максимального известного.
+type MemDB struct {
+	mu     sync.RWMutex
+	items  map[int64]item
+	lastID int64 // последний выданный или максимальный известный id
+}
+
+// New возвращает БД, заполненную объектами items.
+// Объектам с нулевым id назначаются новые id, объектам
+// с нулевой версией - первая версия.
+func New(items ...item) *MemDB {
+	m := MemDB{items: make(map[int64]item, len(items))}
+	m.seed(items)
+	return &m
+}
+
+// NewFromFile возвращает БД, заполненную объектами из
+// JSON-файла с массивом объектов.
+func NewFromFile(path string) (*MemDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := New()
+	if err := m.Load(f); err != nil {
+		return nil, fmt.Errorf("memdb: seed %s: %w", path, err)
+	}
+	return m, nil
+}
 
-var testItem1 = item{
-	ID:   1,
-	Name: "test one",
+// Load добавляет в БД объекты из JSON-массива,
+// объекты с совпадающими id заменяются.
+func (m *MemDB) Load(r io.Reader) error {
+	var items []item
+	if err := json.NewDecoder(r).Decode(&items); err != nil {
+		return err
+	}
+	m.seed(items)
+	return nil
 }
 
-var testItem2 = item{
-	ID:   2,
-	Name: "test two",
+// seed добавляет объекты в БД без проверок.
+func (m *MemDB) seed(items []item) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, it := range items {
+		if it.ID > m.lastID {
+			m.lastID = it.ID
+		}
+	}
+	for _, it := range items {
+		if it.ID == 0 {
+			m.lastID++
+			it.ID = m.lastID
+		}
+		if it.Version == 0 {
+			it.Version = 1
+		}
+		m.items[it.ID] = it
+	}
 }
 
-func New() *MemDB { return &MemDB{} }
+// sorted возвращает все объекты, упорядоченные по id.
+// Вызывается под блокировкой.
+func (m *MemDB) sorted() []item {
+	out := make([]item, 0, len(m.items))
+	for _, it := range m.items {
+		out = append(out, it)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
 
 // Items возвращает списком все объекты из БД.
-func (m *MemDB) Items(context.Context) ([]item, error) {
-	return []item{testItem1, testItem2}, nil
+func (m *MemDB) Items(ctx context.Context) ([]item, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.sorted(), nil
 }
 
 // Item находит объект по id.
 func (m *MemDB) Item(ctx context.Context, id int64) (item, error) {
-	return testItem1, nil
+	if err := ctx.Err(); err != nil {
+		return item{}, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	it, ok := m.items[id]
+	if !ok {
+		return item{}, domain.ErrNotFound
+	}
+	return it, nil
+}
+
+// ListItems возвращает страницу объектов по запросу.
+func (m *MemDB) ListItems(ctx context.Context, q domain.ListQuery) (domain.ItemsPage, error) {
+	if err := ctx.Err(); err != nil {
+		return domain.ItemsPage{}, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return q.Page(m.sorted()), nil
+}
+
+// CreateItem добавляет в БД объект, присваивая ему новый id.
+func (m *MemDB) CreateItem(ctx context.Context, it item) (item, error) {
+	if err := ctx.Err(); err != nil {
+		return item{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastID++
+	it.ID = m.lastID
+	it.Version = 1
+	m.items[it.ID] = it
+
+	return it, nil
 }
 
 // DeleteItem удаляет из БД объект по id.
-func (m *MemDB) DeleteItem(ctx context.Context, id int64) error {
+func (m *MemDB) DeleteItem(ctx context.Context, id, version int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.check(id, version); err != nil {
+		return err
+	}
+	delete(m.items, id)
+
 	return nil
 }
 
 // UpdateItem обновляет в БД объект.
-func (m *MemDB) UpdateItem(ctx context.Context, item item) error {
-	return nil
+func (m *MemDB) UpdateItem(ctx context.Context, it item) (item, error) {
+	if err := ctx.Err(); err != nil {
+		return item{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, err := m.check(it.ID, it.Version)
+	if err != nil {
+		return item{}, err
+	}
+	it.Version = stored.Version + 1
+	m.items[it.ID] = it
+
+	return it, nil
+}
+
+// ModifyItem изменяет объект функцией fn под блокировкой.
+func (m *MemDB) ModifyItem(ctx context.Context, id, version int64, fn domain.ModifyFunc) (item, error) {
+	if err := ctx.Err(); err != nil {
+		return item{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, err := m.check(id, version)
+	if err != nil {
+		return item{}, err
+	}
+	it, err := fn(stored)
+	if err != nil {
+		return item{}, err
+	}
+	it.ID, it.Version = id, stored.Version+1
+	m.items[id] = it
+
+	return it, nil
+}
+
+// Batch выполняет пакет операций под одной блокировкой.
+// Атомарный пакет при ошибке откатывается к исходному состоянию.
+func (m *MemDB) Batch(ctx context.Context, ops []domain.BatchOperation, atomic bool) ([]domain.BatchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	undo := make(map[int64]*item) // исходные объекты, nil - объекта не было
+	lastID := m.lastID
+
+	results := make([]domain.BatchResult, len(ops))
+	for i, op := range ops {
+		if _, seen := undo[op.Item.ID]; !seen {
+			if stored, ok := m.items[op.Item.ID]; ok {
+				undo[op.Item.ID] = &stored
+			}
+		}
+
+		_, existed := m.items[op.Item.ID]
+		it, err := m.batchOp(op)
+		if err != nil && atomic {
+			for id, prev := range undo {
+				if prev == nil {
+					delete(m.items, id)
+				} else {
+					m.items[id] = *prev
+				}
+			}
+			m.lastID = lastID
+			return domain.Abort(ops, i, err), nil
+		}
+		if _, ok := undo[it.ID]; !ok && err == nil {
+			undo[it.ID] = nil // созданный объект
+		}
+		results[i] = domain.BatchResult{Item: it, Err: err,
+			Created: err == nil && op.Op != domain.BatchDelete && !existed}
+	}
+
+	return results, nil
+}
+
+// batchOp выполняет одну операцию пакета.
+// Вызывается под блокировкой.
+func (m *MemDB) batchOp(op domain.BatchOperation) (item, error) {
+	it := op.Item
+	if op.Op == domain.BatchPut {
+		op.Op = domain.BatchCreate
+		if _, ok := m.items[it.ID]; ok {
+			op.Op = domain.BatchUpdate
+		}
+	}
+
+	switch op.Op {
+	case domain.BatchCreate:
+		switch _, ok := m.items[it.ID]; {
+		case it.ID == 0:
+			m.lastID++
+			it.ID = m.lastID
+		case ok:
+			return item{ID: it.ID}, domain.ErrConflict
+		case it.ID > m.lastID:
+			m.lastID = it.ID
+		}
+		it.Version = 1
+	case domain.BatchUpdate:
+		stored, err := m.check(it.ID, it.Version)
+		if err != nil {
+			return item{ID: it.ID}, err
+		}
+		it.Version = stored.Version + 1
+	case domain.BatchDelete:
+		if _, err := m.check(it.ID, it.Version); err != nil {
+			return item{ID: it.ID}, err
+		}
+		delete(m.items, it.ID)
+		return item{ID: it.ID}, nil
+	default:
+		return item{ID: it.ID}, domain.ErrUnknownOp
+	}
+	m.items[it.ID] = it
+	return it, nil
+}
+
+// check находит объект для изменения и проверяет его версию.
+// Вызывается под блокировкой.
+func (m *MemDB) check(id, version int64) (item, error) {
+	stored, ok := m.items[id]
+	if !ok {
+		return item{}, domain.ErrNotFound
+	}
+	if version != 0 && version != stored.Version {
+		return item{}, domain.ErrConflict
+	}
+	return stored, nil
 }
 
 // Close закрывает подключение к БД.
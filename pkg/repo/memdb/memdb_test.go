@@ -0,0 +1,85 @@
+package memdb
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/rtemka/rbtest/domain"
+	"github.com/rtemka/rbtest/pkg/repo/repotest"
+)
+
+func TestConformance(t *testing.T) {
+	repotest.RunConformance(t, func(t *testing.T) domain.Repository {
+		return New()
+	})
+}
+
+func TestNewFromFile(t *testing.T) {
+	m, err := NewFromFile("testdata/items.json")
+	if err != nil {
+		t.Fatalf("NewFromFile() = err %v", err)
+	}
+
+	got, err := m.Items(context.Background())
+	if err != nil {
+		t.Fatalf("Items() = err %v", err)
+	}
+
+	want := []item{
+		{ID: 2, Name: "seeded two", Version: 1},
+		{ID: 5, Name: "seeded five", Version: 3},
+		{ID: 6, Name: "seeded without id", Version: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Items() = %v, want %v", got, want)
+	}
+
+	created, err := m.CreateItem(context.Background(), item{Name: "created"})
+	if err != nil {
+		t.Fatalf("CreateItem() = err %v", err)
+	}
+	if created.ID != 7 {
+		t.Errorf("CreateItem() id = %d, want %d", created.ID, 7)
+	}
+
+	if _, err := NewFromFile("testdata/missing.json"); err == nil {
+		t.Errorf("NewFromFile() = nil, want error for missing file")
+	}
+}
+
+func TestMemDBConcurrentUpdates(t *testing.T) {
+	m := New(item{ID: 1, Name: "contended"})
+
+	const writers = 16
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	won, conflicts := 0, 0
+
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := m.UpdateItem(context.Background(), item{ID: 1, Name: "winner", Version: 1})
+
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				won++
+			case errors.Is(err, domain.ErrConflict):
+				conflicts++
+			default:
+				t.Errorf("UpdateItem() = err %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if won != 1 || conflicts != writers-1 {
+		t.Errorf("UpdateItem() won = %d, conflicts = %d, want 1 and %d", won, conflicts, writers-1)
+	}
+}
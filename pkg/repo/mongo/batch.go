@@ -0,0 +1,423 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	"github.com/rtemka/rbtest/domain"
+	"github.com/rtemka/rbtest/pkg/tracing"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// errAbort прерывает транзакцию атомарного пакета.
+var errAbort = errors.New("mongo: batch aborted")
+
+// batchPlan пакет операций, подготовленный для BulkWrite.
+type batchPlan struct {
+	results []domain.BatchResult // ожидаемые результаты операций
+	models  []mongo.WriteModel   // записи для операций без ошибок
+	ops     []int                // индекс операции для каждой записи
+	kinds   []domain.BatchOp     // операция записи, put заменен на create или update
+	creates int64                // число записей каждого типа
+	updates int64
+	deletes int64
+}
+
+// failed возвращает индекс первой операции с ошибкой или -1.
+func (p *batchPlan) failed() int {
+	for i, res := range p.results {
+		if res.Err != nil {
+			return i
+		}
+	}
+	return -1
+}
+
+// complete сообщает, применились ли все записи пакета.
+func (p *batchPlan) complete(res *mongo.BulkWriteResult) bool {
+	return res.UpsertedCount == p.creates &&
+		res.MatchedCount == p.updates &&
+		res.DeletedCount == p.deletes
+}
+
+// Batch выполняет пакет операций одним BulkWrite. Перед записью
+// пакет проверяется по текущим версиям объектов, а каждая
+// запись выполняется с условием на ожидаемую версию, поэтому
+// изменения других клиентов не затираются.
+// Атомарный пакет выполняется в транзакции и требует replica set.
+func (m *Mongo) Batch(ctx context.Context, ops []domain.BatchOperation, atomic bool) ([]domain.BatchResult, error) {
+	ctx, span := m.span(ctx, "batch")
+	span.SetAttributes(attribute.Int("db.batch.size", len(ops)), attribute.Bool("db.batch.atomic", atomic))
+	results, err := m.batch(ctx, ops, atomic)
+	tracing.End(span, err)
+	return results, err
+}
+
+// batch выполняет пакет операций, см. Batch.
+func (m *Mongo) batch(ctx context.Context, ops []domain.BatchOperation, atomic bool) ([]domain.BatchResult, error) {
+	var creates, explicit int64
+	for _, op := range ops {
+		switch {
+		case op.Op == domain.BatchCreate && op.Item.ID == 0:
+			creates++
+		case op.Op == domain.BatchCreate || op.Op == domain.BatchPut:
+			explicit = max(explicit, op.Item.ID)
+		}
+	}
+
+	var first int64
+	if creates > 0 {
+		var err error
+		// id резервируются вне транзакции: при откате
+		// они просто не будут использованы. Новые id идут
+		// после явных id пакета, которых в БД еще может не быть
+		if first, err = m.reserveIDs(ctx, creates, explicit); err != nil {
+			return nil, mapErr(err)
+		}
+	}
+
+	if !atomic {
+		results, err := m.bulk(ctx, ops, first)
+		return results, mapErr(err)
+	}
+
+	session, err := m.client.StartSession()
+	if err != nil {
+		return nil, mapErr(err)
+	}
+	defer session.EndSession(context.Background())
+
+	var results []domain.BatchResult
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		p, err := m.plan(sc, ops, first)
+		if err != nil {
+			return nil, err
+		}
+		if i := p.failed(); i >= 0 {
+			results = domain.Abort(ops, i, p.results[i].Err)
+			return nil, errAbort
+		}
+		if len(p.models) == 0 {
+			results = p.results
+			return nil, nil
+		}
+
+		res, err := m.col().BulkWrite(sc, p.models, options.BulkWrite().SetOrdered(true))
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, domain.ErrConflict // id нового объекта уже занят
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !p.complete(res) {
+			// внутри транзакции сюда можно попасть, только
+			// если id нового объекта уже занят
+			return nil, domain.ErrConflict
+		}
+		results = p.results
+		return nil, nil
+	})
+	if errors.Is(err, errAbort) {
+		return results, nil
+	}
+	if err != nil {
+		return nil, mapErr(err)
+	}
+	return results, nil
+}
+
+// bulk выполняет неатомарный пакет. Запись упорядочена, так
+// как операции пакета могут зависеть друг от друга, и
+// останавливается на первой ошибке записи. Тогда ошибка
+// сообщается только для этой операции, а остальные заново
+// проверяются по текущему состоянию и записываются следующим
+// BulkWrite. Операции без ожидаемой версии, которые не
+// применились из-за изменения объекта другим клиентом,
+// повторяются, как повторяется ModifyItem.
+func (m *Mongo) bulk(ctx context.Context, ops []domain.BatchOperation, first int64) ([]domain.BatchResult, error) {
+	results := make([]domain.BatchResult, 0, len(ops))
+	for len(ops) > 0 {
+		res, raced, err := m.bulkOnce(ctx, ops, first)
+		if err != nil {
+			return nil, err
+		}
+		if err := m.retry(ctx, ops, res, raced); err != nil {
+			return nil, err
+		}
+		// новые объекты из выполненной части заняли свои id
+		for _, op := range ops[:len(res)] {
+			if op.Op == domain.BatchCreate && op.Item.ID == 0 {
+				first++
+			}
+		}
+		results = append(results, res...)
+		ops = ops[len(res):]
+	}
+	return results, nil
+}
+
+// retry повторяет операции ops с индексами raced, пока они
+// не применятся или не завершатся ошибкой операции, и
+// записывает их результаты в results.
+func (m *Mongo) retry(ctx context.Context, ops []domain.BatchOperation, results []domain.BatchResult, raced []int) error {
+	for len(raced) > 0 {
+		sub := make([]domain.BatchOperation, len(raced))
+		for j, i := range raced {
+			sub[j] = ops[i]
+		}
+		res, again, err := m.bulkOnce(ctx, sub, 0)
+		if err != nil {
+			return err
+		}
+
+		var next []int
+		for _, j := range again {
+			next = append(next, raced[j])
+		}
+		for j := range res {
+			results[raced[j]] = res[j]
+		}
+		// операции после ошибки записи не выполнялись
+		raced = append(next, raced[len(res):]...)
+	}
+	return nil
+}
+
+// bulkOnce выполняет операции ops одним упорядоченным BulkWrite
+// и возвращает результаты операций до первой ошибки записи
+// включительно. Если какие-то записи не применились (объект
+// успели изменить или удалить между проверкой и записью), их
+// результат выясняется повторным чтением объектов, а raced -
+// индексы операций без ожидаемой версии, которые стоит
+// повторить.
+func (m *Mongo) bulkOnce(ctx context.Context, ops []domain.BatchOperation, first int64) ([]domain.BatchResult, []int, error) {
+	state, err := m.current(ctx, ops)
+	if err != nil {
+		return nil, nil, err
+	}
+	p := newPlan(ops, first, state)
+	if len(p.models) == 0 {
+		return p.results, nil, nil
+	}
+
+	res, err := m.col().BulkWrite(ctx, p.models, options.BulkWrite().SetOrdered(true))
+
+	// упорядоченная запись останавливается на первой ошибке
+	stopped := len(p.models)
+	var bwe mongo.BulkWriteException
+	switch {
+	case errors.As(err, &bwe) && len(bwe.WriteErrors) > 0:
+		stopped = bwe.WriteErrors[0].Index
+	case err != nil:
+		return nil, nil, err
+	case p.complete(res):
+		return p.results, nil, nil
+	}
+
+	current, err := m.current(ctx, ops)
+	if err != nil {
+		return nil, nil, err
+	}
+	raced := p.settle(ops, res.UpsertedIDs, stopped, current)
+
+	if stopped == len(p.models) {
+		return p.results, raced, nil
+	}
+	werr := error(bwe.WriteErrors[0])
+	if mongo.IsDuplicateKeyError(werr) {
+		// id нового объекта занял другой клиент
+		werr = domain.ErrConflict
+	}
+	i := p.ops[stopped]
+	p.results[i] = domain.BatchResult{Item: item{ID: ops[i].Item.ID}, Err: werr}
+	return p.results[:i+1], raced, nil
+}
+
+// settle выясняет, какие из записей до stopped применились,
+// если BulkWrite затронул меньше документов, чем ожидалось.
+// Новый объект добавлен, если запись есть в upserted. Изменение
+// или удаление применилось, если применилась следующая запись
+// того же объекта (ее условие - версия после этой записи) или
+// если документ в current совпадает с ожидаемым целиком
+// (удаленного документа нет). Версии самой по себе мало: другой
+// клиент мог записать ту же версию с другим именем.
+// Результат неприменившихся записей заменяется ошибкой.
+// Возвращает индексы операций без ожидаемой версии, которые
+// не применились и не имеют следующих записей в пакете: их
+// можно повторить, не нарушив порядок операций.
+func (p *batchPlan) settle(ops []domain.BatchOperation, upserted map[int64]interface{}, stopped int, current map[int64]item) []int {
+	// применилась ли ближайшая следующая запись объекта
+	later := make(map[int64]bool)
+	if stopped < len(p.ops) {
+		later[p.results[p.ops[stopped]].Item.ID] = false
+	}
+
+	var raced []int
+	for k := stopped - 1; k >= 0; k-- {
+		i := p.ops[k]
+		want := p.results[i].Item
+		cur, exists := current[want.ID]
+		next, hasLater := later[want.ID]
+
+		var applied bool
+		switch {
+		case p.kinds[k] == domain.BatchCreate:
+			_, applied = upserted[int64(k)]
+		case next:
+			applied = true
+		case p.kinds[k] == domain.BatchUpdate:
+			applied = exists && cur == want
+		case p.kinds[k] == domain.BatchDelete:
+			applied = !exists
+		}
+		later[want.ID] = applied
+		if applied {
+			continue
+		}
+
+		err := domain.ErrConflict
+		if p.kinds[k] == domain.BatchUpdate && !exists {
+			err = domain.ErrNotFound
+		}
+		p.results[i] = domain.BatchResult{Item: item{ID: ops[i].Item.ID}, Err: err}
+		if !hasLater && ops[i].Op != domain.BatchCreate && ops[i].Item.Version == 0 {
+			raced = append(raced, i)
+		}
+	}
+	// по возрастанию, чтобы повтор сохранил порядок операций
+	slices.Reverse(raced)
+	return raced
+}
+
+// plan проверяет операции пакета по текущему состоянию
+// объектов и строит записи для BulkWrite, см. newPlan.
+func (m *Mongo) plan(ctx context.Context, ops []domain.BatchOperation, first int64) (*batchPlan, error) {
+	state, err := m.current(ctx, ops)
+	if err != nil {
+		return nil, err
+	}
+	return newPlan(ops, first, state), nil
+}
+
+// newPlan проверяет операции пакета по состоянию объектов
+// state и строит записи для BulkWrite. Новым объектам
+// назначаются id подряд, начиная с first. state изменяется.
+func newPlan(ops []domain.BatchOperation, first int64, state map[int64]item) *batchPlan {
+	p := batchPlan{results: make([]domain.BatchResult, len(ops))}
+	add := func(i int, kind domain.BatchOp, model mongo.WriteModel, it item) {
+		p.models = append(p.models, model)
+		p.ops = append(p.ops, i)
+		p.kinds = append(p.kinds, kind)
+		p.results[i] = domain.BatchResult{Item: it, Created: kind == domain.BatchCreate}
+	}
+
+	nextID := first
+	for i, op := range ops {
+		it := op.Item
+
+		if op.Op == domain.BatchPut {
+			op.Op = domain.BatchCreate
+			if _, ok := state[it.ID]; ok {
+				op.Op = domain.BatchUpdate
+			}
+		}
+
+		if op.Op == domain.BatchCreate {
+			if _, ok := state[it.ID]; ok && it.ID != 0 {
+				p.results[i] = domain.BatchResult{Item: item{ID: it.ID}, Err: domain.ErrConflict}
+				continue
+			}
+			if it.ID == 0 {
+				it.ID = nextID
+				nextID++
+			}
+			it.Version = 1
+			state[it.ID] = it
+			p.creates++
+			add(i, op.Op, mongo.NewUpdateOneModel().
+				SetFilter(bson.D{bson.E{Key: "id", Value: it.ID}}).
+				SetUpdate(bson.D{bson.E{Key: "$setOnInsert", Value: it}}).
+				SetUpsert(true), it)
+			continue
+		}
+
+		cur, ok := state[it.ID]
+		switch {
+		case op.Op != domain.BatchUpdate && op.Op != domain.BatchDelete:
+			p.results[i] = domain.BatchResult{Item: item{ID: it.ID}, Err: domain.ErrUnknownOp}
+			continue
+		case !ok:
+			p.results[i] = domain.BatchResult{Item: item{ID: it.ID}, Err: domain.ErrNotFound}
+			continue
+		case it.Version != 0 && it.Version != cur.Version:
+			p.results[i] = domain.BatchResult{Item: item{ID: it.ID}, Err: domain.ErrConflict}
+			continue
+		}
+
+		// запись всегда условна: по версии, прочитанной при проверке
+		filter := versionFilter(it.ID, cur.Version)
+
+		if op.Op == domain.BatchDelete {
+			delete(state, it.ID)
+			p.deletes++
+			add(i, op.Op, mongo.NewDeleteOneModel().SetFilter(filter), item{ID: it.ID})
+			continue
+		}
+
+		it.Version = cur.Version + 1
+		state[it.ID] = it
+		p.updates++
+		add(i, op.Op, mongo.NewUpdateOneModel().
+			SetFilter(filter).
+			SetUpdate(bson.D{bson.E{
+				Key: "$set", Value: bson.D{
+					bson.E{Key: "name", Value: it.Name},
+					bson.E{Key: "version", Value: it.Version},
+				}}}), it)
+	}
+
+	return &p
+}
+
+// current читает объекты с id, заданными в операциях пакета,
+// и возвращает их по id.
+func (m *Mongo) current(ctx context.Context, ops []domain.BatchOperation) (map[int64]item, error) {
+	ids := make([]int64, 0, len(ops))
+	for _, op := range ops {
+		if op.Item.ID != 0 {
+			ids = append(ids, op.Item.ID)
+		}
+	}
+
+	state := make(map[int64]item, len(ids))
+	if len(ids) == 0 {
+		return state, nil
+	}
+
+	filter := bson.D{bson.E{Key: "id", Value: bson.D{bson.E{Key: "$in", Value: ids}}}}
+	cursor, err := m.col().Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+
+	var items []item
+	if err := cursor.All(ctx, &items); err != nil {
+		return nil, err
+	}
+	for _, it := range items {
+		state[it.ID] = it
+	}
+	return state, nil
+}
+
+// col возвращает текущую коллекцию.
+func (m *Mongo) col() *mongo.Collection {
+	return m.client.Database(m.database).Collection(m.collection)
+}
@@ -2,20 +2,30 @@ package mongo
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
 
 	"github.com/rtemka/rbtest/domain"
+	"github.com/rtemka/rbtest/pkg/tracing"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// Когда при выполнении операции не найдено
-// ни одного документа
-var ErrNoDocuments = mongo.ErrNoDocuments
-
 // псевдоним для объекта хранения БД
 type item = domain.Item
 
+// название коллекции, в которой хранятся счетчики id
+const countersCollection = "counters"
+
 // Mongo структура для выполнения CRUD операций с БД
 type Mongo struct {
 	client *mongo.Client // клиент mongo
@@ -25,10 +35,14 @@ type Mongo struct {
 	// название текущей collection,
 	// переключается методом Collection()
 	collection string
+	// журнал ошибок потока изменений, задается методом
+	// Logger(), по умолчанию slog.Default()
+	logger *slog.Logger
 }
 
 // New подключается к БД, используя connstr, и возвращает
-// объект для работы с БД
+// объект для работы с БД. На поле id коллекции создается
+// уникальный индекс, если его еще нет.
 func New(connstr, database, collection string) (*Mongo, error) {
 
 	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(connstr))
@@ -36,11 +50,26 @@ func New(connstr, database, collection string) (*Mongo, error) {
 		return nil, err
 	}
 
-	return &Mongo{
+	m := &Mongo{
 		client:     client,
 		database:   database,
 		collection: collection,
-	}, client.Ping(context.Background(), nil)
+	}
+	if err := client.Ping(context.Background(), nil); err != nil {
+		return m, err
+	}
+	return m, m.ensureIndex(context.Background())
+}
+
+// ensureIndex создает уникальный индекс по id текущей коллекции:
+// без него два клиента, одновременно создающие объект с одним
+// и тем же id через upsert, получили бы два документа.
+func (m *Mongo) ensureIndex(ctx context.Context) error {
+	_, err := m.col().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{bson.E{Key: "id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
 }
 
 // Database переключает имя базы данных mongodb
@@ -56,32 +85,175 @@ func (m *Mongo) Collection(collection string) *Mongo {
 	return m
 }
 
+// Logger задает журнал, в который пишутся ошибки потока
+// изменений: они не возвращаются вызывающему, а лишь
+// закрывают канал Watch.
+func (m *Mongo) Logger(logger *slog.Logger) *Mongo {
+	m.logger = logger
+	return m
+}
+
+// log возвращает журнал ошибок потока изменений.
+func (m *Mongo) log() *slog.Logger {
+	if m.logger == nil {
+		return slog.Default()
+	}
+	return m.logger
+}
+
 // Close закрывает соединение с БД
 func (m *Mongo) Close() error {
 	return m.client.Disconnect(context.Background())
 }
 
+// Ping проверяет соединение с сервером БД.
+func (m *Mongo) Ping(ctx context.Context) error {
+	return mapErr(m.client.Ping(ctx, nil))
+}
+
 // Items возвращает списком все объекты из БД.
-func (m *Mongo) Items(ctx context.Context) ([]item, error) {
+func (m *Mongo) Items(ctx context.Context) (items []item, err error) {
+	ctx, span := m.span(ctx, "items")
+	defer func() { tracing.End(span, err) }()
 
 	col := m.client.Database(m.database).Collection(m.collection)
 
 	cursor, err := col.Find(ctx, bson.D{})
 	if err != nil {
-		return nil, err
+		return nil, mapErr(err)
 	}
 	defer func() {
 		_ = cursor.Close(ctx)
 	}()
 
-	var items []item
+	err = mapErr(cursor.All(ctx, &items))
+	span.SetAttributes(attribute.Int("db.items", len(items)))
+
+	return items, err
+}
+
+// IterateItems обходит объекты курсором mongo по порядку id,
+// в памяти одновременно находится только одна порция курсора.
+// Ошибка fn в спане ошибкой БД не отмечается.
+func (m *Mongo) IterateItems(ctx context.Context, fn func(item) error) (err error) {
+	ctx, span := m.span(ctx, "iterate_items")
+	var fnErr error
+	defer func() {
+		if err == fnErr {
+			tracing.End(span, nil)
+			return
+		}
+		tracing.End(span, err)
+	}()
+
+	col := m.client.Database(m.database).Collection(m.collection)
 
-	return items, cursor.All(ctx, &items)
+	opts := options.Find().SetSort(bson.D{bson.E{Key: "id", Value: 1}})
+	cursor, err := col.Find(ctx, bson.D{}, opts)
+	if err != nil {
+		return mapErr(err)
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+
+	for cursor.Next(ctx) {
+		var it item
+		if err := cursor.Decode(&it); err != nil {
+			return err
+		}
+		if fnErr = fn(it); fnErr != nil {
+			return fnErr
+		}
+	}
+	return mapErr(cursor.Err())
+}
+
+// ListItems возвращает страницу объектов по запросу.
+// Фильтрация, сортировка и ограничение размера страницы
+// выполняются на стороне БД.
+func (m *Mongo) ListItems(ctx context.Context, q domain.ListQuery) (_ domain.ItemsPage, err error) {
+	ctx, span := m.span(ctx, "list_items")
+	defer func() { tracing.End(span, err) }()
+
+	col := m.client.Database(m.database).Collection(m.collection)
+
+	limit := q.PageLimit()
+	opts := options.Find().
+		SetSort(listSort(q)).
+		SetLimit(int64(limit) + 1) // лишний объект говорит о наличии следующей страницы
+
+	cursor, err := col.Find(ctx, listFilter(q), opts)
+	if err != nil {
+		return domain.ItemsPage{}, mapErr(err)
+	}
+	defer func() {
+		_ = cursor.Close(ctx)
+	}()
+
+	items := make([]item, 0, limit+1)
+	if err := cursor.All(ctx, &items); err != nil {
+		return domain.ItemsPage{}, mapErr(err)
+	}
+
+	return q.Cut(items), nil
+}
+
+// listFilter строит фильтр mongo по запросу списка.
+func listFilter(q domain.ListQuery) bson.D {
+
+	var conds bson.A
+
+	if q.NamePrefix != "" {
+		conds = append(conds, bson.D{bson.E{Key: "name", Value: primitive.Regex{
+			Pattern: "^" + regexp.QuoteMeta(q.NamePrefix)}}})
+	}
+	if q.NameContains != "" {
+		conds = append(conds, bson.D{bson.E{Key: "name", Value: primitive.Regex{
+			Pattern: regexp.QuoteMeta(q.NameContains)}}})
+	}
+
+	if q.After != nil {
+		op := "$gt"
+		if q.Desc {
+			op = "$lt"
+		}
+		byID := bson.D{bson.E{Key: "id", Value: bson.D{bson.E{Key: op, Value: q.After.ID}}}}
+
+		if q.Sort == domain.SortByName {
+			// порядок определяется парой (name, id)
+			conds = append(conds, bson.D{bson.E{Key: "$or", Value: bson.A{
+				bson.D{bson.E{Key: "name", Value: bson.D{bson.E{Key: op, Value: q.After.Name}}}},
+				append(bson.D{bson.E{Key: "name", Value: q.After.Name}}, byID...),
+			}}})
+		} else {
+			conds = append(conds, byID)
+		}
+	}
+
+	if len(conds) == 0 {
+		return bson.D{}
+	}
+	return bson.D{bson.E{Key: "$and", Value: conds}}
+}
+
+// listSort строит порядок сортировки mongo по запросу списка.
+func listSort(q domain.ListQuery) bson.D {
+	dir := 1
+	if q.Desc {
+		dir = -1
+	}
+	if q.Sort == domain.SortByName {
+		return bson.D{bson.E{Key: "name", Value: dir}, bson.E{Key: "id", Value: dir}}
+	}
+	return bson.D{bson.E{Key: "id", Value: dir}}
 }
 
 // AddItem добавляет в БД объект, если он уже
 // есть в БД, то no-op.
-func (m *Mongo) AddItem(ctx context.Context, item item) error {
+func (m *Mongo) AddItem(ctx context.Context, item item) (err error) {
+	ctx, span := m.span(ctx, "add_item")
+	defer func() { tracing.End(span, err) }()
 
 	col := m.client.Database(m.database).Collection(m.collection)
 	filter := bson.D{bson.E{Key: "id", Value: item.ID}}
@@ -91,40 +263,311 @@ func (m *Mongo) AddItem(ctx context.Context, item item) error {
 			Key: "$setOnInsert", Value: item},
 	}
 
-	_, err := col.UpdateOne(ctx, filter, upd, opts)
+	_, err = col.UpdateOne(ctx, filter, upd, opts)
 
-	return err
+	return mapErr(err)
+}
+
+// CreateItem добавляет в БД новый объект, присваивая ему
+// уникальный id и первую версию. Переданные id и версия игнорируются.
+// Возвращает объект с присвоенным id.
+func (m *Mongo) CreateItem(ctx context.Context, it item) (_ item, err error) {
+	ctx, span := m.span(ctx, "create_item")
+	defer func() { tracing.End(span, err) }()
+
+	col := m.client.Database(m.database).Collection(m.collection)
+	opts := options.Update().SetUpsert(true)
+	it.Version = 1
+
+	for {
+		id, err := m.reserveIDs(ctx, 1, 0)
+		if err != nil {
+			return item{}, mapErr(err)
+		}
+		it.ID = id
+
+		filter := bson.D{bson.E{Key: "id", Value: it.ID}}
+		upd := bson.D{
+			bson.E{
+				Key: "$setOnInsert", Value: it},
+		}
+
+		res, err := col.UpdateOne(ctx, filter, upd, opts)
+		if mongo.IsDuplicateKeyError(err) {
+			continue // тот же id одновременно занял другой клиент
+		}
+		if err != nil {
+			return item{}, mapErr(err)
+		}
+		if res.UpsertedCount == 1 {
+			return it, nil
+		}
+		// id уже занят объектом, добавленным в обход
+		// счетчика (например, через AddItem), берем следующий
+	}
+}
+
+// reserveIDs атомарно увеличивает счетчик id текущей коллекции
+// на n и возвращает первый из n зарезервированных id. Счетчик
+// предварительно подтягивается к максимальному id в коллекции
+// и к floor, чтобы не выдавать id уже существующих объектов
+// и объектов, которые вот-вот будут созданы с явным id.
+func (m *Mongo) reserveIDs(ctx context.Context, n, floor int64) (int64, error) {
+
+	db := m.client.Database(m.database)
+
+	var last item
+	opts := options.FindOne().SetSort(bson.D{bson.E{Key: "id", Value: -1}})
+	err := db.Collection(m.collection).FindOne(ctx, bson.D{}, opts).Decode(&last)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return 0, err
+	}
+
+	counters := db.Collection(countersCollection)
+	filter := bson.D{bson.E{Key: "_id", Value: m.collection}}
+
+	raise := bson.D{
+		bson.E{
+			Key: "$max", Value: bson.D{bson.E{Key: "seq", Value: max(last.ID, floor)}}},
+	}
+	_, err = counters.UpdateOne(ctx, filter, raise, options.Update().SetUpsert(true))
+	if err != nil {
+		return 0, err
+	}
+
+	inc := bson.D{
+		bson.E{
+			Key: "$inc", Value: bson.D{bson.E{Key: "seq", Value: n}}},
+	}
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err = counters.FindOneAndUpdate(ctx, filter, inc,
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&counter)
+
+	return counter.Seq - n + 1, err
 }
 
 // Item находит объект по id.
-// Возвращает ошибку ErrNoDocuments в случае если документ не найден.
-func (m *Mongo) Item(ctx context.Context, id int64) (item, error) {
+// Возвращает ошибку domain.ErrNotFound в случае если документ не найден.
+func (m *Mongo) Item(ctx context.Context, id int64) (item item, err error) {
+	ctx, span := m.span(ctx, "item")
+	defer func() { tracing.End(span, err) }()
 
 	col := m.client.Database(m.database).Collection(m.collection)
 
-	var item item
+	err = col.FindOne(ctx, bson.D{bson.E{Key: "id", Value: id}}).Decode(&item)
+	if err == mongo.ErrNoDocuments {
+		return item, domain.ErrNotFound
+	}
 
-	return item, col.FindOne(ctx, bson.D{bson.E{Key: "id", Value: id}}).Decode(&item)
+	return item, mapErr(err)
 }
 
-// DeleteItem удаляет из БД объект по id.
-func (m *Mongo) DeleteItem(ctx context.Context, id int64) error {
+// DeleteItem удаляет из БД объект по id. Если version не 0,
+// то объект удаляется, только если его версия совпадает с version.
+// Возвращает ошибку domain.ErrNotFound в случае если документ не найден
+// и domain.ErrConflict, если версия не совпала.
+func (m *Mongo) DeleteItem(ctx context.Context, id, version int64) (err error) {
+	ctx, span := m.span(ctx, "delete_item")
+	defer func() { tracing.End(span, err) }()
+
 	col := m.client.Database(m.database).Collection(m.collection)
-	_, err := col.DeleteOne(ctx, bson.D{bson.E{Key: "id", Value: id}})
-	return err
+	res, err := col.DeleteOne(ctx, versionFilter(id, version))
+	if err != nil {
+		return mapErr(err)
+	}
+	if res.DeletedCount == 0 {
+		return m.mismatch(ctx, id)
+	}
+	return nil
 }
 
-// UpdateItem обновляет в БД объект.
-func (m *Mongo) UpdateItem(ctx context.Context, item item) error {
+// UpdateItem обновляет в БД объект и увеличивает его версию.
+// Если item.Version не 0, то объект обновляется, только если
+// его версия совпадает с item.Version.
+// Возвращает ошибку domain.ErrNotFound в случае если документ не найден
+// и domain.ErrConflict, если версия не совпала.
+func (m *Mongo) UpdateItem(ctx context.Context, it item) (_ item, err error) {
+	ctx, span := m.span(ctx, "update_item")
+	defer func() { tracing.End(span, err) }()
 
 	col := m.client.Database(m.database).Collection(m.collection)
 
-	filter := bson.D{bson.E{Key: "id", Value: item.ID}}
 	upd := bson.D{
 		bson.E{
-			Key: "$set", Value: item},
+			Key: "$set", Value: bson.D{bson.E{Key: "name", Value: it.Name}}},
+		bson.E{
+			Key: "$inc", Value: bson.D{bson.E{Key: "version", Value: int64(1)}}},
 	}
-	_, err := col.UpdateOne(ctx, filter, upd)
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var updated item
+	err = col.FindOneAndUpdate(ctx, versionFilter(it.ID, it.Version), upd, opts).Decode(&updated)
+	if err == mongo.ErrNoDocuments {
+		return item{}, m.mismatch(ctx, it.ID)
+	}
+
+	return updated, mapErr(err)
+}
+
+// ModifyItem изменяет объект функцией fn. Документ обновляется
+// условно, только если его версия не изменилась с момента чтения,
+// поэтому одновременные частичные изменения от разных клиентов
+// не затирают друг друга: проигравший перечитывает документ
+// и применяет fn заново.
+func (m *Mongo) ModifyItem(ctx context.Context, id, version int64, fn domain.ModifyFunc) (_ item, err error) {
+	ctx, span := m.span(ctx, "modify_item")
+	defer func() { tracing.End(span, err) }()
+
+	return domain.Modify(ctx, m, id, version, fn)
+}
+
+// tracer создает спаны операций с БД.
+var tracer = otel.Tracer("github.com/rtemka/rbtest/pkg/repo/mongo")
 
+// span начинает спан операции op с текущей коллекцией.
+func (m *Mongo) span(ctx context.Context, op string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "mongo."+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemMongoDB,
+			semconv.DBNamespace(m.database),
+			semconv.DBCollectionName(m.collection),
+			semconv.DBOperationName(op),
+		))
+}
+
+// mapErr переводит ошибки драйвера в ошибки domain: таймауты
+// драйвера в context.DeadlineExceeded, сетевые ошибки и ошибки
+// выбора сервера в domain.ErrUnavailable. Исходная ошибка
+// сохраняется в тексте.
+func mapErr(err error) error {
+	var sel topology.ServerSelectionError
+	switch {
+	case err == nil,
+		errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, context.Canceled):
+		return err
+	case mongo.IsTimeout(err):
+		return fmt.Errorf("%w: %v", context.DeadlineExceeded, err)
+	case mongo.IsNetworkError(err), errors.As(err, &sel):
+		return fmt.Errorf("%w: %v", domain.ErrUnavailable, err)
+	}
 	return err
 }
+
+// versionFilter строит фильтр по id и, если version не 0, по версии.
+func versionFilter(id, version int64) bson.D {
+	filter := bson.D{bson.E{Key: "id", Value: id}}
+	if version != 0 {
+		filter = append(filter, bson.E{Key: "version", Value: version})
+	}
+	return filter
+}
+
+// mismatch выясняет, почему условное изменение объекта
+// не затронуло ни одного документа: объекта нет в БД
+// (domain.ErrNotFound) или не совпала версия (domain.ErrConflict).
+func (m *Mongo) mismatch(ctx context.Context, id int64) error {
+	col := m.client.Database(m.database).Collection(m.collection)
+	n, err := col.CountDocuments(ctx, bson.D{bson.E{Key: "id", Value: id}})
+	switch {
+	case err != nil:
+		return mapErr(err)
+	case n == 0:
+		return domain.ErrNotFound
+	}
+	return domain.ErrConflict
+}
+
+// changeEvent событие потока изменений mongo.
+type changeEvent struct {
+	OperationType            string `bson:"operationType"`
+	FullDocument             *item  `bson:"fullDocument"`
+	FullDocumentBeforeChange *item  `bson:"fullDocumentBeforeChange"`
+}
+
+// change превращает событие mongo в изменение объекта.
+// Возвращает false для событий, не касающихся объектов.
+func (ev changeEvent) change() (domain.Change, bool) {
+	switch ev.OperationType {
+	case "insert", "update", "replace":
+		if ev.FullDocument == nil {
+			// документ успел удалиться до того, как его
+			// прочитали, удаление придет следующим событием
+			return domain.Change{}, false
+		}
+		op := domain.ChangeUpdated
+		if ev.OperationType == "insert" {
+			op = domain.ChangeCreated
+		}
+		return domain.Change{Op: op, Item: *ev.FullDocument}, true
+
+	case "delete":
+		if ev.FullDocumentBeforeChange == nil {
+			// без pre-image неизвестен id удаленного объекта
+			return domain.Change{Op: domain.ChangeReset}, true
+		}
+		return domain.Change{Op: domain.ChangeDeleted, Item: *ev.FullDocumentBeforeChange}, true
+
+	case "drop", "rename", "dropDatabase", "invalidate":
+		return domain.Change{Op: domain.ChangeReset}, true
+	}
+	return domain.Change{}, false
+}
+
+// Watch подписывается на поток изменений (change stream) текущей
+// коллекции. Требует replica set и MongoDB 6.0+: id удаленного
+// объекта берется из pre-image документа, поэтому для коллекции
+// должна быть включена опция changeStreamPreAndPostImages, иначе
+// вместо удаления приходит событие domain.ChangeReset.
+// Спан охватывает только подписку, а не время жизни потока.
+func (m *Mongo) Watch(ctx context.Context) (<-chan domain.Change, error) {
+
+	col := m.client.Database(m.database).Collection(m.collection)
+
+	opts := options.ChangeStream().
+		SetFullDocument(options.UpdateLookup).
+		SetFullDocumentBeforeChange(options.WhenAvailable)
+
+	sctx, span := m.span(ctx, "watch")
+	stream, err := col.Watch(sctx, mongo.Pipeline{}, opts)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(chan domain.Change)
+
+	go func() {
+		defer close(changes)
+		defer func() {
+			_ = stream.Close(context.Background())
+		}()
+
+		for stream.Next(ctx) {
+			var ev changeEvent
+			if err := stream.Decode(&ev); err != nil {
+				m.log().WarnContext(ctx, "change stream event decode failed", "err", err)
+				return
+			}
+
+			change, ok := ev.change()
+			if !ok {
+				continue
+			}
+
+			select {
+			case changes <- change:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := stream.Err(); err != nil && ctx.Err() == nil {
+			m.log().WarnContext(ctx, "change stream failed", "err", mapErr(err))
+		}
+	}()
+
+	return changes, nil
+}
@@ -2,9 +2,15 @@ package mongo
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"testing"
+
+	"github.com/rtemka/rbtest/domain"
+	"github.com/rtemka/rbtest/pkg/repo/repotest"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
 )
 
 var tdb *Mongo
@@ -12,13 +18,15 @@ var tdb *Mongo
 const testDBEnv = "TEST_DB_URL"
 
 var testItem1 = item{
-	ID:   1,
-	Name: "test one",
+	ID:      1,
+	Name:    "test one",
+	Version: 1,
 }
 
 var testItem2 = item{
-	ID:   2,
-	Name: "test two",
+	ID:      2,
+	Name:    "test two",
+	Version: 1,
 }
 
 var testData = []any{testItem1, testItem2}
@@ -29,6 +37,9 @@ func restoreDB(db *Mongo) error {
 	if err != nil {
 		return err
 	}
+	if err := db.ensureIndex(context.Background()); err != nil {
+		return err
+	}
 	col := db.client.Database(db.database).Collection(db.collection)
 	_, err = col.InsertMany(context.Background(), testData)
 
@@ -68,20 +79,30 @@ func TestMongo(t *testing.T) {
 
 		want := testItem2
 
-		err := tdb.DeleteItem(context.Background(), want.ID)
+		err := tdb.DeleteItem(context.Background(), want.ID, want.Version+1)
+		if !errors.Is(err, domain.ErrConflict) {
+			t.Fatalf("DeleteItem() = err %v, want %v", err, domain.ErrConflict)
+		}
+
+		err = tdb.DeleteItem(context.Background(), want.ID, want.Version)
 		if err != nil {
 			t.Fatalf("DeleteItem() = err %v", err)
 		}
 
 		got, err := tdb.Item(context.Background(), want.ID)
-		if err != nil && err != ErrNoDocuments {
-			t.Fatalf("Item() = err %v", err)
+		if !errors.Is(err, domain.ErrNotFound) {
+			t.Fatalf("Item() = err %v, want %v", err, domain.ErrNotFound)
 		}
 
 		if got != (item{}) {
 			t.Errorf("DeleteItem() got = %v, want nothing", got)
 		}
 
+		err = tdb.DeleteItem(context.Background(), want.ID, 0)
+		if !errors.Is(err, domain.ErrNotFound) {
+			t.Errorf("DeleteItem() = err %v, want %v", err, domain.ErrNotFound)
+		}
+
 	})
 
 	t.Run("AddItem", func(t *testing.T) {
@@ -104,23 +125,308 @@ func TestMongo(t *testing.T) {
 
 	})
 
+	t.Run("CreateItem", func(t *testing.T) {
+
+		want := item{Name: "test created"}
+
+		got, err := tdb.CreateItem(context.Background(), want)
+		if err != nil {
+			t.Fatalf("CreateItem() = err %v", err)
+		}
+
+		if got.ID <= testItem2.ID {
+			t.Errorf("CreateItem() id = %d, want > %d", got.ID, testItem2.ID)
+		}
+
+		stored, err := tdb.Item(context.Background(), got.ID)
+		if err != nil {
+			t.Fatalf("Item() = err %v", err)
+		}
+
+		if stored != got {
+			t.Errorf("CreateItem() = %v, want %v", stored, got)
+		}
+
+		next, err := tdb.CreateItem(context.Background(), want)
+		if err != nil {
+			t.Fatalf("CreateItem() = err %v", err)
+		}
+
+		if next.ID <= got.ID {
+			t.Errorf("CreateItem() id = %d, want > %d", next.ID, got.ID)
+		}
+	})
+
+	t.Run("ListItems", func(t *testing.T) {
+
+		q := domain.ListQuery{Limit: 1, NamePrefix: "test"}
+
+		first, err := tdb.ListItems(context.Background(), q)
+		if err != nil {
+			t.Fatalf("ListItems() = err %v", err)
+		}
+
+		if len(first.Items) != 1 || first.Items[0] != testItem1 || first.Next == nil {
+			t.Fatalf("ListItems() = %v, want page with %v and cursor", first, testItem1)
+		}
+
+		q.After = first.Next
+		second, err := tdb.ListItems(context.Background(), q)
+		if err != nil {
+			t.Fatalf("ListItems() = err %v", err)
+		}
+
+		if len(second.Items) != 1 || second.Items[0] != testItem2 {
+			t.Errorf("ListItems() = %v, want page with %v", second, testItem2)
+		}
+	})
+
 	t.Run("UpdateItem()", func(t *testing.T) {
 		want := testItem1
 		want.Name = "upd name"
 
-		err := tdb.UpdateItem(context.Background(), want)
+		got, err := tdb.UpdateItem(context.Background(), want)
 		if err != nil {
 			t.Fatalf("UpdateItem() error = %v", err)
 		}
 
-		got, err := tdb.Item(context.Background(), want.ID)
+		want.Version++
+		if got != want {
+			t.Errorf("UpdateItem() got = %v, want = %v", got, want)
+		}
+
+		stored, err := tdb.Item(context.Background(), want.ID)
 		if err != nil {
 			t.Fatalf("Item() error = %v", err)
 		}
 
-		if got != want {
-			t.Errorf("UpdateItem() got = %v, want = %v", got, want)
+		if stored != want {
+			t.Errorf("UpdateItem() stored = %v, want = %v", stored, want)
+		}
+
+		// устаревшая версия
+		_, err = tdb.UpdateItem(context.Background(), testItem1)
+		if !errors.Is(err, domain.ErrConflict) {
+			t.Errorf("UpdateItem() = err %v, want %v", err, domain.ErrConflict)
+		}
+
+		_, err = tdb.UpdateItem(context.Background(), item{ID: 999, Name: "missing"})
+		if !errors.Is(err, domain.ErrNotFound) {
+			t.Errorf("UpdateItem() = err %v, want %v", err, domain.ErrNotFound)
+		}
+	})
+
+}
+
+func TestConformance(t *testing.T) {
+	connstr, ok := os.LookupEnv(testDBEnv)
+	if !ok {
+		t.Skipf("you should set %q env variable to run this test, skipped...", testDBEnv)
+	}
+
+	repotest.RunConformance(t, func(t *testing.T) domain.Repository {
+		db, err := New(connstr, "conformancedb", "items")
+		if err != nil {
+			t.Fatalf("New() = err %v", err)
+		}
+		t.Cleanup(func() { _ = db.Close() })
+
+		if err := db.client.Database(db.database).Drop(context.Background()); err != nil {
+			t.Fatalf("Drop() = err %v", err)
 		}
+		if err := db.ensureIndex(context.Background()); err != nil {
+			t.Fatalf("ensureIndex() = err %v", err)
+		}
+		return db
 	})
+}
+
+func TestChangeEvent(t *testing.T) {
+	tests := []struct {
+		name   string
+		ev     changeEvent
+		want   domain.Change
+		wantOk bool
+	}{
+		{
+			name:   "insert",
+			ev:     changeEvent{OperationType: "insert", FullDocument: &testItem1},
+			want:   domain.Change{Op: domain.ChangeCreated, Item: testItem1},
+			wantOk: true,
+		},
+		{
+			name:   "update",
+			ev:     changeEvent{OperationType: "update", FullDocument: &testItem2},
+			want:   domain.Change{Op: domain.ChangeUpdated, Item: testItem2},
+			wantOk: true,
+		},
+		{
+			name: "updateOfDeleted",
+			ev:   changeEvent{OperationType: "update"},
+		},
+		{
+			name:   "delete",
+			ev:     changeEvent{OperationType: "delete", FullDocumentBeforeChange: &testItem1},
+			want:   domain.Change{Op: domain.ChangeDeleted, Item: testItem1},
+			wantOk: true,
+		},
+		{
+			name:   "deleteWithoutPreImage",
+			ev:     changeEvent{OperationType: "delete"},
+			want:   domain.Change{Op: domain.ChangeReset},
+			wantOk: true,
+		},
+		{
+			name: "unknown",
+			ev:   changeEvent{OperationType: "create"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.ev.change()
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("change() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
 
+// TestBatchSettle проверяет, как неатомарный пакет выясняет
+// результат записей, которые не применились целиком, потому что
+// другой клиент изменил объекты между проверкой и BulkWrite.
+func TestBatchSettle(t *testing.T) {
+	a := item{ID: 1, Name: "a", Version: 1}
+	update := func(name string, version int64) domain.BatchOperation {
+		return domain.BatchOperation{Op: domain.BatchUpdate, Item: item{ID: a.ID, Name: name, Version: version}}
+	}
+
+	tests := []struct {
+		name      string
+		ops       []domain.BatchOperation
+		current   []item         // состояние после BulkWrite
+		upserted  map[int64]bool // записи, добавившие документ
+		stopped   int            // -1 - запись не прерывалась
+		wantErrs  []error
+		wantRaced []int
+	}{
+		{
+			name:     "applied",
+			ops:      []domain.BatchOperation{update("b", 1)},
+			current:  []item{{ID: a.ID, Name: "b", Version: 2}},
+			stopped:  -1,
+			wantErrs: []error{nil},
+		},
+		{
+			// версия та же, что ждали, но записал ее другой клиент
+			name:     "conflicting update",
+			ops:      []domain.BatchOperation{update("b", 1)},
+			current:  []item{{ID: a.ID, Name: "other", Version: 2}},
+			stopped:  -1,
+			wantErrs: []error{domain.ErrConflict},
+		},
+		{
+			name:      "conflicting update without version",
+			ops:       []domain.BatchOperation{update("b", 0)},
+			current:   []item{{ID: a.ID, Name: "other", Version: 2}},
+			stopped:   -1,
+			wantErrs:  []error{domain.ErrConflict},
+			wantRaced: []int{0},
+		},
+		{
+			name:      "deleted",
+			ops:       []domain.BatchOperation{update("b", 0)},
+			stopped:   -1,
+			wantErrs:  []error{domain.ErrNotFound},
+			wantRaced: []int{0},
+		},
+		{
+			// первая запись применилась, раз применилась вторая,
+			// условие которой - версия после первой
+			name:     "chained updates",
+			ops:      []domain.BatchOperation{update("b", 1), update("c", 0)},
+			current:  []item{{ID: a.ID, Name: "c", Version: 3}},
+			stopped:  -1,
+			wantErrs: []error{nil, nil},
+		},
+		{
+			// по состоянию после пакета не понять, применилась
+			// ли первая запись, и она не считается примененной
+			name:      "chained updates lost",
+			ops:       []domain.BatchOperation{update("b", 1), update("c", 0)},
+			current:   []item{{ID: a.ID, Name: "other", Version: 3}},
+			stopped:   -1,
+			wantErrs:  []error{domain.ErrConflict, domain.ErrConflict},
+			wantRaced: []int{1},
+		},
+		{
+			name: "put raced by insert",
+			ops: []domain.BatchOperation{
+				{Op: domain.BatchPut, Item: item{ID: 5, Name: "new"}},
+				{Op: domain.BatchCreate, Item: item{ID: 6, Name: "new"}},
+			},
+			current:   []item{a, {ID: 5, Name: "other", Version: 1}, {ID: 6, Name: "new", Version: 1}},
+			upserted:  map[int64]bool{1: true},
+			stopped:   -1,
+			wantErrs:  []error{domain.ErrConflict, nil},
+			wantRaced: []int{0},
+		},
+		{
+			name:     "stopped",
+			ops:      []domain.BatchOperation{update("b", 1), {Op: domain.BatchDelete, Item: item{ID: a.ID}}},
+			current:  []item{{ID: a.ID, Name: "b", Version: 2}},
+			stopped:  1,
+			wantErrs: []error{nil},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPlan(tt.ops, 100, map[int64]item{a.ID: a})
+			current := make(map[int64]item)
+			for _, it := range tt.current {
+				current[it.ID] = it
+			}
+			upserted := make(map[int64]interface{})
+			for k := range tt.upserted {
+				upserted[k] = k
+			}
+			stopped := tt.stopped
+			if stopped < 0 {
+				stopped = len(p.models)
+			}
+
+			raced := p.settle(tt.ops, upserted, stopped, current)
+
+			for i, want := range tt.wantErrs {
+				if err := p.results[i].Err; !errors.Is(err, want) {
+					t.Errorf("settle() op %d = err %v, want %v", i, err, want)
+				}
+			}
+			if fmt.Sprint(raced) != fmt.Sprint(tt.wantRaced) {
+				t.Errorf("settle() raced = %v, want %v", raced, tt.wantRaced)
+			}
+		})
+	}
+}
+
+func TestMapErr(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{name: "nil", err: nil, want: nil},
+		{name: "deadline", err: context.DeadlineExceeded, want: context.DeadlineExceeded},
+		{name: "serverSelection", err: topology.ServerSelectionError{Wrapped: errors.New("no reachable servers")}, want: domain.ErrUnavailable},
+		{name: "other", err: mongo.ErrNilDocument, want: mongo.ErrNilDocument},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mapErr(tt.err); !errors.Is(got, tt.want) {
+				t.Errorf("mapErr() = %v, want %v", got, tt.want)
+			}
+		})
+	}
 }
@@ -0,0 +1,133 @@
+// Пакет observe оборачивает БД, сообщая о каждом вызове:
+// операции, длительности и ошибке. На нем построены метрики
+// и журнал вызовов БД.
+package observe
+
+import (
+	"context"
+	"time"
+
+	"github.com/rtemka/rbtest/domain"
+)
+
+type item = domain.Item
+type repo = domain.Repository
+
+// Func получает результат вызова БД. ctx - контекст вызова,
+// op - имя операции, например, "create_item".
+type Func func(ctx context.Context, op string, d time.Duration, err error)
+
+// Wrap возвращает обертку над r, которая вызывает fn после
+// каждого вызова БД, кроме Close. Если r умеет сообщать
+// об изменениях (domain.Watcher), обертка тоже умеет.
+func Wrap(r repo, fn Func) repo {
+	or := &repository{repo: r, fn: fn}
+	if w, ok := r.(domain.Watcher); ok {
+		return &watchingRepository{repository: or, w: w}
+	}
+	return or
+}
+
+// repository обертка над БД.
+type repository struct {
+	repo repo
+	fn   Func
+}
+
+func (r *repository) observe(ctx context.Context, op string, start time.Time, err error) {
+	r.fn(ctx, op, time.Since(start), err)
+}
+
+func (r *repository) Items(ctx context.Context) ([]item, error) {
+	start := time.Now()
+	items, err := r.repo.Items(ctx)
+	r.observe(ctx, "items", start, err)
+	return items, err
+}
+
+// IterateItems обходит объекты БД. Ошибка fn ошибкой БД
+// не считается.
+func (r *repository) IterateItems(ctx context.Context, fn func(item) error) error {
+	var fnErr error
+	start := time.Now()
+	err := domain.Iterate(ctx, r.repo, func(it item) error {
+		fnErr = fn(it)
+		return fnErr
+	})
+	if err != nil && err == fnErr {
+		r.observe(ctx, "iterate_items", start, nil)
+	} else {
+		r.observe(ctx, "iterate_items", start, err)
+	}
+	return err
+}
+
+func (r *repository) Item(ctx context.Context, id int64) (item, error) {
+	start := time.Now()
+	it, err := r.repo.Item(ctx, id)
+	r.observe(ctx, "item", start, err)
+	return it, err
+}
+
+func (r *repository) ListItems(ctx context.Context, q domain.ListQuery) (domain.ItemsPage, error) {
+	start := time.Now()
+	page, err := r.repo.ListItems(ctx, q)
+	r.observe(ctx, "list_items", start, err)
+	return page, err
+}
+
+func (r *repository) CreateItem(ctx context.Context, it item) (item, error) {
+	start := time.Now()
+	it, err := r.repo.CreateItem(ctx, it)
+	r.observe(ctx, "create_item", start, err)
+	return it, err
+}
+
+func (r *repository) DeleteItem(ctx context.Context, id, version int64) error {
+	start := time.Now()
+	err := r.repo.DeleteItem(ctx, id, version)
+	r.observe(ctx, "delete_item", start, err)
+	return err
+}
+
+func (r *repository) UpdateItem(ctx context.Context, it item) (item, error) {
+	start := time.Now()
+	it, err := r.repo.UpdateItem(ctx, it)
+	r.observe(ctx, "update_item", start, err)
+	return it, err
+}
+
+func (r *repository) ModifyItem(ctx context.Context, id, version int64, fn domain.ModifyFunc) (item, error) {
+	start := time.Now()
+	it, err := r.repo.ModifyItem(ctx, id, version, fn)
+	r.observe(ctx, "modify_item", start, err)
+	return it, err
+}
+
+// Batch сообщает о пакете одним вызовом, ошибки отдельных
+// операций не учитываются.
+func (r *repository) Batch(ctx context.Context, ops []domain.BatchOperation, atomic bool) ([]domain.BatchResult, error) {
+	start := time.Now()
+	res, err := r.repo.Batch(ctx, ops, atomic)
+	r.observe(ctx, "batch", start, err)
+	return res, err
+}
+
+func (r *repository) Close() error {
+	return r.repo.Close()
+}
+
+// watchingRepository обертка над БД, которая умеет
+// сообщать об изменениях.
+type watchingRepository struct {
+	*repository
+	w domain.Watcher
+}
+
+// Watch сообщает только о подписке, а не о времени ее жизни.
+func (r *watchingRepository) Watch(ctx context.Context) (<-chan domain.Change, error) {
+	start := time.Now()
+	changes, err := r.w.Watch(ctx)
+	r.observe(ctx, "watch", start, err)
+	return changes, err
+}
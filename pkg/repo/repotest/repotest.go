@@ -0,0 +1,783 @@
+// Пакет repotest содержит общий набор тестов, которому
+// должна удовлетворять любая реализация domain.Repository.
+package repotest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rtemka/rbtest/domain"
+)
+
+type item = domain.Item
+
+// Factory возвращает новый пустой репозиторий для одного теста.
+// Освобождение ресурсов репозитория фабрика регистрирует сама
+// через t.Cleanup.
+type Factory func(t *testing.T) domain.Repository
+
+// RunConformance проверяет, что репозиторий ведет себя так,
+// как того требует контракт domain.Repository. Каждый подтест
+// получает от factory новый репозиторий. Необязательные
+// возможности (например, domain.Watcher) проверяются, только
+// если репозиторий их реализует.
+func RunConformance(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, repo domain.Repository)
+	}{
+		{"CreateItem", testCreateItem},
+		{"Items", testItems},
+		{"ListItems", testListItems},
+		{"Iterate", testIterate},
+		{"UpdateItem", testUpdateItem},
+		{"DeleteItem", testDeleteItem},
+		{"ModifyItem", testModifyItem},
+		{"Batch", testBatch},
+		{"BatchAtomic", testBatchAtomic},
+		{"BatchPut", testBatchPut},
+		{"NotFound", testNotFound},
+		{"ConcurrentCreate", testConcurrentCreate},
+		{"ConcurrentUpdate", testConcurrentUpdate},
+		{"ConcurrentModify", testConcurrentModify},
+		{"ConcurrentBatch", testConcurrentBatch},
+		{"ContextCanceled", testContextCanceled},
+		{"Watch", testWatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, factory(t))
+		})
+	}
+}
+
+// create добавляет в репозиторий объекты с указанными именами.
+func create(t *testing.T, repo domain.Repository, names ...string) []item {
+	t.Helper()
+	out := make([]item, 0, len(names))
+	for _, name := range names {
+		it, err := repo.CreateItem(context.Background(), item{Name: name})
+		if err != nil {
+			t.Fatalf("CreateItem() = err %v", err)
+		}
+		out = append(out, it)
+	}
+	return out
+}
+
+func testCreateItem(t *testing.T, repo domain.Repository) {
+	ctx := context.Background()
+
+	// переданные id и версия игнорируются
+	first, err := repo.CreateItem(ctx, item{ID: 100, Name: "first", Version: 7})
+	if err != nil {
+		t.Fatalf("CreateItem() = err %v", err)
+	}
+	if first.ID <= 0 || first.Name != "first" || first.Version != 1 {
+		t.Errorf("CreateItem() = %v, want positive id, name %q and version 1", first, "first")
+	}
+
+	second := create(t, repo, "second")[0]
+	if second.ID <= first.ID {
+		t.Errorf("CreateItem() id = %d, want > %d", second.ID, first.ID)
+	}
+
+	got, err := repo.Item(ctx, first.ID)
+	if err != nil {
+		t.Fatalf("Item() = err %v", err)
+	}
+	if got != first {
+		t.Errorf("Item() = %v, want %v", got, first)
+	}
+}
+
+func testItems(t *testing.T, repo domain.Repository) {
+	want := create(t, repo, "a", "b", "c")
+
+	got, err := repo.Items(context.Background())
+	if err != nil {
+		t.Fatalf("Items() = err %v", err)
+	}
+
+	if err := sameItems(got, want); err != nil {
+		t.Errorf("Items() %v", err)
+	}
+}
+
+func testListItems(t *testing.T, repo domain.Repository) {
+	ctx := context.Background()
+	all := create(t, repo, "pear", "apple", "plum", "apricot", "peach")
+
+	t.Run("Pages", func(t *testing.T) {
+		q := domain.ListQuery{Limit: 2}
+		var got []item
+		for pages := 0; ; pages++ {
+			if pages > len(all) {
+				t.Fatalf("ListItems() does not stop paging")
+			}
+			page, err := repo.ListItems(ctx, q)
+			if err != nil {
+				t.Fatalf("ListItems() = err %v", err)
+			}
+			if len(page.Items) > 2 {
+				t.Fatalf("ListItems() page len = %d, want <= 2", len(page.Items))
+			}
+			got = append(got, page.Items...)
+			if page.Next == nil {
+				break
+			}
+			q.After = page.Next
+		}
+		if err := sameOrder(got, all); err != nil {
+			t.Errorf("ListItems() %v", err)
+		}
+	})
+
+	t.Run("SortByNameDesc", func(t *testing.T) {
+		page, err := repo.ListItems(ctx, domain.ListQuery{Sort: domain.SortByName, Desc: true})
+		if err != nil {
+			t.Fatalf("ListItems() = err %v", err)
+		}
+		want := []item{all[2], all[0], all[4], all[3], all[1]}
+		if err := sameOrder(page.Items, want); err != nil {
+			t.Errorf("ListItems() %v", err)
+		}
+	})
+
+	t.Run("Filters", func(t *testing.T) {
+		page, err := repo.ListItems(ctx, domain.ListQuery{NamePrefix: "p", NameContains: "a"})
+		if err != nil {
+			t.Fatalf("ListItems() = err %v", err)
+		}
+		want := []item{all[0], all[4]}
+		if err := sameOrder(page.Items, want); err != nil {
+			t.Errorf("ListItems() %v", err)
+		}
+	})
+}
+
+func testIterate(t *testing.T, repo domain.Repository) {
+	ctx := context.Background()
+	want := create(t, repo, "c", "a", "b")
+
+	var got []item
+	err := domain.Iterate(ctx, repo, func(it item) error {
+		got = append(got, it)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Iterate() = err %v", err)
+	}
+	if err := sameOrder(got, want); err != nil {
+		t.Errorf("Iterate() %v", err)
+	}
+
+	// ошибка fn останавливает обход
+	errStop := errors.New("stop")
+	calls := 0
+	err = domain.Iterate(ctx, repo, func(item) error {
+		calls++
+		return errStop
+	})
+	if !errors.Is(err, errStop) || calls != 1 {
+		t.Errorf("Iterate() = err %v after %d calls, want %v after 1 call", err, calls, errStop)
+	}
+}
+
+func testUpdateItem(t *testing.T, repo domain.Repository) {
+	ctx := context.Background()
+	orig := create(t, repo, "orig")[0]
+
+	want := orig
+	want.Name = "updated"
+
+	got, err := repo.UpdateItem(ctx, want)
+	if err != nil {
+		t.Fatalf("UpdateItem() = err %v", err)
+	}
+	want.Version++
+	if got != want {
+		t.Errorf("UpdateItem() = %v, want %v", got, want)
+	}
+
+	stored, err := repo.Item(ctx, orig.ID)
+	if err != nil {
+		t.Fatalf("Item() = err %v", err)
+	}
+	if stored != want {
+		t.Errorf("Item() = %v, want %v", stored, want)
+	}
+
+	// устаревшая версия
+	_, err = repo.UpdateItem(ctx, orig)
+	if !errors.Is(err, domain.ErrConflict) {
+		t.Errorf("UpdateItem() stale = err %v, want %v", err, domain.ErrConflict)
+	}
+
+	// без проверки версии
+	got, err = repo.UpdateItem(ctx, item{ID: orig.ID, Name: "forced"})
+	if err != nil {
+		t.Fatalf("UpdateItem() = err %v", err)
+	}
+	if got.Version != want.Version+1 {
+		t.Errorf("UpdateItem() version = %d, want %d", got.Version, want.Version+1)
+	}
+}
+
+func testDeleteItem(t *testing.T, repo domain.Repository) {
+	ctx := context.Background()
+	items := create(t, repo, "doomed", "survivor")
+
+	err := repo.DeleteItem(ctx, items[0].ID, items[0].Version+1)
+	if !errors.Is(err, domain.ErrConflict) {
+		t.Errorf("DeleteItem() stale = err %v, want %v", err, domain.ErrConflict)
+	}
+
+	if err := repo.DeleteItem(ctx, items[0].ID, items[0].Version); err != nil {
+		t.Fatalf("DeleteItem() = err %v", err)
+	}
+
+	if _, err := repo.Item(ctx, items[0].ID); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("Item() deleted = err %v, want %v", err, domain.ErrNotFound)
+	}
+
+	got, err := repo.Items(ctx)
+	if err != nil {
+		t.Fatalf("Items() = err %v", err)
+	}
+	if err := sameItems(got, items[1:]); err != nil {
+		t.Errorf("Items() %v", err)
+	}
+
+	// без проверки версии
+	if err := repo.DeleteItem(ctx, items[1].ID, 0); err != nil {
+		t.Errorf("DeleteItem() = err %v", err)
+	}
+}
+
+func testModifyItem(t *testing.T, repo domain.Repository) {
+	ctx := context.Background()
+	orig := create(t, repo, "orig")[0]
+
+	rename := func(name string) domain.ModifyFunc {
+		return func(it item) (item, error) {
+			it.Name = name
+			it.ID, it.Version = 0, 100 // должны игнорироваться
+			return it, nil
+		}
+	}
+
+	got, err := repo.ModifyItem(ctx, orig.ID, orig.Version, rename("modified"))
+	if err != nil {
+		t.Fatalf("ModifyItem() = err %v", err)
+	}
+	want := item{ID: orig.ID, Name: "modified", Version: orig.Version + 1}
+	if got != want {
+		t.Errorf("ModifyItem() = %v, want %v", got, want)
+	}
+
+	stored, err := repo.Item(ctx, orig.ID)
+	if err != nil {
+		t.Fatalf("Item() = err %v", err)
+	}
+	if stored != want {
+		t.Errorf("Item() = %v, want %v", stored, want)
+	}
+
+	// устаревшая версия
+	_, err = repo.ModifyItem(ctx, orig.ID, orig.Version, rename("stale"))
+	if !errors.Is(err, domain.ErrConflict) {
+		t.Errorf("ModifyItem() stale = err %v, want %v", err, domain.ErrConflict)
+	}
+
+	// ошибка fn отменяет изменение
+	errAbort := errors.New("abort")
+	_, err = repo.ModifyItem(ctx, orig.ID, 0, func(item) (item, error) { return item{}, errAbort })
+	if !errors.Is(err, errAbort) {
+		t.Errorf("ModifyItem() aborted = err %v, want %v", err, errAbort)
+	}
+	if stored, _ := repo.Item(ctx, orig.ID); stored != want {
+		t.Errorf("Item() after abort = %v, want %v", stored, want)
+	}
+
+	_, err = repo.ModifyItem(ctx, 1<<40, 0, rename("missing"))
+	if !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("ModifyItem() missing = err %v, want %v", err, domain.ErrNotFound)
+	}
+}
+
+// batchErrs сравнивает ошибки результатов пакета с ожидаемыми.
+func batchErrs(t *testing.T, results []domain.BatchResult, want []error) {
+	t.Helper()
+	if len(results) != len(want) {
+		t.Fatalf("Batch() = %d results, want %d", len(results), len(want))
+	}
+	for i, res := range results {
+		if !errors.Is(res.Err, want[i]) || (want[i] == nil) != (res.Err == nil) {
+			t.Errorf("Batch() op %d = err %v, want %v", i, res.Err, want[i])
+		}
+	}
+}
+
+func testBatch(t *testing.T, repo domain.Repository) {
+	ctx := context.Background()
+	items := create(t, repo, "a", "b", "c")
+	a, b, c := items[0], items[1], items[2]
+
+	ops := []domain.BatchOperation{
+		{Op: domain.BatchCreate, Item: item{Name: "new"}},
+		{Op: domain.BatchUpdate, Item: item{ID: a.ID, Name: "a2", Version: a.Version}},
+		{Op: domain.BatchUpdate, Item: item{ID: b.ID, Name: "b2", Version: b.Version + 1}},
+		{Op: domain.BatchDelete, Item: item{ID: c.ID, Version: c.Version}},
+		{Op: domain.BatchDelete, Item: item{ID: 1 << 40}},
+		// видит результат второй операции
+		{Op: domain.BatchUpdate, Item: item{ID: a.ID, Name: "a3", Version: a.Version + 1}},
+	}
+
+	results, err := repo.Batch(ctx, ops, false)
+	if err != nil {
+		t.Fatalf("Batch() = err %v", err)
+	}
+	batchErrs(t, results, []error{nil, nil, domain.ErrConflict, nil, domain.ErrNotFound, nil})
+
+	created := results[0].Item
+	if created.ID == 0 || created.Name != "new" || created.Version != 1 {
+		t.Errorf("Batch() created = %v", created)
+	}
+	wantA := item{ID: a.ID, Name: "a3", Version: a.Version + 2}
+	if results[5].Item != wantA {
+		t.Errorf("Batch() updated = %v, want %v", results[5].Item, wantA)
+	}
+
+	got, err := repo.Items(ctx)
+	if err != nil {
+		t.Fatalf("Items() = err %v", err)
+	}
+	if err := sameItems(got, []item{wantA, b, created}); err != nil {
+		t.Errorf("Items() after batch %v", err)
+	}
+}
+
+func testBatchPut(t *testing.T, repo domain.Repository) {
+	ctx := context.Background()
+	a := create(t, repo, "a")[0]
+	id := a.ID + 100
+
+	ops := []domain.BatchOperation{
+		{Op: domain.BatchCreate, Item: item{ID: id, Name: "explicit"}},
+		{Op: domain.BatchCreate, Item: item{ID: a.ID, Name: "taken"}},
+		{Op: domain.BatchPut, Item: item{ID: a.ID, Name: "a2"}},
+		{Op: domain.BatchPut, Item: item{ID: id + 1, Name: "put"}},
+		{Op: domain.BatchPut, Item: item{ID: a.ID, Name: "stale", Version: a.Version}},
+	}
+
+	results, err := repo.Batch(ctx, ops, false)
+	if err != nil {
+		t.Fatalf("Batch() = err %v", err)
+	}
+	batchErrs(t, results, []error{nil, domain.ErrConflict, nil, nil, domain.ErrConflict})
+	for i, want := range []bool{true, false, false, true, false} {
+		if results[i].Created != want {
+			t.Errorf("Batch() op %d created = %t, want %t", i, results[i].Created, want)
+		}
+	}
+
+	want := []item{
+		{ID: a.ID, Name: "a2", Version: a.Version + 1},
+		{ID: id, Name: "explicit", Version: 1},
+		{ID: id + 1, Name: "put", Version: 1},
+	}
+	for i, k := range []int{2, 0, 3} {
+		if results[k].Item != want[i] {
+			t.Errorf("Batch() op %d = %v, want %v", k, results[k].Item, want[i])
+		}
+	}
+
+	// новые id назначаются после наибольшего
+	next := create(t, repo, "next")[0]
+	if next.ID <= id+1 {
+		t.Errorf("CreateItem() id = %d, want > %d", next.ID, id+1)
+	}
+
+	got, err := repo.Items(ctx)
+	if err != nil {
+		t.Fatalf("Items() = err %v", err)
+	}
+	if err := sameItems(got, append(want, next)); err != nil {
+		t.Errorf("Items() after batch %v", err)
+	}
+
+	// явный id, следующий за наибольшим, и новый объект
+	// без id в одном пакете (импорт файла, где id есть
+	// не у всех строк) не претендуют на один id
+	ops = []domain.BatchOperation{
+		{Op: domain.BatchPut, Item: item{ID: next.ID + 1, Name: "with id"}},
+		{Op: domain.BatchCreate, Item: item{ID: next.ID + 2, Name: "with id too"}},
+		{Op: domain.BatchCreate, Item: item{Name: "without id"}},
+	}
+	results, err = repo.Batch(ctx, ops, false)
+	if err != nil {
+		t.Fatalf("Batch() = err %v", err)
+	}
+	batchErrs(t, results, []error{nil, nil, nil})
+	if id := results[2].Item.ID; id <= next.ID+2 {
+		t.Errorf("Batch() new item id = %d, want > %d", id, next.ID+2)
+	}
+}
+
+func testBatchAtomic(t *testing.T, repo domain.Repository) {
+	ctx := context.Background()
+	items := create(t, repo, "a", "b")
+	a, b := items[0], items[1]
+
+	ops := []domain.BatchOperation{
+		{Op: domain.BatchCreate, Item: item{Name: "new"}},
+		{Op: domain.BatchUpdate, Item: item{ID: a.ID, Name: "a2", Version: a.Version}},
+		{Op: domain.BatchDelete, Item: item{ID: b.ID, Version: b.Version + 1}},
+	}
+
+	results, err := repo.Batch(ctx, ops, true)
+	if err != nil {
+		t.Fatalf("Batch() = err %v", err)
+	}
+	batchErrs(t, results, []error{domain.ErrAborted, domain.ErrAborted, domain.ErrConflict})
+
+	got, err := repo.Items(ctx)
+	if err != nil {
+		t.Fatalf("Items() = err %v", err)
+	}
+	if err := sameItems(got, items); err != nil {
+		t.Errorf("Items() after aborted batch %v", err)
+	}
+
+	ops[2].Item.Version = b.Version
+	results, err = repo.Batch(ctx, ops, true)
+	if err != nil {
+		t.Fatalf("Batch() = err %v", err)
+	}
+	batchErrs(t, results, []error{nil, nil, nil})
+
+	got, err = repo.Items(ctx)
+	if err != nil {
+		t.Fatalf("Items() = err %v", err)
+	}
+	want := []item{{ID: a.ID, Name: "a2", Version: a.Version + 1}, results[0].Item}
+	if err := sameItems(got, want); err != nil {
+		t.Errorf("Items() after batch %v", err)
+	}
+}
+
+func testNotFound(t *testing.T, repo domain.Repository) {
+	ctx := context.Background()
+	const missing = 1 << 40
+
+	if _, err := repo.Item(ctx, missing); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("Item() = err %v, want %v", err, domain.ErrNotFound)
+	}
+	if _, err := repo.UpdateItem(ctx, item{ID: missing, Name: "x"}); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("UpdateItem() = err %v, want %v", err, domain.ErrNotFound)
+	}
+	if _, err := repo.UpdateItem(ctx, item{ID: missing, Name: "x", Version: 1}); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("UpdateItem() versioned = err %v, want %v", err, domain.ErrNotFound)
+	}
+	if err := repo.DeleteItem(ctx, missing, 0); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("DeleteItem() = err %v, want %v", err, domain.ErrNotFound)
+	}
+}
+
+func testConcurrentCreate(t *testing.T, repo domain.Repository) {
+	const writers = 20
+
+	var wg sync.WaitGroup
+	created := make(chan item, writers)
+
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			it, err := repo.CreateItem(context.Background(), item{Name: fmt.Sprintf("writer %d", i)})
+			if err != nil {
+				t.Errorf("CreateItem() = err %v", err)
+				return
+			}
+			created <- it
+		}(i)
+	}
+	wg.Wait()
+	close(created)
+
+	var want []item
+	ids := make(map[int64]bool, writers)
+	for it := range created {
+		if ids[it.ID] {
+			t.Errorf("CreateItem() duplicate id %d", it.ID)
+		}
+		ids[it.ID] = true
+		want = append(want, it)
+	}
+
+	got, err := repo.Items(context.Background())
+	if err != nil {
+		t.Fatalf("Items() = err %v", err)
+	}
+	if err := sameItems(got, want); err != nil {
+		t.Errorf("Items() %v", err)
+	}
+}
+
+func testConcurrentUpdate(t *testing.T, repo domain.Repository) {
+	const writers = 10
+	orig := create(t, repo, "contended")[0]
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var won []item
+
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			upd := orig
+			upd.Name = fmt.Sprintf("writer %d", i)
+			got, err := repo.UpdateItem(context.Background(), upd)
+			switch {
+			case err == nil:
+				mu.Lock()
+				won = append(won, got)
+				mu.Unlock()
+			case !errors.Is(err, domain.ErrConflict):
+				t.Errorf("UpdateItem() = err %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(won) != 1 {
+		t.Fatalf("UpdateItem() %d writers won the same version, want 1", len(won))
+	}
+
+	stored, err := repo.Item(context.Background(), orig.ID)
+	if err != nil {
+		t.Fatalf("Item() = err %v", err)
+	}
+	if stored != won[0] {
+		t.Errorf("Item() = %v, want %v", stored, won[0])
+	}
+}
+
+// testConcurrentModify проверяет, что одновременные изменения
+// без проверки версии не теряются: каждое применяется к результату
+// предыдущего.
+func testConcurrentModify(t *testing.T, repo domain.Repository) {
+	const writers = 10
+	orig := create(t, repo, "x")[0]
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := repo.ModifyItem(context.Background(), orig.ID, 0, func(it item) (item, error) {
+				it.Name += "x"
+				return it, nil
+			})
+			if err != nil {
+				t.Errorf("ModifyItem() = err %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	stored, err := repo.Item(context.Background(), orig.ID)
+	if err != nil {
+		t.Fatalf("Item() = err %v", err)
+	}
+	if len(stored.Name) != writers+1 || stored.Version != orig.Version+writers {
+		t.Errorf("Item() = %v, want name of %d chars and version %d",
+			stored, writers+1, orig.Version+writers)
+	}
+}
+
+// testConcurrentBatch проверяет, что одновременные пакеты
+// (например, два импорта или импорт рядом с записью через API)
+// не падают на блокировках БД: каждая операция применяется
+// к результату предыдущей.
+func testConcurrentBatch(t *testing.T, repo domain.Repository) {
+	const (
+		writers = 8
+		rounds  = 10
+		ids     = 5
+	)
+	base := create(t, repo, "base")[0].ID
+
+	ops := make([]domain.BatchOperation, ids)
+	for i := range ops {
+		ops[i] = domain.BatchOperation{Op: domain.BatchPut, Item: item{ID: base + 1 + int64(i), Name: "put"}}
+	}
+
+	var wg sync.WaitGroup
+	var created atomic.Int64
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				results, err := repo.Batch(context.Background(), ops, false)
+				if err != nil {
+					t.Errorf("Batch() = err %v", err)
+					return
+				}
+				for _, res := range results {
+					if res.Err != nil {
+						t.Errorf("Batch() op = err %v", res.Err)
+					}
+					if res.Created {
+						created.Add(1)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := created.Load(); n != ids {
+		t.Errorf("Batch() created %d items, want %d", n, ids)
+	}
+	for _, op := range ops {
+		stored, err := repo.Item(context.Background(), op.Item.ID)
+		if err != nil {
+			t.Fatalf("Item() = err %v", err)
+		}
+		if stored.Version != writers*rounds {
+			t.Errorf("Item() = %v, want version %d", stored, writers*rounds)
+		}
+	}
+}
+
+func testContextCanceled(t *testing.T, repo domain.Repository) {
+	existing := create(t, repo, "existing")[0]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := repo.Items(ctx); err == nil {
+		t.Errorf("Items() = nil, want error")
+	}
+	if _, err := repo.Item(ctx, existing.ID); err == nil {
+		t.Errorf("Item() = nil, want error")
+	}
+	if _, err := repo.ListItems(ctx, domain.ListQuery{}); err == nil {
+		t.Errorf("ListItems() = nil, want error")
+	}
+	if _, err := repo.CreateItem(ctx, item{Name: "canceled"}); err == nil {
+		t.Errorf("CreateItem() = nil, want error")
+	}
+	if _, err := repo.UpdateItem(ctx, item{ID: existing.ID, Name: "canceled"}); err == nil {
+		t.Errorf("UpdateItem() = nil, want error")
+	}
+	if err := repo.DeleteItem(ctx, existing.ID, 0); err == nil {
+		t.Errorf("DeleteItem() = nil, want error")
+	}
+
+	// ни одна из операций не должна была примениться
+	got, err := repo.Items(context.Background())
+	if err != nil {
+		t.Fatalf("Items() = err %v", err)
+	}
+	if err := sameItems(got, []item{existing}); err != nil {
+		t.Errorf("Items() %v", err)
+	}
+}
+
+func testWatch(t *testing.T, repo domain.Repository) {
+	w, ok := repo.(domain.Watcher)
+	if !ok {
+		t.Skip("repository does not implement domain.Watcher")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changes, err := w.Watch(ctx)
+	if err != nil {
+		t.Skipf("Watch() is not available: %v", err)
+	}
+
+	next := func(want domain.ChangeOp) domain.Change {
+		t.Helper()
+		select {
+		case c, ok := <-changes:
+			if !ok {
+				t.Fatalf("Watch() stream closed, want %s", want)
+			}
+			return c
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Watch() timeout waiting for %s", want)
+		}
+		return domain.Change{}
+	}
+
+	created := create(t, repo, "watched")[0]
+	if c := next(domain.ChangeCreated); c.Op != domain.ChangeCreated || c.Item != created {
+		t.Errorf("Watch() = %v, want created %v", c, created)
+	}
+
+	updated, err := repo.UpdateItem(context.Background(), item{ID: created.ID, Name: "watched upd"})
+	if err != nil {
+		t.Fatalf("UpdateItem() = err %v", err)
+	}
+	if c := next(domain.ChangeUpdated); c.Op != domain.ChangeUpdated || c.Item != updated {
+		t.Errorf("Watch() = %v, want updated %v", c, updated)
+	}
+
+	if err := repo.DeleteItem(context.Background(), created.ID, 0); err != nil {
+		t.Fatalf("DeleteItem() = err %v", err)
+	}
+	// без pre-image репозиторий вправе сообщить об удалении как о сбросе
+	c := next(domain.ChangeDeleted)
+	if c.Op != domain.ChangeReset && (c.Op != domain.ChangeDeleted || c.Item.ID != created.ID) {
+		t.Errorf("Watch() = %v, want deleted id %d", c, created.ID)
+	}
+
+	cancel()
+	for range changes {
+		// канал должен закрыться после отмены контекста
+	}
+}
+
+// sameItems сравнивает наборы объектов без учета порядка.
+func sameItems(got, want []item) error {
+	if len(got) != len(want) {
+		return fmt.Errorf("= %v, want %v", got, want)
+	}
+	set := make(map[item]int, len(want))
+	for _, it := range want {
+		set[it]++
+	}
+	for _, it := range got {
+		if set[it] == 0 {
+			return fmt.Errorf("= %v, want %v", got, want)
+		}
+		set[it]--
+	}
+	return nil
+}
+
+// sameOrder сравнивает списки объектов с учетом порядка.
+func sameOrder(got, want []item) error {
+	if len(got) != len(want) {
+		return fmt.Errorf("= %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return fmt.Errorf("= %v, want %v", got, want)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,456 @@
+// Пакет sqlite реализует контракт БД поверх SQLite
+// с драйвером на чистом Go (без cgo).
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rtemka/rbtest/domain"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+type item = domain.Item
+
+// migrations изменения схемы БД по порядку. Номер миграции
+// равен ее индексу плюс один, примененные миграции
+// записываются в таблицу schema_migrations.
+// Уже выпущенные миграции менять нельзя, только добавлять новые.
+var migrations = []string{
+	// 1: таблица объектов, AUTOINCREMENT не дает повторно
+	// выдавать id удаленных объектов
+	`CREATE TABLE items (
+		id      INTEGER PRIMARY KEY AUTOINCREMENT,
+		name    TEXT    NOT NULL,
+		version INTEGER NOT NULL DEFAULT 1
+	)`,
+	// 2: индекс для сортировки и постраничного вывода по имени
+	`CREATE INDEX items_name_id ON items (name, id)`,
+}
+
+// запросы, которые готовятся заранее
+const (
+	qItems  = `SELECT id, name, version FROM items ORDER BY id`
+	qItem   = `SELECT id, name, version FROM items WHERE id = ?`
+	qCreate = `INSERT INTO items (id, name, version) VALUES (NULLIF(?, 0), ?, 1)
+		RETURNING id, name, version`
+	qUpdate = `UPDATE items SET name = ?, version = version + 1
+		WHERE id = ? AND (? = 0 OR version = ?) RETURNING id, name, version`
+	qDelete = `DELETE FROM items WHERE id = ? AND (? = 0 OR version = ?)`
+	qExists = `SELECT EXISTS (SELECT 1 FROM items WHERE id = ?)`
+)
+
+// SQLite структура для выполнения CRUD операций с БД.
+type SQLite struct {
+	db    *sql.DB
+	items *sql.Stmt
+	item  *sql.Stmt
+	add   *sql.Stmt
+	upd   *sql.Stmt
+	del   *sql.Stmt
+	exist *sql.Stmt
+}
+
+// Open открывает или создает файл БД по пути path,
+// применяет недостающие миграции схемы и готовит запросы.
+func Open(path string) (*SQLite, error) {
+	// WAL позволяет читать во время записи, а busy_timeout
+	// заставляет конкурентных писателей ждать, а не падать.
+	// Транзакции сразу берут блокировку на запись (BEGIN
+	// IMMEDIATE): отложенная транзакция, которая сначала читает,
+	// не может потом перейти к записи и получает SQLITE_BUSY
+	// без ожидания busy_timeout.
+	dsn := "file:" + path +
+		"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)&_txlock=immediate"
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	s := SQLite{db: db}
+
+	if err := s.migrate(context.Background()); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("sqlite: migrate: %w", err)
+	}
+
+	if err := s.prepare(context.Background()); err != nil {
+		_ = s.Close()
+		return nil, fmt.Errorf("sqlite: prepare: %w", err)
+	}
+
+	return &s, nil
+}
+
+// migrate применяет миграции, которые еще не были применены.
+// Каждая миграция выполняется в своей транзакции.
+func (s *SQLite) migrate(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx,
+		`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`)
+	if err != nil {
+		return err
+	}
+
+	var current int
+	err = s.db.QueryRowContext(ctx,
+		`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	for i := current; i < len(migrations); i++ {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, migrations[i]); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO schema_migrations (version) VALUES (?)`, i+1); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, mapErr(err))
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// prepare готовит постоянные запросы.
+func (s *SQLite) prepare(ctx context.Context) error {
+	stmts := []struct {
+		dst   **sql.Stmt
+		query string
+	}{
+		{&s.items, qItems},
+		{&s.item, qItem},
+		{&s.add, qCreate},
+		{&s.upd, qUpdate},
+		{&s.del, qDelete},
+		{&s.exist, qExists},
+	}
+
+	for _, st := range stmts {
+		stmt, err := s.db.PrepareContext(ctx, st.query)
+		if err != nil {
+			return err
+		}
+		*st.dst = stmt
+	}
+	return nil
+}
+
+// Close закрывает подготовленные запросы и соединение с БД.
+func (s *SQLite) Close() error {
+	for _, stmt := range []*sql.Stmt{s.items, s.item, s.add, s.upd, s.del, s.exist} {
+		if stmt != nil {
+			_ = stmt.Close()
+		}
+	}
+	return s.db.Close()
+}
+
+// Ping проверяет, что файл БД доступен.
+func (s *SQLite) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// mapErr переводит ошибки БД в ошибки domain: отсутствие строки
+// в domain.ErrNotFound, нарушение уникальности в domain.ErrConflict.
+func mapErr(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return domain.ErrNotFound
+	}
+
+	var serr *sqlite.Error
+	if errors.As(err, &serr) {
+		switch serr.Code() {
+		case sqlite3.SQLITE_CONSTRAINT_UNIQUE, sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY:
+			return fmt.Errorf("%w: %v", domain.ErrConflict, err)
+		}
+	}
+	return err
+}
+
+// scanner общий интерфейс *sql.Row и *sql.Rows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanItem(row scanner) (item, error) {
+	var it item
+	err := row.Scan(&it.ID, &it.Name, &it.Version)
+	return it, mapErr(err)
+}
+
+// collect читает все строки результата.
+func collect(rows *sql.Rows, capacity int) ([]item, error) {
+	defer rows.Close()
+
+	out := make([]item, 0, capacity)
+	for rows.Next() {
+		it, err := scanItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, it)
+	}
+	return out, mapErr(rows.Err())
+}
+
+// Items возвращает списком все объекты из БД.
+func (s *SQLite) Items(ctx context.Context) ([]item, error) {
+	rows, err := s.items.QueryContext(ctx)
+	if err != nil {
+		return nil, mapErr(err)
+	}
+	return collect(rows, 0)
+}
+
+// IterateItems обходит объекты по порядку id, читая строки
+// результата по одной.
+func (s *SQLite) IterateItems(ctx context.Context, fn func(item) error) error {
+	rows, err := s.items.QueryContext(ctx)
+	if err != nil {
+		return mapErr(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		it, err := scanItem(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(it); err != nil {
+			return err
+		}
+	}
+	return mapErr(rows.Err())
+}
+
+// Item находит объект по id.
+// Возвращает ошибку domain.ErrNotFound в случае если объект не найден.
+func (s *SQLite) Item(ctx context.Context, id int64) (item, error) {
+	return scanItem(s.item.QueryRowContext(ctx, id))
+}
+
+// ListItems возвращает страницу объектов по запросу.
+// Фильтрация, сортировка и ограничение размера страницы
+// выполняются на стороне БД.
+func (s *SQLite) ListItems(ctx context.Context, q domain.ListQuery) (domain.ItemsPage, error) {
+	query, args := listQuery(q)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return domain.ItemsPage{}, mapErr(err)
+	}
+
+	items, err := collect(rows, q.PageLimit()+1)
+	if err != nil {
+		return domain.ItemsPage{}, err
+	}
+	return q.Cut(items), nil
+}
+
+// listQuery строит SQL-запрос страницы списка. Запрашивается
+// на один объект больше размера страницы, чтобы узнать,
+// есть ли следующая страница.
+func listQuery(q domain.ListQuery) (string, []any) {
+	var (
+		conds []string
+		args  []any
+	)
+
+	// instr, в отличие от LIKE, чувствителен к регистру
+	// и не требует экранирования шаблонов
+	if q.NamePrefix != "" {
+		conds = append(conds, "instr(name, ?) = 1")
+		args = append(args, q.NamePrefix)
+	}
+	if q.NameContains != "" {
+		conds = append(conds, "instr(name, ?) > 0")
+		args = append(args, q.NameContains)
+	}
+
+	op, dir := ">", "ASC"
+	if q.Desc {
+		op, dir = "<", "DESC"
+	}
+
+	if q.After != nil {
+		if q.Sort == domain.SortByName {
+			conds = append(conds, fmt.Sprintf("(name %[1]s ? OR (name = ? AND id %[1]s ?))", op))
+			args = append(args, q.After.Name, q.After.Name, q.After.ID)
+		} else {
+			conds = append(conds, "id "+op+" ?")
+			args = append(args, q.After.ID)
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("SELECT id, name, version FROM items")
+	if len(conds) > 0 {
+		b.WriteString(" WHERE ")
+		b.WriteString(strings.Join(conds, " AND "))
+	}
+	if q.Sort == domain.SortByName {
+		fmt.Fprintf(&b, " ORDER BY name %[1]s, id %[1]s", dir)
+	} else {
+		fmt.Fprintf(&b, " ORDER BY id %s", dir)
+	}
+	b.WriteString(" LIMIT ?")
+	args = append(args, q.PageLimit()+1)
+
+	return b.String(), args
+}
+
+// stmt возвращает подготовленный запрос для выполнения
+// в транзакции tx или вне транзакции, если tx равна nil.
+func stmt(ctx context.Context, tx *sql.Tx, st *sql.Stmt) *sql.Stmt {
+	if tx == nil {
+		return st
+	}
+	return tx.StmtContext(ctx, st)
+}
+
+// CreateItem добавляет в БД объект, присваивая ему новый id.
+func (s *SQLite) CreateItem(ctx context.Context, it item) (item, error) {
+	it.ID = 0
+	return s.create(ctx, nil, it)
+}
+
+// create добавляет объект с id it.ID, а если он равен 0 - с новым id.
+// Занятый id дает ошибку domain.ErrConflict.
+func (s *SQLite) create(ctx context.Context, tx *sql.Tx, it item) (item, error) {
+	return scanItem(stmt(ctx, tx, s.add).QueryRowContext(ctx, it.ID, it.Name))
+}
+
+// UpdateItem обновляет в БД объект и увеличивает его версию.
+// Если item.Version не 0, то объект обновляется, только если
+// его версия совпадает с item.Version.
+// Возвращает ошибку domain.ErrNotFound в случае если объект не найден
+// и domain.ErrConflict, если версия не совпала.
+func (s *SQLite) UpdateItem(ctx context.Context, it item) (item, error) {
+	return s.update(ctx, nil, it)
+}
+
+func (s *SQLite) update(ctx context.Context, tx *sql.Tx, it item) (item, error) {
+	updated, err := scanItem(stmt(ctx, tx, s.upd).QueryRowContext(ctx, it.Name, it.ID, it.Version, it.Version))
+	if errors.Is(err, domain.ErrNotFound) {
+		return item{}, s.mismatch(ctx, tx, it.ID)
+	}
+	return updated, err
+}
+
+// DeleteItem удаляет из БД объект по id. Если version не 0,
+// то объект удаляется, только если его версия совпадает с version.
+// Возвращает ошибку domain.ErrNotFound в случае если объект не найден
+// и domain.ErrConflict, если версия не совпала.
+func (s *SQLite) DeleteItem(ctx context.Context, id, version int64) error {
+	return s.delete(ctx, nil, id, version)
+}
+
+func (s *SQLite) delete(ctx context.Context, tx *sql.Tx, id, version int64) error {
+	res, err := stmt(ctx, tx, s.del).ExecContext(ctx, id, version, version)
+	if err != nil {
+		return mapErr(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return s.mismatch(ctx, tx, id)
+	}
+	return nil
+}
+
+// ModifyItem изменяет объект функцией fn. Запись выполняется
+// условным UPDATE по прочитанной версии и повторяется, если
+// объект успели изменить.
+func (s *SQLite) ModifyItem(ctx context.Context, id, version int64, fn domain.ModifyFunc) (item, error) {
+	return domain.Modify(ctx, s, id, version, fn)
+}
+
+// Batch выполняет пакет операций в одной транзакции.
+// Каждая операция - один запрос, который либо применяется
+// целиком, либо не меняет БД, поэтому неудачная операция
+// неатомарного пакета не мешает остальным. Атомарный пакет
+// при первой ошибке откатывает транзакцию.
+func (s *SQLite) Batch(ctx context.Context, ops []domain.BatchOperation, atomic bool) ([]domain.BatchResult, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, mapErr(err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	results := make([]domain.BatchResult, len(ops))
+	for i, op := range ops {
+		it, created, err := s.batchOp(ctx, tx, op)
+		switch {
+		case err == nil:
+		case !domain.IsOpError(err):
+			return nil, err // ошибка БД, а не операции
+		case atomic:
+			return domain.Abort(ops, i, err), nil
+		default:
+			it = item{ID: op.Item.ID}
+		}
+		results[i] = domain.BatchResult{Item: it, Created: created && err == nil, Err: err}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, mapErr(err)
+	}
+	return results, nil
+}
+
+// batchOp выполняет одну операцию пакета в транзакции tx
+// и сообщает, создала ли она объект.
+func (s *SQLite) batchOp(ctx context.Context, tx *sql.Tx, op domain.BatchOperation) (item, bool, error) {
+	switch op.Op {
+	case domain.BatchPut:
+		var exists bool
+		if err := stmt(ctx, tx, s.exist).QueryRowContext(ctx, op.Item.ID).Scan(&exists); err != nil {
+			return item{}, false, mapErr(err)
+		}
+		if exists {
+			it, err := s.update(ctx, tx, op.Item)
+			return it, false, err
+		}
+		it, err := s.create(ctx, tx, op.Item)
+		return it, true, err
+	case domain.BatchCreate:
+		it, err := s.create(ctx, tx, op.Item)
+		return it, true, err
+	case domain.BatchUpdate:
+		it, err := s.update(ctx, tx, op.Item)
+		return it, false, err
+	case domain.BatchDelete:
+		return item{ID: op.Item.ID}, false, s.delete(ctx, tx, op.Item.ID, op.Item.Version)
+	}
+	return item{}, false, domain.ErrUnknownOp
+}
+
+// mismatch выясняет, почему условное изменение объекта
+// не затронуло ни одной строки: объекта нет в БД
+// (domain.ErrNotFound) или не совпала версия (domain.ErrConflict).
+func (s *SQLite) mismatch(ctx context.Context, tx *sql.Tx, id int64) error {
+	var exists bool
+	if err := stmt(ctx, tx, s.exist).QueryRowContext(ctx, id).Scan(&exists); err != nil {
+		return mapErr(err)
+	}
+	if !exists {
+		return domain.ErrNotFound
+	}
+	return domain.ErrConflict
+}
@@ -0,0 +1,72 @@
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/rtemka/rbtest/domain"
+	"github.com/rtemka/rbtest/pkg/repo/repotest"
+)
+
+func open(t *testing.T, path string) *SQLite {
+	t.Helper()
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open() = err %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func TestConformance(t *testing.T) {
+	repotest.RunConformance(t, func(t *testing.T) domain.Repository {
+		return open(t, filepath.Join(t.TempDir(), "items.db"))
+	})
+}
+
+func TestMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "items.db")
+
+	db := open(t, path)
+	created, err := db.CreateItem(context.Background(), item{Name: "kept"})
+	if err != nil {
+		t.Fatalf("CreateItem() = err %v", err)
+	}
+	_ = db.Close()
+
+	// повторное открытие не применяет миграции заново
+	db = open(t, path)
+
+	var version int
+	err = db.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version)
+	if err != nil {
+		t.Fatalf("schema_migrations = err %v", err)
+	}
+	if version != len(migrations) {
+		t.Errorf("schema version = %d, want %d", version, len(migrations))
+	}
+
+	got, err := db.Item(context.Background(), created.ID)
+	if err != nil {
+		t.Fatalf("Item() = err %v", err)
+	}
+	if got != created {
+		t.Errorf("Item() = %v, want %v", got, created)
+	}
+}
+
+func TestMapErr(t *testing.T) {
+	db := open(t, filepath.Join(t.TempDir(), "items.db"))
+
+	created, err := db.CreateItem(context.Background(), item{Name: "unique"})
+	if err != nil {
+		t.Fatalf("CreateItem() = err %v", err)
+	}
+
+	_, err = db.db.Exec(`INSERT INTO items (id, name) VALUES (?, ?)`, created.ID, "duplicate")
+	if err = mapErr(err); !errors.Is(err, domain.ErrConflict) {
+		t.Errorf("mapErr() = %v, want %v", err, domain.ErrConflict)
+	}
+}
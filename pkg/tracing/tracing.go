@@ -0,0 +1,104 @@
+// Пакет tracing настраивает трассировку OpenTelemetry:
+// экспорт спанов и передачу контекста трассировки
+// в заголовках W3C Trace Context.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServiceName имя сервиса в спанах.
+const ServiceName = "rbtest"
+
+// Экспортеры спанов.
+const (
+	ExporterNone   = "none"   // трассировка выключена
+	ExporterStdout = "stdout" // JSON в стандартный вывод
+	ExporterFile   = "file"   // JSON в файл
+	ExporterOTLP   = "otlp"   // OTLP/HTTP, адрес задается переменными OTEL_EXPORTER_OTLP_*
+)
+
+// Setup настраивает глобальную трассировку с экспортером
+// exporter, для ExporterFile спаны дописываются в файл path.
+// Пустой exporter означает ExporterNone. Возвращает функцию,
+// которая отправляет оставшиеся спаны и закрывает экспортер.
+// Выборка спанов настраивается стандартными переменными
+// окружения OTEL_TRACES_SAMPLER и OTEL_TRACES_SAMPLER_ARG.
+func Setup(ctx context.Context, exporter, path string) (shutdown func(context.Context) error, err error) {
+	var exp sdktrace.SpanExporter
+	var closer io.Closer
+
+	switch exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+
+	case ExporterStdout:
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+
+	case ExporterFile:
+		if path == "" {
+			return nil, errors.New("trace file path must be set")
+		}
+		f, ferr := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if ferr != nil {
+			return nil, ferr
+		}
+		closer = f
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(f))
+
+	case ExporterOTLP:
+		exp, err = otlptracehttp.New(ctx)
+
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q, want %s, %s, %s or %s",
+			exporter, ExporterNone, ExporterStdout, ExporterFile, ExporterOTLP)
+	}
+	if err != nil {
+		if closer != nil {
+			_ = closer.Close()
+		}
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(),
+		resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(ServiceName)))
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if closer != nil {
+			err = errors.Join(err, closer.Close())
+		}
+		return err
+	}, nil
+}
+
+// End завершает span, отмечая в нем ошибку err, если она есть.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,56 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+)
+
+func TestSetup(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "spans.json")
+
+	tests := []struct {
+		exporter string
+		path     string
+		wantErr  bool
+	}{
+		{exporter: ""},
+		{exporter: ExporterNone},
+		{exporter: "jaeger", wantErr: true},
+		{exporter: ExporterFile, wantErr: true},
+		{exporter: ExporterFile, path: filepath.Join(t.TempDir(), "missing", "spans.json"), wantErr: true},
+		{exporter: ExporterFile, path: path},
+	}
+
+	for _, tt := range tests {
+		shutdown, err := Setup(ctx, tt.exporter, tt.path)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("Setup(%q, %q) = err %v, want error %t", tt.exporter, tt.path, err, tt.wantErr)
+		}
+		if err != nil {
+			continue
+		}
+
+		_, span := otel.Tracer("test").Start(ctx, "span-"+tt.exporter)
+		End(span, errors.New("boom"))
+		if err := shutdown(ctx); err != nil {
+			t.Fatalf("shutdown() = err %v", err)
+		}
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() = err %v", err)
+	}
+	for _, want := range []string{`"Name":"span-file"`, `"Code":"Error"`, `"boom"`, `"Value":"` + ServiceName + `"`} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("exported span %s does not contain %s", b, want)
+		}
+	}
+}